@@ -0,0 +1,106 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// AuditReportSender implements ReportSender by writing the DNS query for each
+// report to an audit log, and then optionally passing the report to another
+// ReportSender.  This allows an auditor (e.g. during QA) to inspect exactly
+// what would be sent over the wire, and confirm that no identifying data has
+// leaked into the query names.
+//
+// Each query is preceded by its length as a 2-byte big-endian integer, which
+// is the framing used for DNS over TCP (RFC 1035 section 4.2.2).  Use
+// ReadAuditLog to read the queries back, and Receiver.ParseQuery to decode
+// them.
+//
+// The audit log contains the full contents of each report, including the
+// bin, so it must be protected in the same way as the salt file.
+type AuditReportSender struct {
+	mu     sync.Mutex // Protects `w`.
+	w      io.Writer
+	suffix string
+	opts   QueryOptions
+	sender ReportSender
+}
+
+// NewAuditReportSender returns an AuditReportSender that writes queries for
+// `suffix` (unless the report has its own Suffix), formatted with `opts`, to
+// `w`.  If `sender` is not nil, each report is also passed to `sender` after
+// it has been written.
+func NewAuditReportSender(w io.Writer, suffix string, opts QueryOptions, sender ReportSender) *AuditReportSender {
+	return &AuditReportSender{
+		w:      w,
+		suffix: suffix,
+		opts:   opts,
+		sender: sender,
+	}
+}
+
+// Send writes the query for `r` to the audit log, and then passes `r` to the
+// underlying ReportSender, if any.  If the query can't be written, the report
+// is not sent.
+func (a *AuditReportSender) Send(r Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = a.suffix
+	}
+	query, err := FormatQueryWithOptions(r, suffix, a.opts)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+	frame = append(frame, query...)
+	a.mu.Lock()
+	_, err = a.w.Write(frame)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if a.sender == nil {
+		return nil
+	}
+	return a.sender.Send(r)
+}
+
+// ReadAuditLog returns the queries in an audit log that was written by an
+// AuditReportSender.
+func ReadAuditLog(r io.Reader) ([][]byte, error) {
+	var queries [][]byte
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return queries, nil
+			}
+			return queries, err
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, query); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return queries, err
+		}
+		queries = append(queries, query)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+)
+
+// # of bytes of HMAC output in each tag.  This is encoded as a 26-character
+// label.
+const tagsize = 16
+
+// ErrBadTag indicates that a report's authentication tag is missing or
+// incorrect.
+var ErrBadTag = errors.New("Report authentication failed")
+
+// Encodes tags using the Base32 alphabet, so that they are valid labels.
+var tagEncoding = base32.NewEncoding(string(Base32)).WithPadding(base32.NoPadding)
+
+// Computes the authentication tag for a name, given its labels (not
+// including the suffix or the tag itself).
+func computeTag(key []byte, labels []string) string {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, strings.Join(labels, "."))
+	return tagEncoding.EncodeToString(h.Sum(nil)[:tagsize])
+}
+
+// signingReportSender implements ReportSender by adding an authentication
+// tag to each report before passing it to another ReportSender.
+type signingReportSender struct {
+	key    []byte
+	sender ReportSender
+}
+
+// NewSigningReportSender returns a ReportSender that authenticates each
+// report with an HMAC tag, keyed by `key`, before passing it to `sender`.
+// The tag is encoded as an additional label immediately before the suffix,
+// and is verified and removed by a Receiver configured with the same AuthKey.
+//
+// This is intended for closed deployments (e.g. managed devices reporting to
+// a company's collector), where it prevents outsiders from submitting reports
+// that would inflate the bin counts.  However, every client that holds the key
+// is identifiable as a member of that deployment, and anyone who extracts the
+// key from a client can forge reports, so it should not be used by publicly
+// distributed software.  The tag adds 27 bytes to each name, which should be
+// included in WithMaxSuffixLength.
+func NewSigningReportSender(key []byte, sender ReportSender) ReportSender {
+	return &signingReportSender{key: key, sender: sender}
+}
+
+func (s *signingReportSender) Send(r Report) error {
+	r.tag = ""
+	r.tag = computeTag(s.key, labels(r))
+	return s.sender.Send(r)
+}
+
+// Verifies and removes the tag, which is the last of `labels`.
+func verifyTag(key []byte, labels []string) (rest []string, tag string, err error) {
+	if len(labels) == 0 {
+		return nil, "", ErrBadTag
+	}
+	last := len(labels) - 1
+	tag, rest = labels[last], labels[:last]
+	expected := computeTag(key, rest)
+	if !hmac.Equal([]byte(tag), []byte(expected)) {
+		return nil, "", ErrBadTag
+	}
+	return rest, tag, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// The media type of beacon messages.
+const beaconMessageType = "application/json"
+
+// A report as carried by a beacon, encoded by ReportName.
+type beaconMessage struct {
+	Name string `json:"name"`
+}
+
+// BeaconReportSender implements ReportSender by posting the name of each
+// report (see ReportName) directly to a collector over HTTP(S), as JSON.
+// This is an alternative for networks that block DNS to arbitrary servers
+// but allow HTTPS.  The name is the same as in a DNS query, so the
+// collector parses it with the same Receiver, and the bins provide the same
+// k-anonymity.
+//
+// Unlike the DNS transports, there is no resolver between the client and
+// the collector, so the collector learns the client's IP address and can
+// link each report to it.  This mode is only suitable for closed deployments
+// (e.g. a company's managed devices) where the operator of the collector is
+// already trusted with that information.
+type BeaconReportSender struct {
+	// The URL of the collector, e.g. "https://metrics.example/report",
+	// which is served by a BeaconHandler.
+	URL string
+	// The suffix for report names, which must match the collector's
+	// Receiver.  Reports with their own Suffix use it instead.
+	Suffix string
+	// The HTTP client for beacons.  The default is a client with a 30 second
+	// timeout.
+	Client *http.Client
+}
+
+// Send posts the name of `r` to the collector.  Any response other than a
+// 2xx status is an error.
+func (s *BeaconReportSender) Send(r Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = s.Suffix
+	}
+	name, err := ReportName(r, suffix)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(beaconMessage{Name: name})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", beaconMessageType)
+	client := s.Client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Beacon failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, udpLimit))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected HTTP status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// BeaconHandler is an http.Handler that receives beacons from a
+// BeaconReportSender, parses them with `Receiver`, and sends the reports to
+// `Reports`, e.g. the input of Filter.  It responds with 204 (No Content)
+// once the report has been accepted by the channel (or if it is a replay),
+// 400 if the beacon cannot be parsed, and 405 for methods other than POST.
+type BeaconHandler struct {
+	Receiver *Receiver
+	Reports  chan<- Report
+	// If set, a beacon whose report was accepted (or is being delivered)
+	// recently is acknowledged without being sent to Reports again.  See
+	// ReplayCache.
+	Replay *ReplayCache
+}
+
+func (h *BeaconHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msg beaconMessage
+	// A valid message is much smaller than a DNS message.
+	if err := json.NewDecoder(io.LimitReader(req.Body, udpLimit)).Decode(&msg); err != nil {
+		http.Error(w, "Malformed beacon", http.StatusBadRequest)
+		return
+	}
+	report, err := h.Receiver.ParseReport(msg.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.Replay != nil && !h.Replay.Reserve(msg.Name) {
+		// The report was already accepted, or is being delivered.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	select {
+	case h.Reports <- *report:
+		w.WriteHeader(http.StatusNoContent)
+	case <-req.Context().Done():
+		if h.Replay != nil {
+			h.Replay.Forget(msg.Name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	cacheKeySize   = 16
+	cacheEntrySize = 16
+	// Key, date in big-endian Unix seconds, and number of entries.
+	cacheHeaderSize = cacheKeySize + 8 + 4
+)
+
+// cacheFile persists the entries of a daily cache, so that they survive a
+// restart.  The file contains a header, followed by the entries, each of
+// which is an HMAC of a plaintext entry with a random key from the header.
+// The key is replaced whenever the date changes, so entries from earlier
+// days can't be tested against candidate domains, even if they remain in
+// the file.
+type cacheFile struct {
+	file  io.ReadWriteSeeker
+	key   [cacheKeySize]byte
+	count int // Number of entries in the file for the current date.
+}
+
+// Loads the cache from `file`, which may be empty, with the given daily
+// `budget` (zero means 1).  Each admitted report has its own entry, so an
+// entry appears in the file up to `budget` times.  A cache with a truncated
+// header is treated as empty, and a truncated entry is ignored, so that an
+// interrupted write doesn't prevent the Reporter from starting.
+func loadCache(file io.ReadWriteSeeker, budget int) (cache, error) {
+	f := &cacheFile{file: file}
+	c := cache{counts: make(map[string]int), budget: budget, file: f}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return cache{}, err
+	}
+	var header [cacheHeaderSize]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return c, nil
+		}
+		return cache{}, err
+	}
+	copy(f.key[:], header[:cacheKeySize])
+	c.date = time.Unix(int64(binary.BigEndian.Uint64(header[cacheKeySize:])), 0).UTC()
+	count := int(binary.BigEndian.Uint32(header[cacheKeySize+8:]))
+	if count > maxReports*c.limit() {
+		return cache{}, errors.New("Cache file has too many entries")
+	}
+	for ; f.count < count; f.count++ {
+		var entry [cacheEntrySize]byte
+		if _, err := io.ReadFull(file, entry[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return cache{}, err
+		}
+		c.counts[string(entry[:])]++
+	}
+	return c, nil
+}
+
+// Returns the entry to store in place of `entry`.
+func (f *cacheFile) hash(entry string) string {
+	mac := hmac.New(sha256.New, f.key[:])
+	mac.Write([]byte(entry))
+	return string(mac.Sum(nil)[:cacheEntrySize])
+}
+
+// Replaces the contents of the file with an empty cache for `date`, under a
+// new key.  Stale entries after the header are ignored, so the file doesn't
+// need to be truncated.
+func (f *cacheFile) reset(date time.Time) error {
+	if _, err := rand.Read(f.key[:]); err != nil {
+		return err
+	}
+	var header [cacheHeaderSize]byte
+	copy(header[:], f.key[:])
+	binary.BigEndian.PutUint64(header[cacheKeySize:], uint64(date.Unix()))
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.file.Write(header[:]); err != nil {
+		return err
+	}
+	f.count = 0
+	return nil
+}
+
+// Appends a hashed entry.  The entry is written before the count, so an
+// interrupted write leaves the file consistent.
+func (f *cacheFile) add(entry string) error {
+	if _, err := f.file.Seek(int64(cacheHeaderSize+f.count*cacheEntrySize), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f.file, entry); err != nil {
+		return err
+	}
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(f.count+1))
+	if _, err := f.file.Seek(cacheKeySize+8, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.file.Write(count[:]); err != nil {
+		return err
+	}
+	f.count++
+	return nil
+}
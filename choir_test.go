@@ -16,12 +16,30 @@ package choir
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -39,7 +57,7 @@ func init() {
 }
 
 func TestReportBuilder(t *testing.T) {
-	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country)
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,12 +103,17 @@ func (b testBinner) bin(key Key) string {
 	return string(b)
 }
 
+func (b testBinner) saltCreated() time.Time {
+	return time.Time{}
+}
+
 func TestReportBuilderExactBin(t *testing.T) {
 	bin := "test bin"
 	b := reportBuilder{
 		values:  2,
 		country: country,
 		binner:  testBinner(bin),
+		clock:   time.Now,
 	}
 	domain := "destination.example"
 	report, err := b.build(domain, testValues)
@@ -184,6 +207,178 @@ func TestParseReport(t *testing.T) {
 	}
 }
 
+func TestEmptySuffix(t *testing.T) {
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	for _, suffix := range []string{"", "."} {
+		if _, err := FormatQuery(report, suffix); !errors.Is(err, ErrEmptySuffix) {
+			t.Errorf("%q: expected ErrEmptySuffix from FormatQuery, got %v", suffix, err)
+		}
+		if _, err := AppendQuery(nil, report, suffix); !errors.Is(err, ErrEmptySuffix) {
+			t.Errorf("%q: expected ErrEmptySuffix from AppendQuery, got %v", suffix, err)
+		}
+		if _, err := ReportName(report, suffix); !errors.Is(err, ErrEmptySuffix) {
+			t.Errorf("%q: expected ErrEmptySuffix from ReportName, got %v", suffix, err)
+		}
+		r := Receiver{Suffix: suffix}
+		if _, err := r.ParseReport("q." + country + ".14131211.domain.example"); !errors.Is(err, ErrEmptySuffix) {
+			t.Errorf("%q: expected ErrEmptySuffix from ParseReport, got %v", suffix, err)
+		}
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	cache := NewReplayCache(time.Minute, 2)
+	cache.clock = func() time.Time { return now }
+	name := "q." + country + ".14131211.domain.example.metrics.example"
+	if !cache.Reserve(name) {
+		t.Error("Failed to reserve a new name")
+	}
+	// Case randomization doesn't evade the cache.
+	if cache.Reserve(strings.ToUpper(name)) {
+		t.Error("Expected a replay")
+	}
+	// Names are forgotten after the TTL, or when the cache is full.
+	now = now.Add(time.Minute)
+	if !cache.Reserve(name) {
+		t.Error("Name was not forgotten after the TTL")
+	}
+	cache.Reserve("r" + name[1:])
+	cache.Reserve("s" + name[1:])
+	if !cache.Reserve(name) {
+		t.Error("Name was not forgotten when the cache was full")
+	}
+	if cache.Reserve("s" + name[1:]) {
+		t.Error("Expected a replay")
+	}
+	// A forgotten name can be reserved again.
+	cache.Forget("s" + name[1:])
+	if !cache.Reserve("s" + name[1:]) {
+		t.Error("Forgotten name was not accepted")
+	}
+	if cache.Hits() != 2 {
+		t.Errorf("Expected 2 hits, got %d", cache.Hits())
+	}
+
+	// Parsing doesn't record the name.
+	r := Receiver{Suffix: "metrics.example"}
+	if _, err := r.ParseReport("t" + name[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.Reserve("t" + name[1:]) {
+		t.Error("Parsed name was recorded")
+	}
+
+	// A replayed beacon is acknowledged without being delivered again.
+	reports := make(chan Report, 2)
+	server := httptest.NewServer(&BeaconHandler{Receiver: &r, Reports: reports, Replay: cache})
+	defer server.Close()
+	report := Report{Key: NewKey("beacon.example", country, testDate), bin: "q"}
+	sender := &BeaconReportSender{URL: server.URL, Suffix: "metrics.example", Client: server.Client()}
+	for i := 0; i < 2; i++ {
+		if err := sender.Send(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports) != 1 {
+		t.Errorf("Expected one report, got %d", len(reports))
+	}
+}
+
+func TestReplayCacheCancelledDelivery(t *testing.T) {
+	cache := NewReplayCache(time.Minute, 10)
+	r := &Receiver{Suffix: "metrics.example"}
+	name, err := ReportName(Report{Key: NewKey("beacon.example", country, testDate), bin: "q"}, "metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"name":"` + name + `"}`
+
+	// The request is cancelled before anyone accepts the report.
+	blocked := &BeaconHandler{Receiver: r, Reports: make(chan Report), Replay: cache}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)).WithContext(ctx)
+	blocked.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The retry is delivered, because the first copy was not.
+	reports := make(chan Report, 1)
+	handler := &BeaconHandler{Receiver: r, Reports: reports, Replay: cache}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected status: %d", w.Code)
+	}
+	if len(reports) != 1 {
+		t.Errorf("Expected the retry to be delivered, got %d reports", len(reports))
+	}
+	if cache.Hits() != 0 {
+		t.Errorf("Expected no hits, got %d", cache.Hits())
+	}
+}
+
+func TestReplayCacheConcurrentDelivery(t *testing.T) {
+	cache := NewReplayCache(time.Minute, 10)
+	reports := make(chan Report)
+	handler := &BeaconHandler{Receiver: &Receiver{Suffix: "metrics.example"}, Reports: reports, Replay: cache}
+	name, err := ReportName(Report{Key: NewKey("beacon.example", country, testDate), bin: "q"}, "metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"name":"` + name + `"}`
+
+	// The first copy blocks until its report is received.
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		close(done)
+	}()
+	for {
+		cache.mu.Lock()
+		reserved := cache.recent.recent.Len()
+		cache.mu.Unlock()
+		if reserved > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// A duplicate that arrives meanwhile is acknowledged without delivery.
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if second.Code != http.StatusNoContent {
+		t.Errorf("Unexpected status: %d", second.Code)
+	}
+	<-reports
+	<-done
+	if first.Code != http.StatusNoContent {
+		t.Errorf("Unexpected status: %d", first.Code)
+	}
+	if cache.Hits() != 1 {
+		t.Errorf("Expected 1 hit, got %d", cache.Hits())
+	}
+}
+
+func TestParseReportMixedCase(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	name := "150Ms.HsTs.Q.zZ.14131211.DeStInAtIoN.eXaMpLe.MeTrIcS.eXaMpLe.CoM."
+	report, err := r.ParseReport(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Report{
+		Key:    NewKey("destination.example", "zz", testDate),
+		Values: []Value{{"150ms"}, {"hsts"}},
+		bin:    "q",
+	}
+	if !report.Equal(expected) {
+		t.Errorf("%v != %v", report, expected)
+	}
+}
+
 func TestMismatchSuffix(t *testing.T) {
 	r := Receiver{
 		Suffix: "metrics.example.com",
@@ -195,14 +390,278 @@ func TestMismatchSuffix(t *testing.T) {
 	}
 }
 
+func TestParseErrorDiagnostic(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	_, err := r.ParseReport("v1.v2.q.zz.14131211.domain.example.wrong.suffix")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	if parseErr.Error() != "name is missing suffix" {
+		t.Errorf("The default message should be unchanged: %s", parseErr.Error())
+	}
+	d := parseErr.Diagnostic()
+	for _, s := range []string{`"metrics.example.com"`, "2 values", `"wrong" "suffix"`} {
+		if !strings.Contains(d, s) {
+			t.Errorf("Diagnostic %q should contain %s", d, s)
+		}
+	}
+}
+
 func TestShortName(t *testing.T) {
 	r := Receiver{
 		Suffix: "metrics.example.com",
 		Values: 3,
 	}
 	_, err := r.ParseReport("bin.short.name.country.date.metrics.example.com")
-	if err == nil {
-		t.Error("Parsing should have failed")
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("Expected ErrSchemaMismatch, got %v", err)
+	}
+}
+
+func TestMissingValue(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	// The client sent only one value, so the server would interpret "q" as
+	// the second value, "zz" as the bin, "14131211" as the country, and
+	// "destination" as the date.
+	_, err := r.ParseReport("150ms.q.zz.14131211.destination.example.metrics.example.com")
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("Expected ErrSchemaMismatch, got %v", err)
+	}
+}
+
+func TestExtraValue(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 1,
+	}
+	// The client sent two values, so the server would interpret "hsts" as the
+	// bin, "q" as the country, and "zz" as the date.
+	_, err := r.ParseReport("150ms.hsts.q.zz.14131211.destination.example.metrics.example.com")
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("Expected ErrSchemaMismatch, got %v", err)
+	}
+}
+
+func TestSchemaMismatch(t *testing.T) {
+	report := Report{Key: NewKey("www.destination.example", country, testDate), Values: testValues, bin: "q"}
+	query, err := FormatQuery(report, "metrics.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, values := range []int{0, 1, 3, 4} {
+		r := Receiver{Suffix: "metrics.example.com", Values: values}
+		if parsed, err := r.ParseQuery(query); !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("Expected ErrSchemaMismatch for %d values, got %v, %v", values, parsed, err)
+		}
+	}
+	r := Receiver{Suffix: "metrics.example.com", Values: 2, CompactDate: true}
+	if _, err := r.ParseQuery(query); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("Expected ErrSchemaMismatch for the wrong date encoding, got %v", err)
+	}
+}
+
+func TestParseReportTooManyLabels(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	name := strings.Repeat("v.", 1000) + "q.zz.14131211.destination.example.metrics.example.com"
+	if _, err := r.ParseReport(name); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("Expected ErrNameTooLong, got %v", err)
+	}
+
+	r.Values = 1000
+	if _, err := r.ParseReport(name); err == nil {
+		t.Error("Expected an error due to an unreasonable number of values")
+	}
+}
+
+func TestNumericDomainLabel(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 1,
+	}
+	// The first label of the domain looks like a date, but is not one.
+	_, err := r.ParseReport("150ms.q.zz.14131211.12345678.example.metrics.example.com")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNoCountry(t *testing.T) {
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, NoCountry, reporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := b.build("destination.example", testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Country != NoCountry {
+		t.Errorf("Unexpected country: %s", report.Country)
+	}
+
+	receiver := Receiver{
+		Suffix:    "metrics.example.com",
+		Values:    2,
+		NoCountry: true,
+	}
+	if parsed := queryRoundtrip(t, receiver, report); !parsed.Equal(report) {
+		t.Errorf("%v != %v", parsed, report)
+	}
+
+	// The client and server must agree.
+	receiver.NoCountry = false
+	if _, err := receiver.ParseReport(name(report, receiver.Suffix)); err == nil {
+		t.Error("Expected an error due to an unexpected NoCountry report")
+	}
+	receiver.NoCountry = true
+	report.Country = country
+	if _, err := receiver.ParseReport(name(report, receiver.Suffix)); err == nil {
+		t.Error("Expected an error due to a report with a country")
+	}
+}
+
+func TestNewCountry(t *testing.T) {
+	for input, expected := range map[string]Country{
+		"us":      "us",
+		"US":      "us",
+		"zz":      UnknownCountry,
+		NoCountry: NoCountry,
+	} {
+		if c, err := NewCountry(input); err != nil || c != expected {
+			t.Errorf("NewCountry(%q) = %q, %v", input, c, err)
+		}
+	}
+	for _, input := range []string{"", "u", "usa", "u1", "0a", "é"} {
+		if _, err := NewCountry(input); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+	if _, err := newReportBuilder(new(bytes.Buffer), 32, 2, "u1", reporterConfig{}); err == nil {
+		t.Error("Expected an error due to an invalid country")
+	}
+
+	receiver := Receiver{Suffix: "metrics.example.com", Values: 2}
+	report := Report{Key: NewKey("destination.example", "u1", testDate), Values: testValues, bin: "q"}
+	if _, err := receiver.ParseReport(name(report, receiver.Suffix)); err == nil {
+		t.Error("Expected an error due to an invalid country label")
+	}
+}
+
+func TestCompactDate(t *testing.T) {
+	date := time.Date(2021, time.March, 4, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return date.Add(time.Hour) }
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{compactDate: true, clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := b.build("destination.example", testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 428 days after 2020-01-01 is "anm" in Base32.
+	if l := labels(report); l[4] != "anm" {
+		t.Errorf("Wrong compact date label: %s", l[4])
+	}
+	standard := report
+	standard.compactDate = false
+	if saved := nameLength(standard, 0) - nameLength(report, 0); saved != 5 {
+		t.Errorf("Expected to save 5 characters, saved %d", saved)
+	}
+
+	receiver := Receiver{Suffix: "metrics.example.com", Values: 2, CompactDate: true}
+	parsed := queryRoundtrip(t, receiver, report)
+	if !parsed.Equal(report) || !parsed.Date.Equal(date) {
+		t.Errorf("%v != %v", parsed, report)
+	}
+	if name(*parsed, receiver.Suffix) != name(report, receiver.Suffix) {
+		t.Error("Parsed report has a different name")
+	}
+	// The client and server must agree.
+	receiver.CompactDate = false
+	if _, err := receiver.ParseReport(name(report, receiver.Suffix)); err == nil {
+		t.Error("Expected an error due to a compact date")
+	}
+	receiver.CompactDate = true
+	if _, err := receiver.ParseReport(name(standard, receiver.Suffix)); err == nil {
+		t.Error("Expected an error due to a standard date")
+	}
+
+	// The compact date survives a queue.
+	buf := new(bytes.Buffer)
+	report.Date = today()
+	if err := NewQueueReportSender(buf, 1).Send(report); err != nil {
+		t.Fatal(err)
+	}
+	var f funcReportSender = func(r Report) error {
+		if name(r, "") != name(report, "") {
+			t.Errorf("Queued report has a different name: %s", name(r, ""))
+		}
+		return nil
+	}
+	if _, err := DrainQueue(buf, f, today()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []time.Time{compactDateEpoch.AddDate(0, 0, -1), compactDateEpoch.AddDate(0, 0, 1<<15)} {
+		if _, err := b.buildWithDate(d, "destination.example", testValues); err == nil {
+			t.Errorf("Expected an error for %v", d)
+		}
+	}
+	for _, d := range []time.Time{compactDateEpoch, compactDateEpoch.AddDate(0, 0, 1<<15-1)} {
+		parsed, err := parseCompactDate(formatDate(d, true))
+		if err != nil || !parsed.Equal(d) {
+			t.Errorf("Round trip failed for %v: %v, %v", d, parsed, err)
+		}
+	}
+}
+
+func TestAmbiguousValues(t *testing.T) {
+	// Values that look like a bin, a country, and a date.
+	var values []Value
+	for _, s := range []string{"q", "us", "20191218"} {
+		v, _ := NewValue(s)
+		values = append(values, v)
+	}
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 3, country, reporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := b.build("destination.example", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The positional parse is correct if the value count is correct.
+	receiver := Receiver{Suffix: "metrics.example.com", Values: 3}
+	if parsed := queryRoundtrip(t, receiver, report); !parsed.Equal(report) {
+		t.Errorf("%v != %v", parsed, report)
+	}
+
+	b.rejectAmbiguous = true
+	for _, v := range values {
+		vs := []Value{testValues[0], testValues[1], v}
+		if _, err := b.build("destination.example", vs); !errors.Is(err, ErrAmbiguousValue) {
+			t.Errorf("Expected ErrAmbiguousValue for %s, got %v", v, err)
+		}
+	}
+	// Values that only resemble a field are permitted.
+	for _, s := range []string{"q2", "usa", "20191318", "1234567"} {
+		v, _ := NewValue(s)
+		if _, err := b.build("destination.example", []Value{v, v, v}); err != nil {
+			t.Errorf("Unexpected error for %s: %v", s, err)
+		}
+	}
+	b.compactDate = true
+	if _, err := b.build("destination.example", []Value{testValues[0], testValues[1], {"anm"}}); !errors.Is(err, ErrAmbiguousValue) {
+		t.Errorf("Expected ErrAmbiguousValue for a compact date, got %v", err)
 	}
 }
 
@@ -241,7 +700,7 @@ func TestReportRoundtrip(t *testing.T) {
 func TestBins(t *testing.T) {
 	domain := "destination.example"
 	for bins := 1; bins <= 255; bins++ {
-		builder, err := newReportBuilder(new(bytes.Buffer), bins, 2, country)
+		builder, err := newReportBuilder(new(bytes.Buffer), bins, 2, country, reporterConfig{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -261,296 +720,3952 @@ func TestBins(t *testing.T) {
 	}
 }
 
-func TestNoValues(t *testing.T) {
+func TestNameTooLong(t *testing.T) {
 	suffix := "metrics.example.com"
-	report := Report{
-		Key: Key{
-			Domain:  "destination.example",
-			Country: country,
-			Date:    testDate,
-		},
-		Values: nil, // This is the purpose of this test.
-		bin:    "q",
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{suffixLength: len(suffix)})
+	if err != nil {
+		t.Fatal(err)
 	}
-	name := name(report, suffix)
-	if !strings.HasPrefix(name, "q.") {
-		t.Errorf("%s doesn't start with the bin", name)
+	// Each value is 63 bytes, so the values take up 128 bytes including the
+	// following dots, and the bin, country, and date add 14 more.  With the
+	// suffix and its leading dot, 91 bytes remain for the domain.
+	v := strings.Repeat("v", 63)
+	v1, _ := NewValue(v)
+	values := []Value{v1, v1}
+	domain := strings.Repeat("d", 51) + "." + strings.Repeat("e", 39)
+	report, err := b.build(domain, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(name(report, suffix)); n != MaxNameLength {
+		t.Errorf("Expected a name of length %d, got %d", MaxNameLength, n)
+	}
+	if _, err := formatQuery(name(report, suffix), QueryOptions{}); err != nil {
+		t.Errorf("A name at the maximum length should be valid: %v", err)
+	}
+
+	// One more byte is too long.
+	if _, err := b.build("x"+domain, values); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("Expected ErrNameTooLong, got %v", err)
 	}
 }
 
-func TestFormat(t *testing.T) {
-	name := "abcd.efgh.i.jklm.nop.example"
-	query, err := formatQuery(name)
+func TestSingleLabelDomain(t *testing.T) {
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	msg := dnsmessage.Message{}
-	if err := msg.Unpack(query); err != nil {
-		t.Fatal(err)
-	}
-	if msg.Header.OpCode != 0 {
-		t.Error("Message is not a question")
+	if _, err := b.build("localhost", testValues); !errors.Is(err, ErrSingleLabelDomain) {
+		t.Errorf("Expected ErrSingleLabelDomain, got %v", err)
 	}
-	if !msg.Header.RecursionDesired {
-		t.Error("Query doesn't request recursion")
+	if _, err := b.build("localhost.", testValues); !errors.Is(err, ErrSingleLabelDomain) {
+		t.Errorf("Expected ErrSingleLabelDomain, got %v", err)
 	}
-	question := msg.Questions[0]
-	expectedQuestion := dnsmessage.Question{
-		Name:  dnsmessage.MustNewName(name + "."),
-		Type:  dnsmessage.TypeTXT,
-		Class: dnsmessage.ClassINET,
+
+	b, err = newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{singleLabel: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if question != expectedQuestion {
-		t.Errorf("%v != %v", question, expectedQuestion)
+	report, err := b.build("Wiki", testValues)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(msg.Additionals) != 1 {
-		t.Error("Expected 1 additional record for EDNS0")
+	if report.Domain != "wiki" {
+		t.Errorf("Wrong domain: %s", report.Domain)
 	}
 }
 
-func TestFormatTooLong(t *testing.T) {
-	// Name contains a 64-character label, but the limit is 63.
-	name := "a.b.c.0123456789012345678901234567890123456789012345678901234567890123.example"
-	if _, err := formatQuery(name); err == nil {
-		t.Error("Expected an error due to disallowed label")
+func TestEmptyDomain(t *testing.T) {
+	// Single-label domains are permitted, but the empty domain is not.
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{singleLabel: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestValueTooLong(t *testing.T) {
-	// Value has length 64, but the limit is 63.
-	v := "0123456789012345678901234567890123456789012345678901234567890123"
-	if _, err := NewValue(v); err == nil {
-		t.Error("Expected an error due to length limit")
+	for _, domain := range []string{"", "."} {
+		if _, err := b.build(domain, testValues); !errors.Is(err, ErrEmptyDomain) {
+			t.Errorf("%q: expected ErrEmptyDomain, got %v", domain, err)
+		}
 	}
 }
 
-func TestValueUpperCase(t *testing.T) {
-	if _, err := NewValue("Asdf"); err == nil {
-		t.Error("Expected failure due to upper-case character")
+func TestNormalizeDomain(t *testing.T) {
+	if d, err := NormalizeDomain("WWW.Example."); err != nil || d != "www.example" {
+		t.Errorf("Unexpected result: %q, %v", d, err)
+	}
+	if _, err := NormalizeDomain("localhost"); !errors.Is(err, ErrSingleLabelDomain) {
+		t.Errorf("Expected ErrSingleLabelDomain, got %v", err)
+	}
+	if _, err := NormalizeDomain(strings.Repeat("a", 300) + ".example"); err == nil {
+		t.Error("Expected an error due to a long domain")
 	}
 }
 
-func TestValueUnicode(t *testing.T) {
-	if _, err := NewValue("a⌘cd"); err == nil {
-		t.Error("Expected failure due to non-ASCII character")
+func TestMaxReportNameLength(t *testing.T) {
+	suffix := "metrics.example."
+	for _, bins := range []int{1, 32, 33, 1025} {
+		b, err := newReportBuilder(new(bytes.Buffer), bins, 3, country, reporterConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		long, _ := NewValue(strings.Repeat("v", 20))
+		short, _ := NewValue("v")
+		domain := "destination.example"
+		report, err := b.build(domain, []Value{long, short, long})
+		if err != nil {
+			t.Fatal(err)
+		}
+		max := MaxReportNameLength(3, 20, suffix, bins)
+		// The name of this report is shorter than the worst case by the
+		// shorter value.
+		if length := len(name(report, "metrics.example")) - len(domain); length != max-19 {
+			t.Errorf("%d bins: %d != %d", bins, length, max-19)
+		}
+	}
+	if budget := MaxNameLength - MaxReportNameLength(2, 63, "metrics.example", 32); budget != 95 {
+		t.Errorf("Wrong domain budget: %d", budget)
 	}
 }
 
-func TestValueWithDot(t *testing.T) {
-	if _, err := NewValue("asdf.1234"); err == nil {
-		t.Error("Expected failure due to '.' in Value")
+func TestSuffixes(t *testing.T) {
+	suffixes := []string{"a.metrics.example", "B.metrics.example."}
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{suffixes: suffixes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		report, err := b.build("destination.example", testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[report.Suffix()]++
+	}
+	if len(counts) != 2 || counts["a.metrics.example"] == 0 || counts["b.metrics.example"] == 0 {
+		t.Errorf("Expected both normalized suffixes to be used: %v", counts)
 	}
-}
 
-func TestFilter(t *testing.T) {
-	c := make(chan Report)
-	f := Filter(c, 2)
+	if _, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{suffixes: []string{""}}); err == nil {
+		t.Error("Expected an error due to an empty suffix")
+	}
+}
 
-	key := Key{
-		Domain:  "d1.example",
-		Country: "zz",
-		Date:    testDate,
+func TestSharedSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	config := reporterConfig{sharedSecret: secret}
+	// The file is unused, so it can be nil.
+	b1, err := newReportBuilder(nil, 1024, 2, country, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := newReportBuilder(nil, 1024, 2, country, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newReportBuilder(nil, 1024, 2, country, reporterConfig{sharedSecret: []byte("fedcba9876543210")})
+	if err != nil {
+		t.Fatal(err)
 	}
+	same := 0
 	for i := 0; i < 10; i++ {
-		vi, _ := NewValue(strconv.Itoa(i))
-		c <- Report{
-			Key:    key,
-			Values: []Value{vi},
-			bin:    "1",
+		domain := fmt.Sprintf("domain%d.example", i)
+		r1, err := b1.build(domain, testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r2, err := b2.build(domain, testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r1.bin != r2.bin {
+			t.Errorf("Bins differ with the same secret: %s != %s", r1.bin, r2.bin)
+		}
+		r3, err := other.build(domain, testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r1.bin == r3.bin {
+			same++
 		}
 	}
-	select {
-	case <-f:
-		t.Error("There should be no output from f yet")
-	default:
+	if same == 10 {
+		t.Error("Bins are the same with a different secret")
 	}
-	go func() {
-		v10, _ := NewValue("10")
-		c <- Report{
-			Key:    key,
-			Values: []Value{v10},
-			bin:    "2",
-		}
-		close(c)
-	}()
-	values := make([]int, 0)
-	for report := range f {
-		if report.Key != key {
-			t.Errorf("Mismatched key: %v != %v", report.Key, key)
+
+	binner, err := newSecretBinner(secret, 1024, Base32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(binner.salt(testDate), binner.salt(testDate.AddDate(0, 0, 1))) {
+		t.Error("The salt should change every day")
+	}
+	if _, err := newSecretBinner(secret[:15], 1024, Base32); err == nil {
+		t.Error("Expected an error due to a short secret")
+	}
+}
+
+func TestBinsBase36(t *testing.T) {
+	domain := "destination.example"
+	for _, bins := range []int{1, 36, 37, 1296, 1297} {
+		builder, err := newReportBuilder(new(bytes.Buffer), bins, 2, country, reporterConfig{alphabet: Base36})
+		if err != nil {
+			t.Fatal(err)
 		}
-		index, err := strconv.Atoi(report.Values[0].String())
+		report, err := builder.build(domain, testValues)
 		if err != nil {
 			t.Error(err)
 		}
-		values = append(values, index)
-	}
-	sort.Ints(values)
-	for i, v := range values {
-		if i != v {
-			t.Errorf("Problem with values: %v", values)
+		expected := Base36.width(bins)
+		if len(report.bin) != expected {
+			t.Errorf("Expected %d-char bin for %d bins: %s", expected, bins, report.bin)
+		}
+		if !Base36.contains(report.bin) {
+			t.Errorf("Bin %s is not in the alphabet", report.bin)
 		}
 	}
 }
 
-type channelReportSender chan Report
-
-func (s channelReportSender) Send(r Report) error {
-	s <- r
-	close(s)
-	return nil
+func TestAlphabetWidth(t *testing.T) {
+	cases := []struct {
+		alphabet Alphabet
+		bins     int
+		width    int
+	}{
+		{Base32, 1, 1},
+		{Base32, 32, 1},
+		{Base32, 33, 2},
+		{Base32, 1024, 2},
+		{Base32, 1025, 3},
+		{Base36, 36, 1},
+		{Base36, 37, 2},
+		{"01", 2, 1},
+		{"01", 3, 2},
+	}
+	for _, c := range cases {
+		if w := c.alphabet.width(c.bins); w != c.width {
+			t.Errorf("%q.width(%d) = %d, expected %d", c.alphabet, c.bins, w, c.width)
+		}
+	}
+	if s := Base32.encode(33, 2); s != "bb" {
+		t.Errorf("Unexpected encoding: %s", s)
+	}
 }
 
-func TestBurst(t *testing.T) {
-	burst := 200 * time.Millisecond
-	var c channelReportSender = make(chan Report)
-	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, burst, c)
+func TestBinLabels(t *testing.T) {
+	cases := []struct {
+		bins        int
+		first, last string
+	}{
+		{1, "a", "a"},
+		{32, "a", "7"},
+		{33, "aa", "ba"},
+		{1024, "aa", "77"},
+		{1025, "aaa", "baa"},
+	}
+	for _, c := range cases {
+		labels, err := Base32.BinLabels(c.bins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(labels) != c.bins || labels[0] != c.first || labels[len(labels)-1] != c.last {
+			t.Errorf("%d bins: got %d labels from %s to %s", c.bins, len(labels), labels[0], labels[len(labels)-1])
+		}
+		seen := newStringSet()
+		for _, label := range labels {
+			seen.add(label)
+		}
+		if seen.len() != c.bins {
+			t.Errorf("%d bins: labels are not distinct", c.bins)
+		}
+	}
+
+	// Every bin produced by the binner is in the list.
+	b, err := newHashBinner(new(bytes.Buffer), 33, Base32, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	v0, _ := NewValue("asdf")
-	for i := 0; i < 10; i++ {
-		v1, _ := NewValue(strconv.Itoa(i))
-		if err := r.Report(fmt.Sprintf("domain%d.example", i), v0, v1); err != nil {
-			t.Fatal(err)
+	labels, _ := Base32.BinLabels(33)
+	valid := newStringSet()
+	for _, label := range labels {
+		valid.add(label)
+	}
+	for i := 0; i < 100; i++ {
+		if bin := b.bin(NewKey(fmt.Sprintf("domain%d.example", i), country, testDate)); !valid.contains(bin) {
+			t.Errorf("Bin %s is not in the list", bin)
 		}
 	}
 
-	select {
-	case q := <-c:
-		t.Errorf("Channel shouldn't be ready yet, but got %v", q)
-	default:
+	if _, err := Base32.BinLabels(0); err == nil {
+		t.Error("Expected an error due to zero bins")
 	}
+	if _, err := Alphabet("a").BinLabels(2); err == nil {
+		t.Error("Expected an error due to a bad alphabet")
+	}
+}
 
-	// This should run after the burst duration.
-	report, ok := <-c
-	if !ok {
-		t.Fatal("Expected channel to get one entry before being closed")
+func TestBadAlphabet(t *testing.T) {
+	for _, a := range []Alphabet{"a", "aa", "aB", "a.b", "a⌘"} {
+		if _, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{alphabet: a}); err == nil {
+			t.Errorf("Expected an error for alphabet %q", a)
+		}
 	}
-	if report.Country != country || report.Values[0] != v0 {
-		t.Fatal("Wrong report", report)
+}
+
+func TestParseReportWrongAlphabet(t *testing.T) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 1,
+	}
+	// "0" is a valid Base36 bin, but not a valid Base32 bin.
+	name := "150ms.0.zz.14131211.destination.example.metrics.example.com"
+	if _, err := r.ParseReport(name); err == nil {
+		t.Error("Expected an error due to the bin alphabet")
+	}
+	r.Alphabet = Base36
+	if _, err := r.ParseReport(name); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestCache(t *testing.T) {
-	c := cache{}
-	k := Key{
-		Domain: "domain.example",
-		Date:   testDate,
+// A random report with `values` values, for testing/quick.
+type randomReport struct {
+	Report
+	values int
+}
+
+// Returns a random string of `n` characters from `chars`.
+func randomString(rand *rand.Rand, chars string, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[rand.Intn(len(chars))]
 	}
-	if added, _ := c.Add(k); !added {
-		t.Error("First add should succeed")
+	return string(b)
+}
+
+// Generate implements quick.Generator.
+func (randomReport) Generate(rand *rand.Rand, size int) reflect.Value {
+	const valueChars = "abcdefghijklmnopqrstuvwxyz0123456789-_"
+	const domainChars = "abcdefghijklmnopqrstuvwxyz0123456789-"
+	r := randomReport{values: rand.Intn(5)}
+	for i := 0; i < r.values; i++ {
+		r.Values = append(r.Values, Value{randomString(rand, valueChars, 1+rand.Intn(63))})
 	}
-	if added, _ := c.Add(k); added {
-		t.Error("Duplicate add should fail")
+	labels := make([]string, 2+rand.Intn(3))
+	for i := range labels {
+		labels[i] = randomString(rand, domainChars, 1+rand.Intn(20))
 	}
-	if added, _ := c.Add(k); added {
-		t.Error("Subsequent adds should still fail")
+	r.Key = Key{
+		Domain:  strings.Join(labels, "."),
+		Country: randomString(rand, "abcdefghijklmnopqrstuvwxyz", 2),
+		Date:    compactDateEpoch.AddDate(0, 0, rand.Intn(4000)),
 	}
+	r.bin = randomString(rand, string(Base32), 1+rand.Intn(2))
+	return reflect.ValueOf(r)
 }
 
-func TestCacheMaxReports(t *testing.T) {
-	c := cache{}
-	for i := 0; i < maxReports; i++ {
-		k := Key{
-			Domain: fmt.Sprintf("domain%d.example", i),
-			Date:   testDate,
-		}
-		if added, err := c.Add(k); !added {
-			t.Errorf("First add should succeed, but failed with err=%v", err)
-		}
-		if added, err := c.Add(k); added || err != nil {
-			t.Errorf("Duplicate add should fail without an error, err=%v", err)
+// Checks that `r` survives FormatQuery and ParseQuery, or that it is too
+// long to format.
+func checkQueryRoundtrip(r randomReport) error {
+	const suffix = "metrics.example.com"
+	receiver := Receiver{Suffix: suffix, Values: r.values, NoCountry: r.Country == NoCountry}
+	query, err := FormatQuery(r.Report, suffix)
+	if nameLength(r.Report, len(suffix)) > MaxNameLength {
+		if !errors.Is(err, ErrNameTooLong) {
+			return fmt.Errorf("Expected an error for a long name: %v", r.Report)
 		}
+		return nil
+	} else if err != nil {
+		return err
 	}
-	newKey := Key{
-		Domain: "newdomain.example",
-		Date:   testDate,
+	parsed, err := receiver.ParseQuery(query)
+	if err != nil {
+		return err
 	}
-	if _, err := c.Add(newKey); err == nil {
-		t.Error("After maxReports, all additions for that date should fail with an error")
+	if !parsed.Equal(r.Report) || parsed.bin != r.bin {
+		return fmt.Errorf("%v != %v", parsed, r.Report)
 	}
+	return nil
 }
 
-func TestCacheDateRollover(t *testing.T) {
-	c := cache{}
-	date1 := time.Date(2020, time.February, 02, 0, 0, 0, 0, time.UTC)
-	date2 := time.Date(2020, time.February, 03, 0, 0, 0, 0, time.UTC)
-	domain1 := "domain1.example"
-	domain2 := "domain2.example"
-	if added, _ := c.Add(Key{Domain: domain1, Date: date1}); !added {
-		t.Error("First add should succeed")
+func TestQueryRoundtripProperty(t *testing.T) {
+	// Edge cases from other tests.
+	seeds := []randomReport{
+		{Report: Report{Key: NewKey("domain.example", country, testDate), bin: "q"}},
+		{Report: Report{Key: NewKey("www.destination.example", country, testDate), Values: testValues, bin: "q"}, values: 2},
+		{Report: Report{Key: NewKey("a.b.c.d.example", "us", testDate), bin: "qq"}},
+		{Report: Report{Key: NewKey("domain.example", NoCountry, testDate), Values: []Value{{strings.Repeat("v", 63)}}, bin: "7"}, values: 1},
 	}
-	if added, _ := c.Add(Key{Domain: domain2, Date: date1}); !added {
-		t.Error("New domain on first date should succeed")
-	}
-	if added, _ := c.Add(Key{Domain: domain1, Date: date2}); !added {
-		t.Error("Addition for a new date should succeed")
+	for _, seed := range seeds {
+		if err := checkQueryRoundtrip(seed); err != nil {
+			t.Error(err)
+		}
 	}
-	if added, err := c.Add(Key{Domain: domain2, Date: date1}); added || err == nil {
-		t.Error("Addition for an old date should fail with an error")
+	f := func(r randomReport) bool {
+		if err := checkQueryRoundtrip(r); err != nil {
+			t.Log(err)
+			return false
+		}
+		return true
 	}
-	if added, _ := c.Add(Key{Domain: domain2, Date: date2}); !added {
-		t.Error("Re-addition for a new date should succeed")
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
 	}
 }
 
-type funcReportSender (func(Report) error)
-
-func (s funcReportSender) Send(r Report) error {
-	return s(r)
+// Formats `report` as a query, and parses it back from the question name.
+func queryRoundtrip(t *testing.T, receiver Receiver, report Report) *Report {
+	query, err := FormatQuery(report, receiver.Suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := receiver.ParseReport(msg.Questions[0].Name.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
 }
 
-func TestOnceADayReportSender(t *testing.T) {
-	var r *Report
-	var f funcReportSender = func(report Report) error {
-		r = &report
-		return nil
+func TestMultiCharBinRoundtrip(t *testing.T) {
+	receiver := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	// Bin counts on either side of each increase in the bin label length.
+	for _, bins := range []int{32, 33, 1024, 1025, 32768, 32769} {
+		width := Base32.width(bins)
+		// Check the first and last bins, and the one assigned by the builder.
+		b, err := newReportBuilder(new(bytes.Buffer), bins, 2, country, reporterConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		built, err := b.build("www.destination.example", testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := built
+		first.bin = Base32.encode(0, width)
+		last := built
+		last.bin = Base32.encode(uint64(bins-1), width)
+		for _, original := range []Report{built, first, last} {
+			if len(original.bin) != width {
+				t.Errorf("Expected a %d-char bin for %d bins, got %s", width, bins, original.bin)
+			}
+			parsed := queryRoundtrip(t, receiver, original)
+			if parsed.bin != original.bin {
+				t.Errorf("Bin mismatch for %d bins: %s != %s", bins, parsed.bin, original.bin)
+			}
+			if !parsed.Equal(original) {
+				t.Errorf("%v != %v", parsed, original)
+			}
+		}
 	}
-	s := newOnceADayReportSender(f)
+}
 
-	v1, _ := NewValue("test1")
-	r1 := Report{
+func TestNoValues(t *testing.T) {
+	suffix := "metrics.example.com"
+	report := Report{
 		Key: Key{
-			Domain:  "domain.example",
-			Date:    testDate,
+			Domain:  "destination.example",
 			Country: country,
+			Date:    testDate,
 		},
-		Values: []Value{v1},
+		Values: nil, // This is the purpose of this test.
 		bin:    "q",
 	}
-	if err := s.Send(r1); err != nil {
+	name := name(report, suffix)
+	if !strings.HasPrefix(name, "q.") {
+		t.Errorf("%s doesn't start with the bin", name)
+	}
+}
+
+func TestRequireValues(t *testing.T) {
+	if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, nil, WithRequireValues()); !errors.Is(err, ErrNoValues) {
+		t.Errorf("Expected ErrNoValues, got %v", err)
+	}
+	r, err := NewReporter(new(bytes.Buffer), 32, 1, country, time.Minute, nil, WithRequireValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.(ChannelReporter).Channel(0, "channel.example"); !errors.Is(err, ErrNoValues) {
+		t.Errorf("Expected ErrNoValues for a channel, got %v", err)
+	}
+	b := r.(*reporter).builder
+	b.values = 0
+	if _, err := b.build("domain.example", nil); !errors.Is(err, ErrNoValues) {
+		t.Errorf("Expected ErrNoValues from build, got %v", err)
+	}
+	// Zero values are permitted by default.
+	if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, nil); err != nil {
 		t.Error(err)
 	}
+}
+
+func TestFormat(t *testing.T) {
+	name := "abcd.efgh.i.jklm.nop.example"
+	query, err := formatQuery(name, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.OpCode != 0 {
+		t.Error("Message is not a question")
+	}
+	if !msg.Header.RecursionDesired {
+		t.Error("Query doesn't request recursion")
+	}
+	question := msg.Questions[0]
+	expectedQuestion := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name + "."),
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassINET,
+	}
+	if question != expectedQuestion {
+		t.Errorf("%v != %v", question, expectedQuestion)
+	}
+	if len(msg.Additionals) != 1 {
+		t.Error("Expected 1 additional record for EDNS0")
+	}
+}
+
+// The NULL record type, which dnsmessage does not define.
+const typeNULL = dnsmessage.Type(10)
+
+func TestFormatTypeAndClass(t *testing.T) {
+	name := "abcd.efgh.i.jklm.nop.example"
+	opts := QueryOptions{Type: typeNULL, Class: dnsmessage.ClassCHAOS}
+	query, err := formatQuery(name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	question := msg.Questions[0]
+	if question.Type != typeNULL || question.Class != dnsmessage.ClassCHAOS {
+		t.Errorf("Wrong type or class: %v", question)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := b.build("destination.example", testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := "metrics.example"
+	r := Receiver{Suffix: suffix, Values: 2}
+
+	query, err := FormatQuery(report, suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := r.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(report) {
+		t.Errorf("%v != %v", parsed, report)
+	}
+
+	// The Receiver expects TXT queries by default.
+	opts := QueryOptions{Type: typeNULL}
+	nullQuery, err := FormatQueryWithOptions(report, suffix, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ParseQuery(nullQuery); err == nil {
+		t.Error("Expected an error due to the wrong query type")
+	}
+	r.QueryType = typeNULL
+	if _, err := r.ParseQuery(nullQuery); err != nil {
+		t.Error(err)
+	}
+	if _, err := r.ParseQuery(query); err == nil {
+		t.Error("Expected an error due to the wrong query type")
+	}
+	if _, err := r.ParseQuery(query[:5]); err == nil {
+		t.Error("Expected an error due to a truncated query")
+	}
+}
+
+func TestFormatPadding(t *testing.T) {
+	for _, name := range []string{"a.example", strings.Repeat("a", 60) + ".example"} {
+		for _, block := range []int{1, 128, 468} {
+			query, err := formatQuery(name, QueryOptions{Padding: block})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(query)%block != 0 {
+				t.Errorf("Query length %d is not a multiple of %d", len(query), block)
+			}
+			msg := dnsmessage.Message{}
+			if err := msg.Unpack(query); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Questions[0].Name.String() != name+"." {
+				t.Errorf("Unexpected name: %s", msg.Questions[0].Name)
+			}
+			opt := msg.Additionals[0].Body.(*dnsmessage.OPTResource)
+			if len(opt.Options) != 2 || opt.Options[1].Code != 0xc {
+				t.Errorf("Expected a padding option: %v", opt.Options)
+			}
+		}
+	}
+	if _, err := formatQuery("a.example", QueryOptions{Padding: -1}); err == nil {
+		t.Error("Expected an error due to negative padding")
+	}
+	if _, err := formatQuery("a.example", QueryOptions{Padding: udpLimit + 1}); err == nil {
+		t.Error("Expected an error due to excessive padding")
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	report := Report{
+		Key:    NewKey("www.example", country, testDate),
+		Values: testValues,
+		bin:    "q",
+	}
+	prefix := []byte("prefix")
+	for _, opts := range []QueryOptions{{}, {Padding: 128}} {
+		expected, err := FormatQueryWithOptions(report, "metrics.example.com", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := AppendQueryWithOptions(append([]byte(nil), prefix...), report, "metrics.example.com", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:len(prefix)], prefix) || !bytes.Equal(buf[len(prefix):], expected) {
+			t.Errorf("Wrong appended query with %+v: %x", opts, buf)
+		}
+		// Reusing the buffer produces the same query.
+		if buf, err = AppendQueryWithOptions(buf[:0], report, "metrics.example.com", opts); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Errorf("Wrong query in reused buffer with %+v: %x", opts, buf)
+		}
+	}
+	buf, err := AppendQueryWithOptions(prefix, report, "metrics.example.com", QueryOptions{Padding: -1})
+	if err == nil {
+		t.Error("Expected an error due to negative padding")
+	}
+	if !bytes.Equal(buf, prefix) {
+		t.Errorf("Buffer was modified on error: %q", buf)
+	}
+}
+
+// Starts a fake resolver that responds to each query with the next RCode in
+// `rcodes`, and records whether each query had an EDNS Client Subnet option.
+func fakeResolver(t *testing.T, rcodes ...dnsmessage.RCode) (address string, ecs <-chan bool) {
+	return fakeResolverOn(t, "udp4", rcodes...)
+}
+
+// Like fakeResolver, but listens on the loopback address of `network` ("udp4"
+// or "udp6").  Returns an empty address if `network` is unavailable.
+func fakeResolverOn(t *testing.T, network string, rcodes ...dnsmessage.RCode) (address string, ecs <-chan bool) {
+	loopback := "127.0.0.1:0"
+	if network == "udp6" {
+		loopback = "[::1]:0"
+	}
+	conn, err := net.ListenPacket(network, loopback)
+	if err != nil {
+		if network == "udp6" {
+			return "", nil
+		}
+		t.Fatal(err)
+	}
+	ch := make(chan bool, len(rcodes))
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, udpLimit)
+		for _, rcode := range rcodes {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+			opt := query.Additionals[0].Body.(*dnsmessage.OPTResource)
+			hasECS := false
+			for _, o := range opt.Options {
+				hasECS = hasECS || o.Code == 0x8
+			}
+			ch <- hasECS
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: rcode},
+				Questions: query.Questions,
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), ch
+}
+
+func TestDNSReportSender(t *testing.T) {
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	address, ecs := fakeResolver(t, dnsmessage.RCodeNameError)
+	sender := &DNSReportSender{Resolver: address, Suffix: "metrics.example"}
+	if err := sender.Send(report); err != nil {
+		t.Fatal(err)
+	}
+	if !<-ecs {
+		t.Error("Expected a client subnet option")
+	}
+}
+
+func TestDNSReportSenderFallback(t *testing.T) {
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	for _, rcode := range []dnsmessage.RCode{dnsmessage.RCodeFormatError, dnsmessage.RCodeRefused} {
+		// Without the fallback, the rejection is an error.
+		address, ecs := fakeResolver(t, rcode)
+		sender := &DNSReportSender{Resolver: address, Suffix: "metrics.example"}
+		if err := sender.Send(report); err == nil {
+			t.Errorf("Expected an error for %v", rcode)
+		}
+		if !<-ecs {
+			t.Error("Expected a client subnet option")
+		}
+
+		address, ecs = fakeResolver(t, rcode, dnsmessage.RCodeNameError)
+		sender = &DNSReportSender{Resolver: address, Suffix: "metrics.example", ECSFallback: true}
+		if err := sender.Send(report); err != nil {
+			t.Fatal(err)
+		}
+		if !<-ecs {
+			t.Error("Expected a client subnet option on the first attempt")
+		}
+		if <-ecs {
+			t.Error("Expected no client subnet option on the retry")
+		}
+	}
+}
+
+func TestNormalizeResolverAddress(t *testing.T) {
+	cases := map[string]string{
+		"192.0.2.53:53":         "192.0.2.53:53",
+		"192.0.2.53":            "192.0.2.53:53",
+		"[2001:db8::1]:5353":    "[2001:db8::1]:5353",
+		"2001:db8::1":           "[2001:db8::1]:53",
+		"[2001:db8::1]":         "[2001:db8::1]:53",
+		"fe80::1%eth0":          "[fe80::1%eth0]:53",
+		"[::ffff:192.0.2.1]:53": "192.0.2.1:53",
+	}
+	for in, expected := range cases {
+		if out, err := normalizeResolverAddress(in); err != nil || out != expected {
+			t.Errorf("%s: expected %s, got %s, %v", in, expected, out, err)
+		}
+	}
+	if _, err := normalizeResolverAddress("resolver.example:53"); err == nil {
+		t.Error("Expected an error for a hostname")
+	}
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	address, err := RecursiveResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		t.Errorf("Not an IP address: %s", address)
+	}
+}
+
+func TestDiscoveryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RecursiveResolverContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "US\n")
+	}))
+	defer server.Close()
+	if _, err := FetchCountry(ctx, server.Client(), server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if c, err := FetchCountry(context.Background(), server.Client(), server.URL); err != nil || c != "us" {
+		t.Errorf("Wrong country: %q, %v", c, err)
+	}
+}
+
+func TestFetchCountryErrors(t *testing.T) {
+	status := http.StatusOK
+	body := "not a country"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+	if _, err := FetchCountry(context.Background(), nil, server.URL); err == nil {
+		t.Error("Expected an error for a bad response")
+	}
+	status, body = http.StatusTooManyRequests, "us"
+	if _, err := FetchCountry(context.Background(), nil, server.URL); err == nil {
+		t.Error("Expected an error for a bad status")
+	}
+	// A stalled service times out.
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer stalled.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := FetchCountry(ctx, nil, stalled.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestResolverAddressDialable(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		address, ecs := fakeResolverOn(t, network, dnsmessage.RCodeNameError)
+		if address == "" {
+			t.Logf("%s is unavailable", network)
+			continue
+		}
+		// Strip the port, as some platforms report resolvers without one.
+		host, port, _ := net.SplitHostPort(address)
+		normalized, err := normalizeResolverAddress(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _, _ = net.SplitHostPort(normalized)
+		report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+		sender := &DNSReportSender{Resolver: net.JoinHostPort(host, port), Suffix: "metrics.example"}
+		if err := sender.Send(report); err != nil {
+			t.Errorf("%s: %v", network, err)
+		}
+		<-ecs
+	}
+}
+
+// Starts a fake resolver that confirms the first query with `token`.
+func confirmingResolver(t *testing.T, token string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, udpLimit)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		response, err := ConfirmationResponse(buf[:n], token)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteTo(response, addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSReportSenderConfirmation(t *testing.T) {
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	sender := &DNSReportSender{Resolver: confirmingResolver(t, "ok"), Suffix: "metrics.example", Confirmation: "ok"}
+	if err := sender.Send(report); err != nil {
+		t.Fatal(err)
+	}
+	sender.Resolver = confirmingResolver(t, "wrong")
+	if err := sender.Send(report); !errors.Is(err, ErrNotConfirmed) {
+		t.Errorf("Expected ErrNotConfirmed for the wrong token, got %v", err)
+	}
+	// NXDOMAIN is not a confirmation.
+	sender.Resolver, _ = fakeResolver(t, dnsmessage.RCodeNameError)
+	if err := sender.Send(report); !errors.Is(err, ErrNotConfirmed) {
+		t.Errorf("Expected ErrNotConfirmed for NXDOMAIN, got %v", err)
+	}
+	// Without Confirmation, the confirmation is an acceptable response.
+	sender = &DNSReportSender{Resolver: confirmingResolver(t, "ok"), Suffix: "metrics.example"}
+	if err := sender.Send(report); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoHReportSender(t *testing.T) {
+	receiver := Receiver{Suffix: "metrics.example"}
+	var received []*Report
+	rcode := dnsmessage.RCodeNameError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(req.Body)
+		report, err := receiver.ParseQuery(query)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, report)
+		response := dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: rcode}}
+		packed, _ := response.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	sender := &DoHReportSender{URL: server.URL, Suffix: "metrics.example", Options: QueryOptions{Padding: 128}, Client: server.Client()}
+	if err := sender.Send(report); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || !received[0].Equal(report) {
+		t.Errorf("Wrong report received: %v", received)
+	}
+	rcode = dnsmessage.RCodeServerFailure
+	if err := sender.Send(report); err == nil {
+		t.Error("Expected an error due to SERVFAIL")
+	}
+	sender.URL = server.URL + "/missing"
+	server.Config.Handler = http.NotFoundHandler()
+	if err := sender.Send(report); err == nil {
+		t.Error("Expected an error due to the HTTP status")
+	}
+}
+
+func TestNewReportWithBin(t *testing.T) {
+	key := NewKey("domain.example", country, testDate)
+	v, _ := NewValue("value")
+	values := []Value{v}
+	report, err := NewReportWithBin(key, values, "q7", Base32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values[0] = Value{}
+	receiver := Receiver{Suffix: "metrics.example", Values: 1}
+	query, err := FormatQuery(report, "metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := receiver.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Bin() != "q7" || parsed.Values[0] != v {
+		t.Errorf("Unexpected report: %v in bin %s", parsed, parsed.Bin())
+	}
+
+	for _, bin := range []string{"", "q1", "Q", "q.q", strings.Repeat("q", 64)} {
+		if _, err := NewReportWithBin(key, values, bin, Base32); err == nil {
+			t.Errorf("Expected an error for bin %q", bin)
+		}
+	}
+	// Bins from a Reporter with another Alphabet are accepted.
+	report, err = NewReportWithBin(key, []Value{v}, "q1", Base36)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.Alphabet = Base36
+	query, err = FormatQuery(report, "metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := receiver.ParseQuery(query); err != nil || parsed.Bin() != "q1" {
+		t.Errorf("Unexpected Base36 report: %v, %v", parsed, err)
+	}
+	if _, err := NewReportWithBin(key, values, "q", Alphabet("q")); err == nil {
+		t.Error("Expected an error for an invalid Alphabet")
+	}
+	key.Date = key.Date.Add(time.Hour)
+	if _, err := NewReportWithBin(key, values, "q", Base32); err == nil {
+		t.Error("Expected an error for a date that is not midnight")
+	}
+}
+
+func TestBeaconReportSender(t *testing.T) {
+	reports := make(chan Report, 1)
+	handler := &BeaconHandler{Receiver: &Receiver{Suffix: "metrics.example"}, Reports: reports}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+	sender := &BeaconReportSender{URL: server.URL, Suffix: "metrics.example.", Client: server.Client()}
+	if err := sender.Send(report); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-reports; !received.Equal(report) {
+		t.Errorf("Wrong report received: %v", received)
+	}
+	name, err := ReportName(report, "metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "q."+country+".14131211.domain.example.metrics.example" {
+		t.Errorf("Unexpected name %s", name)
+	}
+
+	// The collector rejects reports for another suffix.
+	sender.Suffix = "other.example"
+	if err := sender.Send(report); err == nil {
+		t.Error("Expected an error due to the wrong suffix")
+	}
+	if resp, err := server.Client().Get(server.URL); err != nil {
+		t.Error(err)
+	} else if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status for GET: %d", resp.StatusCode)
+	}
+	if _, err := ReportName(report, strings.Repeat("a.", MaxNameLength/2)); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("Expected ErrNameTooLong, got %v", err)
+	}
+}
+
+func TestOmitClientSubnet(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	if _, err := formatQuery("a.example", QueryOptions{OmitClientSubnet: true, ClientSubnet: subnet}); err == nil {
+		t.Error("Expected an error due to conflicting options")
+	}
+}
+
+func TestFormatClientSubnet(t *testing.T) {
+	cases := []struct {
+		cidr     string
+		expected []byte
+	}{
+		{"203.0.113.0/24", []byte{0, 1, 24, 0, 203, 0, 113}},
+		{"203.0.113.77/20", []byte{0, 1, 20, 0, 203, 0, 112}},
+		{"2001:db8:ffff::/33", []byte{0, 2, 33, 0, 0x20, 0x01, 0x0d, 0xb8, 0x80}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+	}
+	for _, c := range cases {
+		_, subnet, err := net.ParseCIDR(c.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := formatQuery("abcd.example", QueryOptions{ClientSubnet: subnet})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := dnsmessage.Message{}
+		if err := msg.Unpack(query); err != nil {
+			t.Fatal(err)
+		}
+		opt := msg.Additionals[0].Body.(*dnsmessage.OPTResource)
+		if ecs := opt.Options[0]; ecs.Code != 0x8 || !bytes.Equal(ecs.Data, c.expected) {
+			t.Errorf("%s: wrong ECS option %v != %v", c.cidr, ecs.Data, c.expected)
+		}
+	}
+
+	bad := &net.IPNet{IP: net.ParseIP("203.0.113.0"), Mask: net.IPMask{255, 0, 255, 0}}
+	if _, err := formatQuery("abcd.example", QueryOptions{ClientSubnet: bad}); err == nil {
+		t.Error("Expected an error due to a non-canonical mask")
+	}
+	bad = &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(24, 32)}
+	if _, err := formatQuery("abcd.example", QueryOptions{ClientSubnet: bad}); err == nil {
+		t.Error("Expected an error due to an IPv6 address with an IPv4 mask")
+	}
+}
+
+func TestFormatTooLong(t *testing.T) {
+	// Name contains a 64-character label, but the limit is 63.
+	name := "a.b.c.0123456789012345678901234567890123456789012345678901234567890123.example"
+	if _, err := formatQuery(name, QueryOptions{}); err == nil {
+		t.Error("Expected an error due to disallowed label")
+	}
+}
+
+func TestValueTooLong(t *testing.T) {
+	// Value has length 64, but the limit is 63.
+	v := "0123456789012345678901234567890123456789012345678901234567890123"
+	if _, err := NewValue(v); err == nil {
+		t.Error("Expected an error due to length limit")
+	}
+}
+
+func TestValueUpperCase(t *testing.T) {
+	if _, err := NewValue("Asdf"); err == nil {
+		t.Error("Expected failure due to upper-case character")
+	}
+}
+
+func TestValueUnicode(t *testing.T) {
+	if _, err := NewValue("a⌘cd"); err == nil {
+		t.Error("Expected failure due to non-ASCII character")
+	}
+}
+
+func TestValueWithDot(t *testing.T) {
+	if _, err := NewValue("asdf.1234"); err == nil {
+		t.Error("Expected failure due to '.' in Value")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	empty, _ := NewValue("")
+	a, _ := NewValue("a")
+	b, _ := NewValue("b")
+	ab, _ := NewValue("ab")
+	tuples := [][]Value{
+		nil,
+		{empty},
+		{empty, empty},
+		{a},
+		{a, b},
+		{b, a},
+		{ab},
+		{a, empty},
+		{empty, a},
+	}
+	seen := make(map[string]int)
+	for i, values := range tuples {
+		f := Report{Values: values}.Fingerprint()
+		if j, ok := seen[f]; ok {
+			t.Errorf("Collision between %v and %v: %s", tuples[j], values, f)
+		}
+		seen[f] = i
+	}
+	if f := (Report{Values: []Value{a, b}}).Fingerprint(); f != "2:a.b" {
+		t.Errorf("Unexpected fingerprint: %s", f)
+	}
+}
+
+func TestString(t *testing.T) {
+	v1, _ := NewValue("http")
+	v2, _ := NewValue("404")
+	report := Report{
+		Key:    NewKey("www.example", "us", testDate),
+		Values: []Value{v1, v2},
+		bin:    "q",
+	}
+	expected := "domain=www.example country=us date=14131211 values=[http.404]"
+	if s := report.String(); s != expected {
+		t.Errorf("%s != %s", s, expected)
+	}
+	if s := fmt.Sprintf("%v", report); s != expected {
+		t.Errorf("%s != %s", s, expected)
+	}
+	if s := report.Key.String(); s != "domain=www.example country=us date=14131211" {
+		t.Errorf("Wrong Key string: %s", s)
+	}
+	if s := (Report{Key: report.Key}).String(); !strings.HasSuffix(s, " values=[]") {
+		t.Errorf("Wrong string with no values: %s", s)
+	}
+}
+
+func TestToMap(t *testing.T) {
+	v1, _ := NewValue("http")
+	v2, _ := NewValue("404")
+	report := Report{
+		Key:    NewKey("www.example", "us", testDate),
+		Values: []Value{v1, v2},
+		bin:    "q",
+	}
+	expected := "map[bin:q country:us date:14131211 domain:www.example value0:http value1:404]"
+	if m := fmt.Sprint(report.ToMap()); m != expected {
+		t.Errorf("%s != %s", m, expected)
+	}
+	if _, ok := (Report{Key: report.Key}).ToMap()["bin"]; ok {
+		t.Error("Expected no bin")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	r1 := Report{
+		Key: Key{
+			Domain:  "domain.example",
+			Country: country,
+			Date:    testDate,
+		},
+		Values: testValues,
+		bin:    "q",
+	}
+	r2 := r1
+	r2.Values = append([]Value(nil), testValues...)
+	if !r1.Equal(r2) {
+		t.Errorf("%v should equal %v", r1, r2)
+	}
+	r2.bin = "r"
+	if r1.Equal(r2) {
+		t.Error("Reports with different bins should not be equal")
+	}
+	r2.bin = r1.bin
+	r2.Values = r2.Values[:1]
+	if r1.Equal(r2) {
+		t.Error("Reports with different values should not be equal")
+	}
+}
+
+func TestDurationValue(t *testing.T) {
+	cases := []struct {
+		d, bucket time.Duration
+		expected  string
+	}{
+		{0, time.Second, "0s"},
+		{10 * time.Millisecond, time.Second, "0s"},
+		{149 * time.Millisecond, 50 * time.Millisecond, "150ms"},
+		{1234567 * time.Microsecond, 100 * time.Millisecond, "1200ms"},
+		{89 * time.Second, 10 * time.Second, "90s"},
+		{100 * time.Minute, time.Hour, "2h"},
+		{1500 * time.Nanosecond, time.Microsecond, "2us"},
+	}
+	for _, c := range cases {
+		v, err := NewDurationValue(c.d, c.bucket)
+		if err != nil {
+			t.Error(err)
+		} else if v.String() != c.expected {
+			t.Errorf("NewDurationValue(%v, %v) = %s, expected %s", c.d, c.bucket, v, c.expected)
+		}
+	}
+	if _, err := NewDurationValue(time.Second, 0); err == nil {
+		t.Error("Expected an error due to zero bucket")
+	}
+	if _, err := NewDurationValue(-time.Second, time.Second); err == nil {
+		t.Error("Expected an error due to negative duration")
+	}
+}
+
+func TestBoolValue(t *testing.T) {
+	for _, b := range []bool{true, false} {
+		if parsed, err := ParseBoolValue(NewBoolValue(b)); err != nil || parsed != b {
+			t.Errorf("%v: got %v, %v", b, parsed, err)
+		}
+	}
+	if NewBoolValue(true).String() != "1" || NewBoolValue(false).String() != "0" {
+		t.Error("Wrong encoding")
+	}
+	if _, err := ParseBoolValue(Value{"yes"}); err == nil {
+		t.Error("Expected an error due to a non-boolean value")
+	}
+}
+
+func TestEnumValue(t *testing.T) {
+	for i := 0; i < 12; i++ {
+		v, err := NewEnumValue(i, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.String() != strconv.Itoa(i) {
+			t.Errorf("Wrong encoding: %s", v)
+		}
+		if parsed, err := ParseEnumValue(v, 12); err != nil || parsed != i {
+			t.Errorf("%d: got %d, %v", i, parsed, err)
+		}
+	}
+	for _, i := range []int{-1, 12} {
+		if _, err := NewEnumValue(i, 12); err == nil {
+			t.Errorf("Expected an error for index %d", i)
+		}
+	}
+	for _, s := range []string{"", "12", "01", "-1", "a"} {
+		if _, err := ParseEnumValue(Value{s}, 12); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestTimeOfDayBucket(t *testing.T) {
+	day := time.Date(2020, time.February, 3, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		offset   time.Duration
+		buckets  int
+		expected string
+	}{
+		{0, 4, "0"},
+		{6*time.Hour - time.Second, 4, "0"},
+		{6 * time.Hour, 4, "1"},
+		{23*time.Hour + 59*time.Minute + 59*time.Second, 4, "3"},
+		{15 * time.Hour, 1, "0"},
+		{15*time.Hour + 30*time.Minute, 24, "15"},
+		{12 * time.Hour, 5, "2"},
+	}
+	for _, c := range cases {
+		v, err := NewTimeOfDayBucket(day.Add(c.offset), c.buckets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.String() != c.expected {
+			t.Errorf("%v in %d buckets: expected %s, got %s", c.offset, c.buckets, c.expected, v)
+		}
+		if i, err := ParseEnumValue(v, c.buckets); err != nil || strconv.Itoa(i) != c.expected {
+			t.Errorf("Failed to parse %s: %v", v, err)
+		}
+	}
+	// The time of day is taken in the location of `t`.
+	est := time.FixedZone("EST", -5*60*60)
+	if v, _ := NewTimeOfDayBucket(day.In(est), 4); v.String() != "3" {
+		t.Errorf("Expected the last quarter of the previous day, got %s", v)
+	}
+	for _, buckets := range []int{0, -1, MaxTimeOfDayBuckets + 1} {
+		if _, err := NewTimeOfDayBucket(day, buckets); err == nil {
+			t.Errorf("Expected an error for %d buckets", buckets)
+		}
+	}
+}
+
+func TestSeverityValue(t *testing.T) {
+	var reports []Report
+	for _, level := range []int{3, 0, 7} {
+		v, err := NewSeverityValue(level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.String() != "s"+strconv.Itoa(level) {
+			t.Errorf("Wrong encoding: %s", v)
+		}
+		if parsed, err := ParseSeverityValue(v); err != nil || parsed != level {
+			t.Errorf("%d: got %d, %v", level, parsed, err)
+		}
+		reports = append(reports, Report{Values: []Value{{"x"}, v}})
+	}
+	for _, level := range []int{-1, MaxSeverity + 1} {
+		if _, err := NewSeverityValue(level); err == nil {
+			t.Errorf("Expected an error for level %d", level)
+		}
+	}
+	for _, s := range []string{"", "s", "s10", "sa", "t1", "1"} {
+		if _, err := ParseSeverityValue(Value{s}); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+	// Reports without a severity are ignored.
+	reports = append(reports, Report{Values: []Value{{"x"}, {"other"}}}, Report{})
+	if min, max, ok := SeverityRange(reports, 1); !ok || min != 0 || max != 7 {
+		t.Errorf("Wrong range: %d, %d, %v", min, max, ok)
+	}
+	if _, _, ok := SeverityRange(reports, 0); ok {
+		t.Error("Expected no severities")
+	}
+}
+
+func TestSplitValue(t *testing.T) {
+	long := strings.Repeat("abcdefghij", 13)
+	for _, s := range []string{"", "short", long[:62], long[:63], long} {
+		values, err := SplitValue(s, 3)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if len(values) != 3 {
+			t.Errorf("Expected 3 values, got %v", values)
+		}
+		if joined, err := JoinValues(values); err != nil || joined != s {
+			t.Errorf("Round trip failed for %q: %q, %v", s, joined, err)
+		}
+	}
+	if values, _ := SplitValue("short", 2); values[0].String() != "0short" || values[1].String() != "-" {
+		t.Errorf("Wrong encoding: %v", values)
+	}
+	for _, s := range []string{long, "Upper", "dot.ted"} {
+		if _, err := SplitValue(s, 2); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+	if _, err := SplitValue("", 0); err == nil {
+		t.Error("Expected an error for zero labels")
+	}
+	for _, labels := range [][]string{{"1a"}, {"0a", "b"}, {"x"}, {}} {
+		var values []Value
+		for _, l := range labels {
+			values = append(values, Value{l})
+		}
+		if _, err := JoinValues(values); err == nil {
+			t.Errorf("Expected an error for %v", labels)
+		}
+	}
+	// A split value survives the round trip through a name.
+	values, err := SplitValue(long, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Report{Key: NewKey("domain.example", country, testDate), Values: values, bin: "q"}
+	receiver := Receiver{Suffix: "metrics.example", Values: 3}
+	parsed, err := receiver.ParseReport(name(report, "metrics.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined, err := JoinValues(parsed.Values); err != nil || joined != long {
+		t.Errorf("Round trip through a name failed: %q, %v", joined, err)
+	}
+}
+
+func TestValuePolicies(t *testing.T) {
+	var f funcReportSender = func(Report) error { return nil }
+	enum := func(v Value) error {
+		_, err := ParseEnumValue(v, 4)
+		return err
+	}
+	r, err := NewReporter(new(bytes.Buffer), 32, 3, country, time.Minute, f, WithValuePolicies(AllowedValues("http", "https"), enum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("a.example", Value{"https"}, Value{"3"}, Value{"anything"}); err != nil {
+		t.Error(err)
+	}
+	for i, values := range [][]Value{
+		{{"ftp"}, {"3"}, {"x"}},
+		{{"http"}, {"4"}, {"x"}},
+	} {
+		err := r.Report("b.example", values...)
+		var valueErr *ValueError
+		if !errors.As(err, &valueErr) || valueErr.Index != i {
+			t.Errorf("Expected a ValueError for position %d, got %v", i, err)
+		}
+	}
+	// Channels are not subject to the parent's policies.
+	channel, err := r.(ChannelReporter).Channel(1, "channel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Report("c.example", Value{"ftp"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewReporter(new(bytes.Buffer), 32, 1, country, time.Minute, f, WithValuePolicies(nil, nil)); err == nil {
+		t.Error("Expected an error for too many policies")
+	}
+}
+
+func TestKVValue(t *testing.T) {
+	v, err := NewKVValue("status", "404")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "status-404" {
+		t.Errorf("Unexpected encoding: %s", v)
+	}
+	// The value may contain the separator, but the key may not.
+	v, err = NewKVValue("error", "conn-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, value, err := ParseKVValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "error" || value != "conn-reset" {
+		t.Errorf("Unexpected pair: %s, %s", key, value)
+	}
+	if _, err := NewKVValue("a-b", "c"); err == nil {
+		t.Error("Expected an error due to the separator in the key")
+	}
+	if _, err := NewKVValue("", "c"); err == nil {
+		t.Error("Expected an error due to the empty key")
+	}
+	if _, err := NewKVValue("key", strings.Repeat("v", 60)); err == nil {
+		t.Error("Expected an error due to the combined length")
+	}
+	plain, _ := NewValue("plain")
+	if _, _, err := ParseKVValue(plain); err == nil {
+		t.Error("Expected an error due to the missing separator")
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	key1 := NewKey("domain1.example", country, testDate)
+	key2 := NewKey("domain2.example", country, testDate)
+	reports := []Report{
+		{Key: key1, bin: "a"},
+		{Key: key1, bin: "b"},
+		{Key: key1, bin: "a"}, // Same bin as the first report.
+		// This is in the same bin as a report for key1, but it's a different
+		// Key, so it counts separately.
+		{Key: key2, bin: "a"},
+		// Reports without a bin (e.g. from Filter) are skipped.
+		{Key: key1},
+		{Key: NewKey("domain3.example", country, testDate)},
+	}
+	occupancy := Occupancy(reports)
+	if len(occupancy) != 2 || occupancy[key1] != 2 || occupancy[key2] != 1 {
+		t.Errorf("Wrong occupancy: %v", occupancy)
+	}
+}
+
+func TestBinDistribution(t *testing.T) {
+	spread := NewKey("spread.example", country, testDate)
+	shared := NewKey("shared.example", country, testDate)
+	few := NewKey("few.example", country, testDate)
+	var reports []Report
+	for i := 0; i < 16; i++ {
+		// 16 reports in 8 bins, as from independent clients.
+		reports = append(reports, Report{Key: spread, bin: Base32.encode(uint64(i%8), 2)})
+		// 16 reports in one bin, as from clients sharing a salt.
+		reports = append(reports, Report{Key: shared, bin: "aa"})
+	}
+	reports = append(reports, Report{Key: few, bin: "aa"}, Report{Key: few, bin: "aa"}, Report{Key: few})
+	stats := BinDistribution(reports, 32)
+	if s := stats[spread]; s.Reports != 16 || s.Bins != 8 || s.Entropy != 3 || s.MaxEntropy != 4 || s.Concentrated() {
+		t.Errorf("Wrong stats for spread key: %+v", s)
+	}
+	if s := stats[shared]; s.Reports != 16 || s.Bins != 1 || s.Entropy != 0 || !s.Concentrated() {
+		t.Errorf("Wrong stats for shared key: %+v", s)
+	}
+	if s := stats[few]; s.Reports != 2 || s.MaxEntropy != 1 || s.Concentrated() {
+		t.Errorf("Too few reports to be concentrated: %+v", s)
+	}
+}
+
+func TestMaxBinEntropy(t *testing.T) {
+	for _, c := range []struct {
+		n, bins int
+		entropy float64
+	}{
+		{0, 32, 0},
+		{1, 32, 0},
+		{4, 32, 2},
+		{64, 32, 5},
+		{3, 2, math.Log2(3) - 2.0/3},
+	} {
+		if e := maxBinEntropy(c.n, c.bins); math.Abs(e-c.entropy) > 1e-9 {
+			t.Errorf("maxBinEntropy(%d, %d) = %v, expected %v", c.n, c.bins, e, c.entropy)
+		}
+	}
+}
+
+func TestStringSet(t *testing.T) {
+	s := newStringSet()
+	if s.len() != 0 || s.contains("a") {
+		t.Error("New set should be empty")
+	}
+	s.add("a")
+	s.add("a")
+	if s.len() != 1 || !s.contains("a") {
+		t.Errorf("Wrong set after adding: %v", s.sorted())
+	}
+}
+
+func TestStringSetUnion(t *testing.T) {
+	s1 := newStringSet()
+	s1.add("a")
+	s1.add("b")
+	s2 := newStringSet()
+	s2.add("b")
+	s2.add("c")
+	s1.union(s2)
+	// "b" is in both sets, so the union is smaller than the sum of the sizes.
+	if members := s1.sorted(); strings.Join(members, ",") != "a,b,c" {
+		t.Errorf("Wrong union: %v", members)
+	}
+	if s2.len() != 2 {
+		t.Error("Union should not modify its argument")
+	}
+	s1.union(newStringSet())
+	if s1.len() != 3 {
+		t.Error("Union with an empty set should have no effect")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	c := make(chan Report)
+	f := Filter(c, 2)
+
+	key := Key{
+		Domain:  "d1.example",
+		Country: "zz",
+		Date:    testDate,
+	}
+	for i := 0; i < 10; i++ {
+		vi, _ := NewValue(strconv.Itoa(i))
+		c <- Report{
+			Key:    key,
+			Values: []Value{vi},
+			bin:    "1",
+		}
+	}
+	select {
+	case <-f:
+		t.Error("There should be no output from f yet")
+	default:
+	}
+	go func() {
+		v10, _ := NewValue("10")
+		c <- Report{
+			Key:    key,
+			Values: []Value{v10},
+			bin:    "2",
+		}
+		close(c)
+	}()
+	values := make([]int, 0)
+	for report := range f {
+		if report.Key != key {
+			t.Errorf("Mismatched key: %v != %v", report.Key, key)
+		}
+		index, err := strconv.Atoi(report.Values[0].String())
+		if err != nil {
+			t.Error(err)
+		}
+		values = append(values, index)
+	}
+	sort.Ints(values)
+	for i, v := range values {
+		if i != v {
+			t.Errorf("Problem with values: %v", values)
+		}
+	}
+}
+
+// Passes `reports` through a Filter, and returns the output.
+func runFilter(reports []Report, threshold int, opts ...FilterOption) []Report {
+	in := make(chan Report)
+	go func() {
+		for _, r := range reports {
+			in <- r
+		}
+		close(in)
+	}()
+	var out []Report
+	for r := range Filter(in, threshold, opts...) {
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestFilterMaxKeyAge(t *testing.T) {
+	var mu sync.Mutex
+	now := testDate.Add(12 * time.Hour)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	state := &FilterState{}
+	in := make(chan Report)
+	out := Filter(in, 2, WithFilterClock(clock), WithMaxKeyAge(48*time.Hour), WithFilterState(state))
+	old := NewKey("old.example", country, testDate)
+	in <- Report{Key: old, bin: "a"}
+	// The old Key expires.
+	mu.Lock()
+	now = now.AddDate(0, 0, 3)
+	mu.Unlock()
+	in <- Report{Key: old, bin: "b"}
+	// A recent Key is unaffected.
+	recent := NewKey("recent.example", country, clock())
+	in <- Report{Key: recent, bin: "a"}
+	in <- Report{Key: recent, bin: "b"}
+	var released []Report
+	for i := 0; i < 2; i++ {
+		released = append(released, <-out)
+	}
+	close(in)
+	if _, ok := <-out; ok {
+		t.Error("Unexpected report for the expired Key")
+	}
+	for _, r := range released {
+		if r.Key != recent {
+			t.Errorf("Wrong Key released: %v", r.Key)
+		}
+	}
+	if len(state.Pending) != 0 || len(state.Released) != 1 {
+		t.Errorf("Expired Key was not discarded: %v", state)
+	}
+}
+
+func TestFilterReleaseCondition(t *testing.T) {
+	key := NewKey("d1.example", country, testDate)
+	// Returns reports in these bins, with these values.
+	reports := func(bins, values string) []Report {
+		var out []Report
+		for i := range bins {
+			v, _ := NewValue(values[i : i+1])
+			out = append(out, Report{Key: key, Values: []Value{v}, bin: bins[i : i+1]})
+		}
+		return out
+	}
+	oneBin := reports("111", "abc")
+	oneValue := reports("123", "aaa")
+	diverse := reports("123", "abc")
+	cases := []struct {
+		condition ReleaseCondition
+		input     []Report
+		released  bool
+	}{
+		{ReleaseOnBins, oneBin, false},
+		{ReleaseOnBins, oneValue, true},
+		{ReleaseOnBins, diverse, true},
+		{ReleaseOnValues, oneBin, true},
+		{ReleaseOnValues, oneValue, false},
+		{ReleaseOnValues, diverse, true},
+		{ReleaseOnBinsAndValues, oneBin, false},
+		{ReleaseOnBinsAndValues, oneValue, false},
+		{ReleaseOnBinsAndValues, diverse, true},
+	}
+	for i, c := range cases {
+		out := runFilter(c.input, 3, WithReleaseCondition(c.condition))
+		if released := len(out) == len(c.input); released != c.released || (!released && len(out) > 0) {
+			t.Errorf("Case %d: expected released = %v, got %v", i, c.released, out)
+		}
+	}
+
+	// Values in merged states count toward the threshold.
+	state := DamState{Key: key, Bins: []string{"1"}, Observations: [][]Value{oneBin[0].Values, oneBin[1].Values}}
+	out := runFilter(oneBin[2:], 3, WithReleaseCondition(ReleaseOnValues), WithDamStates([]DamState{state}))
+	if len(out) != 3 {
+		t.Errorf("Expected the merged reports to be released: %v", out)
+	}
+}
+
+func TestFilterAnonymity(t *testing.T) {
+	key := NewKey("d1.example", country, testDate)
+	other := NewKey("d2.example", country, testDate)
+	var reports []Report
+	for _, bin := range []string{"a", "b", "a", "c"} {
+		reports = append(reports, Report{Key: key, bin: bin}, Report{Key: other, bin: "a"})
+	}
+	anonymity := make(map[Key]int)
+	record := WithAnonymity(func(key Key, bins int) {
+		if _, ok := anonymity[key]; ok {
+			t.Errorf("Called twice for %v", key)
+		}
+		anonymity[key] = bins
+	})
+	if out := runFilter(reports, 2, record); len(out) != 4 {
+		t.Errorf("Expected the reports for %v, got %v", key, out)
+	}
+	if len(anonymity) != 1 || anonymity[key] != 2 {
+		t.Errorf("Unexpected anonymity: %v", anonymity)
+	}
+
+	// Bins from merged states are counted.
+	anonymity = make(map[Key]int)
+	state := DamState{Key: key, Bins: []string{"a", "b"}, Observations: [][]Value{nil, nil}}
+	runFilter(reports[6:7], 3, record, WithDamStates([]DamState{state}))
+	if anonymity[key] != 3 {
+		t.Errorf("Expected 3 bins, got %v", anonymity)
+	}
+}
+
+func TestFilterReleases(t *testing.T) {
+	key := NewKey("d1.example", country, testDate)
+	in := make(chan Report)
+	out := FilterReleases(context.Background(), in, 2)
+	go func() {
+		for _, bin := range []string{"a", "a", "b", "c"} {
+			in <- Report{Key: key, bin: bin}
+		}
+		close(in)
+	}()
+	var bursts []bool
+	for r := range out {
+		if r.Key != key {
+			t.Errorf("Wrong key: %v", r.Key)
+		}
+		bursts = append(bursts, r.Burst)
+	}
+	if fmt.Sprint(bursts) != "[true true true false]" {
+		t.Errorf("Unexpected releases: %v", bursts)
+	}
+}
+
+func TestFilterReport(t *testing.T) {
+	store := NewMemoryDamStore()
+	key := NewKey("d1.example", "zz", testDate)
+	for i := 0; i < 10; i++ {
+		vi, _ := NewValue(strconv.Itoa(i))
+		released, err := FilterReport(store, Report{Key: key, Values: []Value{vi}, bin: "1"}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(released) != 0 {
+			t.Fatalf("Nothing should be released yet: %v", released)
+		}
+	}
+	if state, burst, _ := store.Get(key); burst || len(state.Bins) != 1 || len(state.Observations) != 10 {
+		t.Errorf("Unexpected state: %v, %v", state, burst)
+	}
+
+	v10, _ := NewValue("10")
+	released, err := FilterReport(store, Report{Key: key, Values: []Value{v10}, bin: "2"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 11 {
+		t.Errorf("Expected all 11 reports to be released, got %d", len(released))
+	}
+	for _, r := range released {
+		if r.Key != key || r.bin != "" {
+			t.Errorf("Unexpected report: %v", r)
+		}
+	}
+
+	// After bursting, reports are released immediately.
+	v11, _ := NewValue("11")
+	released, err = FilterReport(store, Report{Key: key, Values: []Value{v11}, bin: "1"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0].Values[0] != v11 {
+		t.Errorf("Expected the report to be released, got %v", released)
+	}
+	if _, burst, _ := store.Get(key); !burst {
+		t.Error("Dam should have burst")
+	}
+}
+
+func TestFilterKeyValidation(t *testing.T) {
+	key := NewKey("d1.example", country, testDate)
+	late := key
+	late.Date = late.Date.Add(time.Hour)
+	var reports []Report
+	for _, bin := range []string{"a", "b", "c"} {
+		reports = append(reports, Report{Key: late, bin: bin})
+	}
+	state := DamState{Key: late, Bins: []string{"d"}, Observations: [][]Value{nil}}
+	if out := runFilter(reports, 1, WithDamStates([]DamState{state})); len(out) != 0 {
+		t.Errorf("Expected reports with invalid Keys to be discarded, got %v", out)
+	}
+
+	store := NewMemoryDamStore()
+	if _, err := FilterReport(store, Report{Key: late, bin: "a"}, 1); err == nil {
+		t.Error("Expected an error from FilterReport")
+	}
+	if _, _, err := store.AddBin(late, "a", nil); err == nil {
+		t.Error("Expected an error from AddBin")
+	}
+	if err := store.Put(state); err == nil {
+		t.Error("Expected an error from Put")
+	}
+	if released, err := FilterReport(store, Report{Key: key, bin: "a"}, 1); err != nil || len(released) != 1 {
+		t.Errorf("Expected a valid Key to be released: %v, %v", released, err)
+	}
+}
+
+func TestMemoryDamStorePut(t *testing.T) {
+	store := NewMemoryDamStore()
+	key := NewKey("d1.example", "zz", testDate)
+	v, _ := NewValue("1")
+	if err := store.Put(DamState{Key: key, Bins: []string{"a", "b"}, Observations: [][]Value{{v}, {v}}}); err != nil {
+		t.Fatal(err)
+	}
+	// A third bin bursts the imported dam.
+	released, err := FilterReport(store, Report{Key: key, Values: []Value{v}, bin: "c"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 3 {
+		t.Errorf("Expected 3 reports to be released, got %v", released)
+	}
+	// A burst dam can't be replaced.
+	if err := store.Put(DamState{Key: key, Bins: []string{"a"}, Observations: [][]Value{{v}}}); err == nil {
+		t.Error("Expected an error replacing a burst dam")
+	}
+	if _, burst, _ := store.Get(key); !burst {
+		t.Error("Burst dam was replaced")
+	}
+
+	// Neither the imported nor the exported state shares its slices.
+	other := NewKey("d2.example", "zz", testDate)
+	w, _ := NewValue("2")
+	imported := DamState{Key: other, Bins: []string{"a"}, Observations: [][]Value{{v}}}
+	if err := store.Put(imported); err != nil {
+		t.Fatal(err)
+	}
+	imported.Observations[0][0] = w
+	state, _, err := store.Get(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Observations[0][0] = w
+	if state, _, _ := store.Get(other); state.Observations[0][0] != v {
+		t.Errorf("Stored observations were modified: %v", state.Observations)
+	}
+}
+
+func TestFilterMergeStates(t *testing.T) {
+	key := Key{
+		Domain:  "d1.example",
+		Country: "zz",
+		Date:    testDate,
+	}
+	v1, _ := NewValue("1")
+	v2, _ := NewValue("2")
+	v3, _ := NewValue("3")
+
+	// Each shard has seen one report in the same bin, plus one unique bin.
+	// The shards can't burst on their own with a threshold of 3.
+	shard1 := make(chan Report)
+	var states []DamState
+	out1 := Filter(shard1, 3, WithPendingStates(func(s []DamState) {
+		states = append(states, s...)
+	}))
+	shard2 := make(chan Report)
+	out2 := Filter(shard2, 3, WithPendingStates(func(s []DamState) {
+		states = append(states, s...)
+	}))
+	shard1 <- Report{Key: key, Values: []Value{v1}, bin: "a"}
+	shard1 <- Report{Key: key, Values: []Value{v2}, bin: "b"}
+	close(shard1)
+	for r := range out1 {
+		t.Errorf("Unexpected output from shard 1: %v", r)
+	}
+	shard2 <- Report{Key: key, Values: []Value{v3}, bin: "a"}
+	close(shard2)
+	for r := range out2 {
+		t.Errorf("Unexpected output from shard 2: %v", r)
+	}
+	if len(states) != 2 {
+		t.Fatalf("Expected 2 pending states, got %v", states)
+	}
+
+	// Merging the two states yields only two distinct bins, which is not
+	// enough to burst.
+	in := make(chan Report)
+	var remaining []DamState
+	out := Filter(in, 3, WithDamStates(states), WithPendingStates(func(s []DamState) {
+		remaining = s
+	}))
+	close(in)
+	for r := range out {
+		t.Errorf("Merged states should not burst with 2 bins: %v", r)
+	}
+	if len(remaining) != 1 || len(remaining[0].Bins) != 2 || len(remaining[0].Observations) != 3 {
+		t.Fatalf("Unexpected merged state: %v", remaining)
+	}
+
+	// A third bin bursts the merged dam, releasing all the reports.
+	in = make(chan Report)
+	out = Filter(in, 3, WithDamStates(remaining))
+	go func() {
+		in <- Report{Key: key, Values: []Value{v1}, bin: "c"}
+		close(in)
+	}()
+	var values []string
+	for r := range out {
+		values = append(values, r.Values[0].String())
+	}
+	sort.Strings(values)
+	if strings.Join(values, ",") != "1,1,2,3" {
+		t.Errorf("Unexpected released values: %v", values)
+	}
+}
+
+func TestFilterState(t *testing.T) {
+	keyA := NewKey("a.example", "zz", testDate)
+	keyB := NewKey("b.example", "zz", testDate)
+	v, _ := NewValue("1")
+	// Runs a Filter with a threshold of 3 on `reports`, and returns its output.
+	run := func(state *FilterState, reports ...Report) []Report {
+		in := make(chan Report)
+		out := Filter(in, 3, WithFilterState(state))
+		go func() {
+			for _, r := range reports {
+				in <- r
+			}
+			close(in)
+		}()
+		var released []Report
+		for r := range out {
+			released = append(released, r)
+		}
+		return released
+	}
+
+	// In the first chunk, key B bursts, but key A only has 2 bins.
+	var state FilterState
+	released := run(&state,
+		Report{Key: keyA, Values: []Value{v}, bin: "a"},
+		Report{Key: keyA, Values: []Value{v}, bin: "b"},
+		Report{Key: keyB, Values: []Value{v}, bin: "a"},
+		Report{Key: keyB, Values: []Value{v}, bin: "b"},
+		Report{Key: keyB, Values: []Value{v}, bin: "c"},
+	)
+	if len(released) != 3 {
+		t.Errorf("Expected key B to burst, got %v", released)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].Key != keyA || len(state.Released) != 1 || state.Released[0] != keyB {
+		t.Fatalf("Unexpected state: %v", state)
+	}
+
+	// In the second chunk, the bins from the first chunk count toward the
+	// threshold, and key B remains burst.
+	released = run(&state,
+		Report{Key: keyA, Values: []Value{v}, bin: "c"},
+		Report{Key: keyB, Values: []Value{v}, bin: "d"},
+	)
+	counts := make(map[Key]int)
+	for _, r := range released {
+		counts[r.Key]++
+	}
+	if counts[keyA] != 3 || counts[keyB] != 1 {
+		t.Errorf("Unexpected output from the second chunk: %v", counts)
+	}
+	if len(state.Pending) != 0 || len(state.Released) != 2 {
+		t.Errorf("Unexpected state: %v", state)
+	}
+
+	// Pruning discards the state for earlier dates.
+	keyC := NewKey("c.example", "zz", testDate.AddDate(0, 0, 1))
+	state.Pending = append(state.Pending, DamState{Key: keyC, Bins: []string{"a"}})
+	state.Prune(keyC.Date)
+	if len(state.Pending) != 1 || len(state.Released) != 0 {
+		t.Errorf("Unexpected state after pruning: %v", state)
+	}
+}
+
+func TestFilterStateJSON(t *testing.T) {
+	v1, _ := NewValue("1")
+	v2, _ := NewValue("http-404")
+	state := FilterState{
+		Pending: []DamState{{
+			Key:          NewKey("a.example", "zz", testDate),
+			Bins:         []string{"a", "b"},
+			Observations: [][]Value{{v1, v2}, {v1, {}}},
+		}},
+		Released: []Key{NewKey("b.example", "zz", testDate)},
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FilterState
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, state) {
+		t.Errorf("State changed by round trip: %s", data)
+	}
+	// Invalid values are rejected.
+	bad := bytes.Replace(data, []byte(`"http-404"`), []byte(`"HTTP.404"`), 1)
+	if err := json.Unmarshal(bad, &decoded); err == nil {
+		t.Error("Expected an error due to an invalid value")
+	}
+}
+
+func TestFilterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan Report)
+	out := FilterContext(ctx, in, 2)
+	key := Key{
+		Domain:  "d1.example",
+		Country: "zz",
+		Date:    testDate,
+	}
+	v, _ := NewValue("1")
+	in <- Report{Key: key, Values: []Value{v}, bin: "a"}
+	// The input channel is never closed, but canceling stops the Filter.
+	cancel()
+	for r := range out {
+		t.Errorf("Pending reports should be discarded: %v", r)
+	}
+}
+
+func TestFilterContextBlockedOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan Report)
+	out := FilterContext(ctx, in, 1)
+	key := Key{
+		Domain:  "d1.example",
+		Country: "zz",
+		Date:    testDate,
+	}
+	v, _ := NewValue("1")
+	in <- Report{Key: key, Values: []Value{v}, bin: "a"}
+	// The Filter is now blocked delivering the released report, which
+	// is never read.  Canceling should still stop it.
+	cancel()
+	for range out {
+		// The report may or may not be delivered, but the channel must close.
+	}
+}
+
+type channelReportSender chan Report
+
+func (s channelReportSender) Send(r Report) error {
+	s <- r
+	close(s)
+	return nil
+}
+
+// fakeScheduler implements Scheduler by recording the scheduled functions,
+// which the test then runs explicitly.
+type fakeScheduler struct {
+	delays  []time.Duration
+	pending []func()
+}
+
+func (s *fakeScheduler) schedule(d time.Duration, f func()) func() {
+	s.delays = append(s.delays, d)
+	s.pending = append(s.pending, f)
+	return func() {}
+}
+
+// Run all the scheduled functions, as if the clock had advanced past them.
+func (s *fakeScheduler) advance() {
+	pending := s.pending
+	s.pending = nil
+	for _, f := range pending {
+		f()
+	}
+}
+
+func TestBurstJitter(t *testing.T) {
+	var f funcReportSender = func(Report) error { return nil }
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithBurstJitter(0.5), WithoutDailyDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := r.Report("domain.example"); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.advance()
+	}
+	distinct := make(map[time.Duration]bool)
+	for _, d := range scheduler.delays {
+		if d < 30*time.Second || d > 90*time.Second {
+			t.Errorf("Delay out of range: %v", d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("Delays are not jittered: %v", scheduler.delays)
+	}
+	for _, fraction := range []float64{-0.1, 1.1} {
+		if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithBurstJitter(fraction)); err == nil {
+			t.Errorf("Expected an error for jitter %v", fraction)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, time.Minute, f, WithScheduler(scheduler.schedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latency, err := r.(ChannelReporter).Channel(1, "Latency.Metrics.Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.(ChannelReporter).Channel(1, ""); err == nil {
+		t.Error("Expected an error due to an empty suffix")
+	}
+	if _, err := r.(ChannelReporter).Channel(maxValues+1, "latency.metrics.example"); err == nil {
+		t.Error("Expected an error due to too many values")
+	}
+
+	v, _ := NewValue("10ms")
+	if err := latency.Report("domain.example", v, v); err == nil {
+		t.Error("Expected an error due to the wrong number of values")
+	}
+	if err := latency.Report("domain.example", v); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Suffix() != "latency.metrics.example" || len(reports[0].Values) != 1 {
+		t.Fatalf("Expected one report on the channel, got %v", reports)
+	}
+
+	// The channel and its parent have separate daily caches.
+	if err := r.Report("domain.example", v, v); err != nil {
+		t.Fatal(err)
+	}
+	if err := latency.Report("domain.example", v); err != nil {
+		t.Fatal(err)
+	}
+	// They share a burst window, so only one drain is scheduled.
+	if len(scheduler.delays) != 2 {
+		t.Fatalf("Expected one drain per burst, got %v", scheduler.delays)
+	}
+	scheduler.advance()
+	if len(reports) != 2 || reports[1].Suffix() != "" {
+		t.Fatalf("Expected the parent's report, got %v", reports)
+	}
+	// They share a salt, so the bins are the same.
+	if reports[0].bin != reports[1].bin {
+		t.Errorf("Bins differ between channels: %s != %s", reports[0].bin, reports[1].bin)
+	}
+}
+
+type countingReporter struct {
+	Reporter
+	count int
+}
+
+func (r *countingReporter) Report(domain string, values ...Value) error {
+	r.count++
+	return nil
+}
+
+func TestSamplingReporter(t *testing.T) {
+	for _, p := range []float64{-0.1, 1.1} {
+		if _, err := NewSamplingReporter(&countingReporter{}, p); err == nil {
+			t.Errorf("Expected an error for p = %v", p)
+		}
+	}
+	cases := []struct {
+		p        float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.5, 350, 650},
+		{1, 1000, 1000},
+	}
+	for _, c := range cases {
+		r := &countingReporter{}
+		s, err := NewSamplingReporter(r, c.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := s.Report("domain.example"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if r.count < c.min || r.count > c.max {
+			t.Errorf("Forwarded %d of 1000 calls with p = %v", r.count, c.p)
+		}
+	}
+}
+
+func TestOptionalReporterInterfaces(t *testing.T) {
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := r.(ChannelReporter).Channel(0, "channel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampled, err := NewSamplingReporter(r, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Reporter{r, channel, sampled} {
+		_, dated := r.(DatedReporter)
+		_, rotator := r.(SaltRotator)
+		_, previewer := r.(BinPreviewer)
+		_, channels := r.(ChannelReporter)
+		if !dated || !rotator || !previewer || !channels {
+			t.Errorf("%T is missing an optional interface", r)
+		}
+	}
+	if _, err := sampled.BinFor("domain.example"); err != nil {
+		t.Error(err)
+	}
+
+	// A SamplingReporter only supports what the underlying Reporter does.
+	s, err := NewSamplingReporter(&countingReporter{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReportWithDate(testDate, "domain.example"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	if err := s.RotateSalt(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	if _, err := s.BinFor("domain.example"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	if _, err := s.Channel(0, "channel.example"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	burst := 200 * time.Millisecond
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, burst, f, WithScheduler(scheduler.schedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v0, _ := NewValue("asdf")
+	for i := 0; i < 10; i++ {
+		v1, _ := NewValue(strconv.Itoa(i))
+		if err := r.Report(fmt.Sprintf("domain%d.example", i), v0, v1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(reports) != 0 {
+		t.Errorf("Nothing should be sent yet, but got %v", reports)
+	}
+	if len(scheduler.delays) != 1 || scheduler.delays[0] != burst {
+		t.Fatalf("Expected one drain after %v, got %v", burst, scheduler.delays)
+	}
+
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Fatalf("Expected exactly one report after the burst, got %d", len(reports))
+	}
+	report := reports[0]
+	if report.Country != country || report.Values[0] != v0 {
+		t.Fatal("Wrong report", report)
+	}
+
+	// A report after the drain starts a new burst.
+	v1, _ := NewValue("10")
+	if err := r.Report("domain10.example", v0, v1); err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.delays) != 2 {
+		t.Errorf("Expected a second drain to be scheduled, got %v", scheduler.delays)
+	}
+	scheduler.advance()
+	if len(reports) != 2 || reports[1].Domain != "domain10.example" {
+		t.Errorf("Expected the second burst to send its only report, got %v", reports)
+	}
+}
+
+func TestReservoirStrategy(t *testing.T) {
+	s := NewReservoirStrategy()
+	if selected := s.Selected(); len(selected) != 0 {
+		t.Errorf("Expected no selection from an empty burst, got %v", selected)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		s := NewReservoirStrategy()
+		for _, domain := range []string{"a.example", "b.example", "c.example"} {
+			if err := s.Observe(Report{Key: Key{Domain: domain}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		selected := s.Selected()
+		if len(selected) != 1 {
+			t.Fatalf("Expected one selected report, got %v", selected)
+		}
+		counts[selected[0].Domain]++
+	}
+	for domain, count := range counts {
+		if count < 50 {
+			t.Errorf("%s was selected only %d times", domain, count)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("Expected every report to be selected sometimes: %v", counts)
+	}
+}
+
+func TestReservoirUniform(t *testing.T) {
+	const size, items, trials = 2, 5, 2000
+	counts := make([]int, items)
+	for i := 0; i < trials; i++ {
+		r := newReservoir(size)
+		for j := 0; j < items; j++ {
+			if err := r.Observe(Report{Key: Key{Domain: strconv.Itoa(j)}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		selected := r.Selected()
+		if len(selected) != size {
+			t.Fatalf("Expected %d selected reports, got %v", size, selected)
+		}
+		if selected[0].Domain == selected[1].Domain {
+			t.Fatalf("Report was selected twice: %v", selected)
+		}
+		for _, s := range selected {
+			j, _ := strconv.Atoi(s.Domain)
+			counts[j]++
+		}
+	}
+	// Each item is selected with probability size/items.  Compare the
+	// chi-squared statistic to the critical value for 4 degrees of freedom
+	// at p = 0.001, so that the test is rarely flaky.
+	expected := float64(trials*size) / items
+	chi2 := 0.0
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi2 += d * d / expected
+	}
+	if chi2 > 18.47 {
+		t.Errorf("Selection is not uniform: %v (chi-squared %.1f)", counts, chi2)
+	}
+
+	// A reservoir that isn't full selects everything.
+	r := newReservoir(size)
+	if r.Selected() != nil {
+		t.Error("Expected no selection")
+	}
+	if err := r.Observe(Report{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Selected()) != 1 {
+		t.Errorf("Expected one selected report, got %v", r.Selected())
+	}
+}
+
+func TestDedupReportSender(t *testing.T) {
+	var sent []Report
+	fail := false
+	var f funcReportSender = func(r Report) error {
+		if fail {
+			return errors.New("Send failed")
+		}
+		sent = append(sent, r)
+		return nil
+	}
+	now := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	s := NewDedupReportSender(f, 10*time.Second, 2)
+	s.clock = func() time.Time { return now }
+	v1, _ := NewValue("1")
+	v2, _ := NewValue("2")
+	a := Report{Key: NewKey("a.example", country, testDate), Values: []Value{v1}, bin: "q"}
+	b := Report{Key: a.Key, Values: []Value{v2}, bin: "q"}
+	c := Report{Key: NewKey("c.example", country, testDate), bin: "q"}
+	send := func(reports ...Report) {
+		for _, r := range reports {
+			if err := s.Send(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(a, a, b, a)
+	if len(sent) != 2 || s.Duplicates() != 2 {
+		t.Errorf("Expected 2 sent and 2 duplicates, got %v and %d", sent, s.Duplicates())
+	}
+	// The oldest query is forgotten when the limit is reached.
+	send(c, a)
+	if len(sent) != 4 {
+		t.Errorf("Expected a to be sent again, got %v", sent)
+	}
+	// Queries are forgotten after the window.
+	now = now.Add(10 * time.Second)
+	send(a)
+	if len(sent) != 5 {
+		t.Errorf("Expected a to be sent after the window, got %v", sent)
+	}
+	// Failed sends are not remembered.
+	fail = true
+	if err := s.Send(b); err == nil {
+		t.Error("Expected an error")
+	}
+	fail = false
+	send(b)
+	if len(sent) != 6 || s.Duplicates() != 2 {
+		t.Errorf("Expected b to be retried, got %v and %d duplicates", sent, s.Duplicates())
+	}
+
+	// Reports that differ only in their tag or date encoding produce
+	// different queries.
+	tagged := c
+	tagged.tag = "tag"
+	compact := c
+	compact.compactDate = true
+	now = now.Add(10 * time.Second)
+	send(c, tagged, compact)
+	if len(sent) != 9 {
+		t.Errorf("Expected 3 distinct queries, got %v", sent[6:])
+	}
+
+	// A window that is not positive disables deduplication.
+	sent = nil
+	s = NewDedupReportSender(f, 0, 2)
+	send(a, a)
+	if len(sent) != 2 || s.Duplicates() != 0 {
+		t.Errorf("Expected no deduplication, got %v and %d duplicates", sent, s.Duplicates())
+	}
+	// A size below 1 remembers the most recent query.
+	sent = nil
+	s = NewDedupReportSender(f, time.Minute, 0)
+	send(a, a, b, a)
+	if len(sent) != 3 || s.Duplicates() != 1 {
+		t.Errorf("Expected 3 sent and 1 duplicate, got %v and %d", sent, s.Duplicates())
+	}
+}
+
+// Reader that returns an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestReservoirStrategyFrom(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	newStrategy := func() BurstStrategy { return NewReservoirStrategyFrom(zeroReader{}) }
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithBurstStrategy(newStrategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 5; j++ {
+			if err := r.Report(fmt.Sprintf("domain%d-%d.example", i, j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		scheduler.advance()
+	}
+	// Zeros always replace the selected report.
+	if len(reports) != 2 || reports[0].Domain != "domain0-4.example" || reports[1].Domain != "domain1-4.example" {
+		t.Errorf("Expected the last report of each burst, got %v", reports)
+	}
+
+	// Errors from the source are reported.
+	s := NewReservoirStrategyFrom(bytes.NewReader(nil))
+	if err := s.Observe(Report{Key: Key{Domain: "a.example"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Observe(Report{Key: Key{Domain: "b.example"}}); err == nil {
+		t.Error("Expected an error from an empty source")
+	}
+	if selected := s.Selected(); len(selected) != 1 || selected[0].Domain != "a.example" {
+		t.Errorf("Expected the first report to remain selected, got %v", selected)
+	}
+}
+
+func TestFirstStrategy(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithBurstStrategy(NewFirstStrategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 5; j++ {
+			if err := r.Report(fmt.Sprintf("domain%d-%d.example", i, j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		scheduler.advance()
+	}
+	if len(reports) != 2 || reports[0].Domain != "domain0-0.example" || reports[1].Domain != "domain1-0.example" {
+		t.Errorf("Expected the first report of each burst, got %v", reports)
+	}
+
+	// Modifying the selection doesn't modify the strategy.
+	s := NewFirstStrategy()
+	if err := s.Observe(Report{Key: Key{Domain: "a.example"}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Selected()[0].Domain = "b.example"
+	if selected := s.Selected(); selected[0].Domain != "a.example" {
+		t.Errorf("Selection was modified: %v", selected)
+	}
+}
+
+func TestReportCopiesValues(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 1, country, time.Minute, f, WithScheduler(scheduler.schedule), WithBurstStrategy(NewFirstStrategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []Value{{"first"}}
+	if err := r.Report("domain1.example", values...); err != nil {
+		t.Fatal(err)
+	}
+	// Reuse the slice for a second report, while the first is pending.
+	values[0] = Value{"second"}
+	if err := r.Report("domain2.example", values...); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Values[0].String() != "first" {
+		t.Errorf("The pending report was modified: %v", reports)
+	}
+}
+
+func TestAlphabetDecode(t *testing.T) {
+	for _, a := range []Alphabet{Base32, Base36} {
+		for _, n := range []uint64{0, 1, 31, 32, 1000, 1 << 40} {
+			if d := a.decode(a.encode(n, 9)); d != n {
+				t.Errorf("%d != %d", d, n)
+			}
+		}
+	}
+}
+
+func TestActiveBins(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	o := &countingObserver{}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 64, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithActiveBins(16), WithObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := r.Report(fmt.Sprintf("domain%d.example", i)); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.advance()
+	}
+	if len(reports) < 20 || len(reports) > 80 {
+		t.Errorf("Expected about a quarter of the reports to be sent, got %d", len(reports))
+	}
+	if o.counts[EventInactive] != 200-len(reports) {
+		t.Errorf("Expected %d inactive reports, got %d", 200-len(reports), o.counts[EventInactive])
+	}
+	for _, report := range reports {
+		if Base32.decode(report.bin) >= 16 {
+			t.Errorf("Report in inactive bin %s was sent", report.bin)
+		}
+	}
+
+	if _, err := NewReporter(new(bytes.Buffer), 64, 0, country, time.Minute, f, WithActiveBins(65)); err == nil {
+		t.Error("Expected an error due to too many active bins")
+	}
+}
+
+func TestMinBurst(t *testing.T) {
+	if _, err := NewReporter(new(bytes.Buffer), 32, 1, country, time.Second, nil, WithMinBurst(RecommendedBurst)); err == nil {
+		t.Error("Expected an error due to a short burst")
+	}
+	if _, err := NewReporter(new(bytes.Buffer), 32, 1, country, RecommendedBurst, nil, WithMinBurst(RecommendedBurst)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBurstCount(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 1, country, burst, f,
+		WithScheduler(scheduler.schedule), WithBurstCount())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 11; i++ {
+		if err := r.Report(fmt.Sprintf("domain%d.example", i), testValues[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Fatalf("Expected one report, got %v", reports)
+	}
+	values := reports[0].Values
+	if len(values) != 2 || values[0] != testValues[0] || values[1].String() != "8" {
+		t.Errorf("Expected the bucketed count as the last value, got %v", values)
+	}
+
+	// The server must expect one more value.
+	receiver := Receiver{Suffix: "metrics.example", Values: 2}
+	parsed, err := receiver.ParseReport(name(reports[0], receiver.Suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(reports[0]) {
+		t.Errorf("%v != %v", parsed, reports[0])
+	}
+}
+
+func TestCounter(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, time.Minute, f, WithScheduler(scheduler.schedule), WithDedupValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCounter(r)
+	v, _ := NewValue("timeout")
+	for i := 0; i < 10; i++ {
+		if err := c.Increment("domain.example", v); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.advance()
+	}
+	var buckets []string
+	for _, report := range reports {
+		if report.Values[0] != v {
+			t.Errorf("Wrong value: %v", report)
+		}
+		buckets = append(buckets, report.Values[1].String())
+	}
+	if strings.Join(buckets, ",") != "1,2,4,8" {
+		t.Errorf("Expected one report per bucket, got %v", buckets)
+	}
+
+	// Other values are counted separately.
+	reports = nil
+	w, _ := NewValue("refused")
+	if err := c.Increment("domain.example", w); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Values[1].String() != "1" {
+		t.Errorf("Expected a separate count, got %v", reports)
+	}
+}
+
+func TestCounterClock(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	now := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, time.Minute, f, WithScheduler(scheduler.schedule), WithDedupValues(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCounter(r)
+	v, _ := NewValue("timeout")
+	for i := 0; i < 2; i++ {
+		if err := c.Increment("domain.example", v); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.advance()
+	}
+	// The count restarts on the Reporter's next day, not the wall clock's.
+	now = now.Add(2 * time.Hour)
+	reports = nil
+	if err := c.Increment("domain.example", v); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Values[1].String() != "1" {
+		t.Fatalf("Expected the count to restart, got %v", reports)
+	}
+	if !reports[0].Date.Equal(TruncateDate(now)) {
+		t.Errorf("Wrong date: %v", reports[0].Date)
+	}
+}
+
+func TestCountValue(t *testing.T) {
+	for n, expected := range map[int64]string{-1: "0", 0: "0", 1: "1", 3: "2", 1000: "512"} {
+		if v := NewCountValue(n); v.String() != expected {
+			t.Errorf("%d: %s != %s", n, v, expected)
+		}
+	}
+}
+
+func TestPowerOfTwoBucket(t *testing.T) {
+	cases := map[int64]int64{
+		-1: 0, 0: 0, 1: 1, 2: 2, 3: 2, 4: 4, 7: 4, 8: 8, 1000: 512,
+		1 << 62: 1 << 62, 1<<63 - 1: 1 << 62,
+	}
+	for n, expected := range cases {
+		if b := powerOfTwoBucket(n); b != expected {
+			t.Errorf("powerOfTwoBucket(%d) = %d, expected %d", n, b, expected)
+		}
+	}
+	if l := len(strconv.FormatInt(powerOfTwoBucket(1<<63-1), 10)); l != maxBucketLength {
+		t.Errorf("maxBucketLength should be %d", l)
+	}
+}
+
+func TestSigningReportSender(t *testing.T) {
+	key := []byte("shared secret")
+	var signed Report
+	var f funcReportSender = func(r Report) error {
+		signed = r
+		return nil
+	}
+	s := NewSigningReportSender(key, f)
+	original := Report{
+		Key: Key{
+			Domain:  "www.destination.example",
+			Country: country,
+			Date:    testDate,
+		},
+		Values: testValues,
+		bin:    "q",
+	}
+	if err := s.Send(original); err != nil {
+		t.Fatal(err)
+	}
+	if len(signed.tag) != 26 {
+		t.Errorf("Unexpected tag: %s", signed.tag)
+	}
+	receiver := Receiver{
+		Suffix:  "metrics.example.com",
+		Values:  2,
+		AuthKey: key,
+	}
+	parsed := queryRoundtrip(t, receiver, signed)
+	if !parsed.Equal(original) {
+		t.Errorf("%v != %v", parsed, original)
+	}
+
+	// Unsigned, tampered, and wrongly keyed reports are rejected.
+	if _, err := receiver.ParseReport(name(original, receiver.Suffix)); !errors.Is(err, ErrBadTag) {
+		t.Errorf("Expected ErrBadTag for an unsigned report, got %v", err)
+	}
+	tampered := signed
+	tampered.bin = "r"
+	if _, err := receiver.ParseReport(name(tampered, receiver.Suffix)); !errors.Is(err, ErrBadTag) {
+		t.Errorf("Expected ErrBadTag for a tampered report, got %v", err)
+	}
+	receiver.AuthKey = []byte("wrong secret")
+	if _, err := receiver.ParseReport(name(signed, receiver.Suffix)); !errors.Is(err, ErrBadTag) {
+		t.Errorf("Expected ErrBadTag for the wrong key, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := cache{}
+	k := Key{
+		Domain: "domain.example",
+		Date:   testDate,
+	}
+	if added, _ := c.Add(k, ""); !added {
+		t.Error("First add should succeed")
+	}
+	if added, _ := c.Add(k, ""); added {
+		t.Error("Duplicate add should fail")
+	}
+	if added, _ := c.Add(k, ""); added {
+		t.Error("Subsequent adds should still fail")
+	}
+}
+
+func TestCacheRejectsNonMidnight(t *testing.T) {
+	c := cache{}
+	k := Key{
+		Domain: "domain.example",
+		Date:   testDate.Add(time.Hour),
+	}
+	if added, err := c.Add(k, ""); added || err == nil {
+		t.Error("A date that isn't midnight UTC should be rejected")
+	}
+	k.Date = time.Date(2020, time.February, 2, 0, 0, 0, 0, time.FixedZone("X", 3600))
+	if added, err := c.Add(k, ""); added || err == nil {
+		t.Error("A date that isn't in UTC should be rejected")
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	noon := time.Date(2020, time.February, 2, 12, 30, 0, 0, time.UTC)
+	k := NewKey("WWW.Domain.Example.", "ZZ", noon)
+	expected := Key{
+		Domain:  "www.domain.example",
+		Country: "zz",
+		Date:    time.Date(2020, time.February, 2, 0, 0, 0, 0, time.UTC),
+	}
+	if k != expected {
+		t.Errorf("%v != %v", k, expected)
+	}
+	if err := k.validate(); err != nil {
+		t.Error(err)
+	}
+	// The date is determined in UTC, regardless of the time zone.
+	late := time.Date(2020, time.February, 2, 23, 0, 0, 0, time.FixedZone("X", -3600))
+	if d := NewKey("domain.example", "zz", late).Date; !d.Equal(expected.Date.Add(24 * time.Hour)) {
+		t.Errorf("Unexpected date: %v", d)
+	}
+}
+
+func TestCacheMaxReports(t *testing.T) {
+	c := cache{}
+	for i := 0; i < maxReports; i++ {
+		k := Key{
+			Domain: fmt.Sprintf("domain%d.example", i),
+			Date:   testDate,
+		}
+		if added, err := c.Add(k, ""); !added {
+			t.Errorf("First add should succeed, but failed with err=%v", err)
+		}
+		if added, err := c.Add(k, ""); added || err != nil {
+			t.Errorf("Duplicate add should fail without an error, err=%v", err)
+		}
+	}
+	newKey := Key{
+		Domain: "newdomain.example",
+		Date:   testDate,
+	}
+	if _, err := c.Add(newKey, ""); err == nil {
+		t.Error("After maxReports, all additions for that date should fail with an error")
+	}
+}
+
+func TestCacheDateRollover(t *testing.T) {
+	c := cache{}
+	date1 := time.Date(2020, time.February, 02, 0, 0, 0, 0, time.UTC)
+	date2 := time.Date(2020, time.February, 03, 0, 0, 0, 0, time.UTC)
+	domain1 := "domain1.example"
+	domain2 := "domain2.example"
+	if added, _ := c.Add(Key{Domain: domain1, Date: date1}, ""); !added {
+		t.Error("First add should succeed")
+	}
+	if added, _ := c.Add(Key{Domain: domain2, Date: date1}, ""); !added {
+		t.Error("New domain on first date should succeed")
+	}
+	if added, _ := c.Add(Key{Domain: domain1, Date: date2}, ""); !added {
+		t.Error("Addition for a new date should succeed")
+	}
+	if added, err := c.Add(Key{Domain: domain2, Date: date1}, ""); added || err == nil {
+		t.Error("Addition for an old date should fail with an error")
+	}
+	if added, _ := c.Add(Key{Domain: domain2, Date: date2}, ""); !added {
+		t.Error("Re-addition for a new date should succeed")
+	}
+}
+
+type funcReportSender (func(Report) error)
+
+func (s funcReportSender) Send(r Report) error {
+	return s(r)
+}
+
+func TestOnceADayReportSender(t *testing.T) {
+	var r *Report
+	var f funcReportSender = func(report Report) error {
+		r = &report
+		return nil
+	}
+	s := newOnceADayReportSender(f, reporterConfig{})
+
+	v1, _ := NewValue("test1")
+	r1 := Report{
+		Key: Key{
+			Domain:  "domain.example",
+			Date:    testDate,
+			Country: country,
+		},
+		Values: []Value{v1},
+		bin:    "q",
+	}
+	if err := s.Send(r1); err != nil {
+		t.Error(err)
+	}
+
+	if r == nil || r.Key != r1.Key || r.Values[0] != r1.Values[0] || r.bin != r1.bin {
+		t.Errorf("Mismatch: %v != %v", r, r1)
+	}
+
+	// Report the same domain again with a different value.  The cache should
+	// prevent it from being sent again.  If `sender` is called again, it will panic.
+	v2, _ := NewValue("test2")
+	r2 := r1.Clone()
+	r2.Values[0] = v2 // Change the value
+	// This call to Send should be a no-op due to the cache hit.  A cache hit is
+	// not considered an error.
+	r = nil
+	if err := s.Send(r2); err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Error("Send should not have forwarded the duplicate report")
+	}
+
+	// Try the same report on the next day.
+	r3 := r1 // Copy r1
+	r3.Date = r3.Date.Add(24 * time.Hour)
+	if err := s.Send(r3); err != nil {
+		t.Fatal(err)
+	}
+	// The report should have passed through the cache.
+	if r == nil || r.Key != r3.Key || r.Values[0] != r3.Values[0] || r.bin != r3.bin {
+		t.Errorf("Mismatch: %v != %v", r, r1)
+	}
+}
+
+func TestReportClone(t *testing.T) {
+	original := Report{Key: NewKey("domain.example", country, testDate), Values: []Value{{"a"}, {"b"}}, bin: "q"}
+	clone := original.Clone()
+	if !clone.Equal(original) || clone.bin != original.bin {
+		t.Errorf("%v != %v", clone, original)
+	}
+	clone.Values[0] = Value{"c"}
+	if original.Values[0].String() != "a" {
+		t.Error("Clone shares values with the original")
+	}
+	if (Report{}).Clone().Values != nil {
+		t.Error("Clone of nil values should be nil")
+	}
+}
+
+func TestBurstReportSenderCopiesValues(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	s := newBurstReportSender(f, time.Minute, reporterConfig{scheduler: scheduler.schedule})
+	values := []Value{{"a"}}
+	if err := s.Send(Report{Key: NewKey("domain.example", country, testDate), Values: values, bin: "q"}); err != nil {
+		t.Fatal(err)
+	}
+	// The caller reuses its slice before the drain.
+	values[0] = Value{"b"}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Values[0].String() != "a" {
+		t.Errorf("Pending report was modified: %v", reports)
+	}
+}
+
+func TestOnceADayReportSenderConcurrent(t *testing.T) {
+	defer discardLog()()
+	for _, budget := range []int{1, 3} {
+		var sent int32
+		var f funcReportSender = func(Report) error {
+			atomic.AddInt32(&sent, 1)
+			return nil
+		}
+		s := newOnceADayReportSender(f, reporterConfig{dailyBudget: budget})
+		report := Report{Key: NewKey("domain.example", country, testDate), bin: "q"}
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if err := s.Send(report); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if sent != int32(budget) {
+			t.Errorf("Expected %d reports with budget %d, got %d", budget, budget, sent)
+		}
+	}
+}
+
+func TestOnceADayReportSenderBudget(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	s := newOnceADayReportSender(f, reporterConfig{dailyBudget: 2})
+	key := NewKey("domain.example", country, testDate)
+	for _, v := range []string{"a", "b", "c"} {
+		if err := s.Send(Report{Key: key, Values: []Value{{v}}, bin: "q"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports) != 2 || reports[0].Values[0].String() != "a" || reports[1].Values[0].String() != "b" {
+		t.Errorf("Expected the first two reports, got %v", reports)
+	}
+	// The budget is per domain, and is restored on the next day.
+	reports = nil
+	if err := s.Send(Report{Key: NewKey("other.example", country, testDate), bin: "q"}); err != nil {
+		t.Fatal(err)
+	}
+	key.Date = key.Date.AddDate(0, 0, 1)
+	for i := 0; i < 3; i++ {
+		if err := s.Send(Report{Key: key, bin: "q"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports) != 3 {
+		t.Errorf("Expected 3 reports, got %v", reports)
+	}
+	// The budget doesn't allow more distinct domains.
+	for i := 0; i <= maxReports; i++ {
+		k := Key{Domain: fmt.Sprintf("domain%d.example", i), Date: key.Date}
+		_, err := s.cache.Add(k, "")
+		if i < maxReports-1 && err != nil {
+			t.Fatal(err)
+		} else if i == maxReports && err == nil {
+			t.Error("Expected the cache to be full")
+		}
+	}
+	if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithDailyBudget(-1)); err == nil {
+		t.Error("Expected an error for a negative budget")
+	}
+}
+
+func TestDedupValues(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	s := newOnceADayReportSender(f, reporterConfig{dedupValues: true})
+	key := NewKey("domain.example", country, testDate)
+	for _, v := range []string{"a", "b", "a"} {
+		if err := s.Send(Report{Key: key, Values: []Value{{v}}, bin: "q"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports) != 2 || reports[0].Values[0].String() != "a" || reports[1].Values[0].String() != "b" {
+		t.Errorf("Expected one report for each distinct value, got %v", reports)
+	}
+	// The values are only combined with the domain within a single Key.
+	reports = nil
+	if err := s.Send(Report{Key: NewKey("other.example", country, testDate), Values: []Value{{"a"}}, bin: "q"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 {
+		t.Errorf("Expected a report for another domain, got %v", reports)
+	}
+}
+
+func TestClock(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	date := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return date }
+	scheduler := &fakeScheduler{}
+	buf := new(bytes.Buffer)
+	r, err := NewReporter(buf, 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || !reports[0].Date.Equal(TruncateDate(date)) {
+		t.Errorf("Expected a report dated by the clock, got %v", reports)
+	}
+	// The salt's creation time also comes from the clock.
+	b, err := newHashBinner(bytes.NewBuffer(buf.Bytes()), 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.created.Equal(TruncateDate(date)) {
+		t.Errorf("Wrong salt creation date: %v", b.created)
+	}
+}
+
+// A report built just before midnight must not be rejected as old by the
+// cache, even if a report from after midnight is sent concurrently.
+func TestMidnightRollover(t *testing.T) {
+	before := time.Date(2020, time.February, 3, 23, 59, 59, 0, time.UTC)
+	after := before.Add(2 * time.Second)
+	// The first report reads the clock before midnight, and then waits for
+	// the second report (from after midnight) to be sent, if it can be.
+	var armed, first int32
+	stamped := make(chan struct{})
+	done := make(chan struct{})
+	clock := func() time.Time {
+		if atomic.LoadInt32(&armed) == 0 {
+			return before
+		}
+		if atomic.AddInt32(&first, 1) == 1 {
+			close(stamped)
+			select {
+			case <-done:
+			case <-time.After(100 * time.Millisecond):
+			}
+			return before
+		}
+		return after
+	}
+	// Start the salt on the previous day, so that it isn't too new.
+	var salt [saltsize + timestampsize]byte
+	binary.BigEndian.PutUint64(salt[saltsize:], uint64(before.AddDate(0, 0, -1).Unix()))
+	var f funcReportSender = func(Report) error { return nil }
+	noDrain := func(time.Duration, func()) func() { return func() {} }
+	r, err := NewReporter(bytes.NewBuffer(salt[:]), 32, 0, country, time.Minute, f, WithScheduler(noDrain), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := new(bytes.Buffer)
+	w := log.Writer()
+	log.SetOutput(logs)
+	defer log.SetOutput(w)
+	atomic.StoreInt32(&armed, 1)
+	reported := make(chan error)
+	go func() {
+		reported <- r.Report("before.example")
+	}()
+	<-stamped
+	if err := r.Report("after.example"); err != nil {
+		t.Error(err)
+	}
+	close(done)
+	if err := <-reported; err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(logs.String(), "Old date") {
+		t.Errorf("Report was rejected as old: %s", logs)
+	}
+}
+
+func TestReportWithDate(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	now := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	today := TruncateDate(now)
+	yesterday := today.AddDate(0, 0, -1)
+	clock := func() time.Time { return now }
+	// The salt was created well before the replayed date.
+	var salt [saltsize + timestampsize]byte
+	binary.BigEndian.PutUint64(salt[saltsize:], uint64(today.AddDate(0, 0, -7).Unix()))
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(bytes.NewBuffer(salt[:]), 32, 1, country, time.Minute, f, WithScheduler(scheduler.schedule), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := NewValue("v")
+
+	for _, date := range []time.Time{
+		now,                        // Not midnight
+		today.AddDate(0, 0, 1),     // Future
+		today.AddDate(0, 0, -2),    // Too old
+		yesterday.Add(time.Second), // Not midnight
+	} {
+		if err := r.(DatedReporter).ReportWithDate(date, "domain.example", value); err == nil {
+			t.Errorf("Expected an error for %v", date)
+		}
+	}
+
+	if err := r.(DatedReporter).ReportWithDate(yesterday, "domain.example", value); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	// Replayed reports are still deduplicated.
+	if err := r.(DatedReporter).ReportWithDate(yesterday, "domain.example", value); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if err := r.(DatedReporter).ReportWithDate(today, "domain.example", value); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	// Yesterday can't be replayed after a report from today.
+	if err := r.(DatedReporter).ReportWithDate(yesterday, "other.example", value); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %v", reports)
+	}
+	if !reports[0].Date.Equal(yesterday) || !reports[1].Date.Equal(today) {
+		t.Errorf("Wrong dates: %v", reports)
+	}
+}
+
+func TestQueryReportSender(t *testing.T) {
+	var queries [][]byte
+	var reports []Report
+	sender := NewQueryReportSender("metrics.example", QueryOptions{}, func(query []byte, r Report) error {
+		queries = append(queries, query)
+		reports = append(reports, r)
+		return nil
+	})
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, sender, WithScheduler(scheduler.schedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The duplicate is suppressed before it reaches the callback.
+	for i := 0; i < 2; i++ {
+		if err := r.Report("domain.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.advance()
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 query, got %d", len(queries))
+	}
+	receiver := Receiver{Suffix: "metrics.example"}
+	parsed, err := receiver.ParseQuery(queries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(reports[0]) {
+		t.Errorf("Query doesn't match the report: %v != %v", parsed, reports[0])
+	}
+}
+
+func TestWithSalt(t *testing.T) {
+	// A salt file written by a Reporter.
+	file := new(bytes.Buffer)
+	if _, err := NewReporter(file, 32, 0, country, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	salt := append([]byte(nil), file.Bytes()...)
+	expected, err := newHashBinner(bytes.NewBuffer(salt), 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey("domain.example", country, testDate)
+
+	for _, opt := range []ReporterOption{WithSalt(salt), WithSaltSource(bytes.NewReader(salt))} {
+		var config reporterConfig
+		opt(&config)
+		b, err := newReportBuilder(nil, 32, 0, country, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.bin(key) != expected.bin(key) {
+			t.Error("Bin doesn't match the salt file")
+		}
+		if !b.saltCreated().Equal(expected.created) {
+			t.Errorf("Wrong creation date: %v != %v", b.saltCreated(), expected.created)
+		}
+	}
+	// The salt without a timestamp has an unknown creation date.
+	var config reporterConfig
+	WithSalt(salt[:saltsize])(&config)
+	if b, err := newReportBuilder(nil, 32, 0, country, config); err != nil || !b.saltCreated().IsZero() {
+		t.Errorf("Expected an unknown creation date: %v", err)
+	}
+
+	// A short salt is an error, rather than being completed.
+	if _, err := NewReporter(nil, 32, 0, country, time.Minute, nil, WithSalt(salt[:saltsize-1])); err == nil {
+		t.Error("Expected an error due to a short salt")
+	}
+	if _, err := NewReporter(nil, 32, 0, country, time.Minute, nil, WithSalt(salt), WithSharedSecret(salt)); err == nil {
+		t.Error("Expected an error due to a salt and a shared secret")
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "choir_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	defer discardLog()()
+	salt := new(bytes.Buffer)
+	now := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	// The first process exits before the burst drains.
+	noDrain := func(time.Duration, func()) func() { return func() {} }
+	r, err := NewReporter(salt, 32, 0, country, time.Minute, f, WithScheduler(noDrain), WithClock(clock), WithCacheFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("a.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := &fakeScheduler{}
+	restart := func() Reporter {
+		saltCopy := bytes.NewBuffer(salt.Bytes())
+		r, err := NewReporter(saltCopy, 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithClock(clock), WithCacheFile(file), WithBurstStrategy(func() BurstStrategy { return &allStrategy{} }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r = restart()
+	for _, domain := range []string{"a.example", "b.example"} {
+		if err := r.Report(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].Domain != "b.example" {
+		t.Errorf("Expected only b.example, got %v", reports)
+	}
+
+	// Domains are not stored in plaintext.
+	contents, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte("example")) {
+		t.Error("Cache file contains a domain")
+	}
+
+	// The cache is flushed on the next day.
+	now = now.AddDate(0, 0, 1)
+	reports = nil
+	r = restart()
+	if err := r.Report("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Errorf("Expected a report on the next day, got %v", reports)
+	}
+	r = restart()
+	if err := r.Report("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Errorf("Duplicate report after restart: %v", reports)
+	}
+}
+
+func TestConnectivityProbe(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	online := false
+	probe := func() bool { return online }
+	o := &countingObserver{}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithConnectivityProbe(probe, nil), WithObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("domain.example"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline, got %v", err)
+	}
+	// The daily slot was not used.
+	online = true
+	if err := r.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || o.counts[EventOffline] != 1 {
+		t.Errorf("Expected one report after going online, got %v, %v", reports, o.counts)
+	}
+
+	// With an offline sender, reports are queued and use their daily slot.
+	var queue bytes.Buffer
+	reports = nil
+	online = false
+	r, err = NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithConnectivityProbe(probe, NewQueueReportSender(&queue, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := r.(ChannelReporter).Channel(0, "channel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	online = true
+	if err := channel.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 0 {
+		t.Errorf("Expected the duplicate to be dropped, got %v", reports)
+	}
+	if sent, err := DrainQueue(&queue, f, today()); err != nil || sent != 1 {
+		t.Errorf("Expected one queued report, got %d, %v", sent, err)
+	}
+}
+
+func TestLimitedReportSender(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var f funcReportSender = func(Report) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	}
+	for _, block := range []bool{false, true} {
+		s := NewLimitedReportSender(f, 2, block)
+		errs := make(chan error, 3)
+		for i := 0; i < 2; i++ {
+			go func() { errs <- s.Send(Report{}) }()
+			<-started
+		}
+		if s.InFlight() != 2 {
+			t.Errorf("Expected 2 in flight, got %d", s.InFlight())
+		}
+		go func() { errs <- s.Send(Report{}) }()
+		if !block {
+			if err := <-errs; !errors.Is(err, ErrTooManySends) {
+				t.Errorf("Expected ErrTooManySends, got %v", err)
+			}
+		}
+		// Finish the first two sends, and the third if it was blocked.
+		unblock <- struct{}{}
+		unblock <- struct{}{}
+		if block {
+			<-started
+			unblock <- struct{}{}
+		}
+		n := 2
+		if block {
+			n = 3
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+		if s.InFlight() != 0 {
+			t.Errorf("Expected none in flight, got %d", s.InFlight())
+		}
+	}
+}
+
+// Observer that counts the reports at each stage.
+type countingObserver struct {
+	mu     sync.Mutex
+	counts map[Event]int
+	sends  int
+}
+
+func (o *countingObserver) Observe(event Event, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.counts == nil {
+		o.counts = make(map[Event]int)
+	}
+	o.counts[event] += n
+}
+
+func (o *countingObserver) StartSend() func(error) {
+	return func(error) {
+		o.mu.Lock()
+		o.sends++
+		o.mu.Unlock()
+	}
+}
+
+func TestObserver(t *testing.T) {
+	fail := false
+	var f funcReportSender = func(Report) error {
+		if fail {
+			return errors.New("Failed")
+		}
+		return nil
+	}
+	o := &countingObserver{}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discardLog()()
+	// One burst of three distinct domains, and a duplicate.
+	for _, domain := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		if err := r.Report(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.advance()
+	// Channels share the Observer.
+	channel, err := r.(ChannelReporter).Channel(0, "channel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if err := channel.Report("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	expected := map[Event]int{
+		EventBuilt:      5,
+		EventDuplicate:  1,
+		EventSuppressed: 2,
+		EventSent:       1,
+		EventFailed:     1,
+	}
+	if !reflect.DeepEqual(o.counts, expected) {
+		t.Errorf("Wrong counts: %v != %v", o.counts, expected)
+	}
+	if o.sends != 2 {
+		t.Errorf("Expected 2 sends, got %d", o.sends)
+	}
+	if EventSent.String() != "sent" || Event(-1).String() != "unknown" {
+		t.Error("Wrong event names")
+	}
+}
+
+// BurstStrategy that selects every report.
+type allStrategy struct {
+	reports []Report
+}
+
+func (s *allStrategy) Observe(r Report) error {
+	s.reports = append(s.reports, r)
+	return nil
+}
+
+func (s *allStrategy) Selected() []Report {
+	return s.reports
+}
+
+// ReportSender that records each batch.
+type batchSender struct {
+	batches [][]Report
+}
+
+func (s *batchSender) Send(r Report) error {
+	return errors.New("Unexpected call to Send")
+}
+
+func (s *batchSender) SendBatch(reports []Report) error {
+	s.batches = append(s.batches, reports)
+	return nil
+}
+
+func TestBatchReportSender(t *testing.T) {
+	sender := &batchSender{}
+	o := &countingObserver{}
+	scheduler := &fakeScheduler{}
+	newStrategy := func() BurstStrategy { return &allStrategy{} }
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, sender, WithScheduler(scheduler.schedule), WithBurstStrategy(newStrategy), WithObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := []string{"a.example", "b.example", "c.example"}
+	for _, domain := range domains {
+		if err := r.Report(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler.advance()
+	if len(sender.batches) != 1 {
+		t.Fatalf("Expected one batch, got %d", len(sender.batches))
+	}
+	batch := sender.batches[0]
+	if len(batch) != len(domains) {
+		t.Fatalf("Wrong batch size: %d", len(batch))
+	}
+	for i, domain := range domains {
+		if batch[i].Domain != domain {
+			t.Errorf("Wrong domain: %s != %s", batch[i].Domain, domain)
+		}
+	}
+	if o.sends != 1 || o.counts[EventSent] != len(domains) {
+		t.Errorf("Wrong observations: %d sends, %v", o.sends, o.counts)
+	}
+	// An empty burst doesn't produce a batch.
+	scheduler.advance()
+	if len(sender.batches) != 1 {
+		t.Errorf("Unexpected batch: %v", sender.batches)
+	}
+}
+
+func TestObserverTooLong(t *testing.T) {
+	o := &countingObserver{}
+	var f funcReportSender = func(Report) error { return nil }
+	r, err := NewReporter(new(bytes.Buffer), 32, 1, country, time.Minute, f, WithObserver(o), WithMaxSuffixLength(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example"
+	if err := r.Report(long, Value{strings.Repeat("c", 60)}); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("Expected ErrNameTooLong, got %v", err)
+	}
+	// Other errors are not counted.
+	if err := r.Report("a.example"); err == nil {
+		t.Fatal("Expected an error for the wrong number of values")
+	}
+	if o.counts[EventTooLong] != 1 || o.counts[EventBuilt] != 0 {
+		t.Errorf("Wrong counts: %v", o.counts)
+	}
+	if EventTooLong.String() != "too_long" {
+		t.Errorf("Wrong name: %s", EventTooLong)
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithMaxSuffixLength(10), WithMaxNameLength(60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name is "bin.country.date.domain.suffix": 60 characters.
+	domain := strings.Repeat("a", 27) + ".example"
+	if err := r.Report(domain); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("a" + domain); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("Expected ErrNameTooLong, got %v", err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Fatalf("Expected one report, got %v", reports)
+	}
+	if _, err := FormatQueryWithOptions(reports[0], "metrics.ex", QueryOptions{MaxNameLength: 60}); err != nil {
+		t.Error(err)
+	}
+	if _, err := FormatQueryWithOptions(reports[0], "metrics.ex", QueryOptions{MaxNameLength: 59}); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("Expected ErrNameTooLong, got %v", err)
+	}
+
+	if _, err := FormatQueryWithOptions(reports[0], "metrics.ex", QueryOptions{MaxNameLength: MaxNameLength + 1}); err == nil {
+		t.Error("Expected an error due to the maximum name length")
+	}
+	for _, opts := range [][]ReporterOption{
+		{WithMaxNameLength(MaxNameLength + 1)},
+		{WithMaxNameLength(-1)},
+		{WithMaxNameLength(20), WithMaxSuffixLength(20)},
+	} {
+		if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, opts...); err == nil {
+			t.Error("Expected an error due to the maximum name length")
+		}
+	}
+}
+
+// A salt file that blocks until `unblock` is closed.
+type slowFile struct {
+	unblock chan struct{}
+}
+
+func (f slowFile) Read(p []byte) (int, error) {
+	<-f.unblock
+	return 0, io.EOF
+}
+
+func (f slowFile) Write(p []byte) (int, error) {
+	<-f.unblock
+	return len(p), nil
+}
+
+func TestSaltTimeout(t *testing.T) {
+	file := slowFile{make(chan struct{})}
+	defer close(file.unblock)
+	defer discardLog()()
+	_, err := NewReporter(file, 32, 0, country, time.Minute, nil, WithSaltTimeout(10*time.Millisecond))
+	if !errors.Is(err, ErrSaltTimeout) {
+		t.Errorf("Expected ErrSaltTimeout, got %v", err)
+	}
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(file, 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithSaltTimeout(10*time.Millisecond), WithSaltFallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fallback salt works.
+	if err := r.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Errorf("Expected a report, got %v", reports)
+	}
+	// A fast file is unaffected by the timeout.
+	if _, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, nil, WithSaltTimeout(time.Minute)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEphemeralSalt(t *testing.T) {
+	defer discardLog()()
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(nil, 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithEphemeralSalt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 {
+		t.Errorf("Expected a report, got %v", reports)
+	}
+	if err := r.(SaltRotator).RotateSalt(); err == nil {
+		t.Error("Expected an error rotating an ephemeral salt")
+	}
+	// Each Reporter has its own salt.
+	other, err := NewReporter(nil, 32, 0, country, time.Minute, f, WithEphemeralSalt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.(*reporter).builder.binner.(*hashBinner).salt == other.(*reporter).builder.binner.(*hashBinner).salt {
+		t.Error("Ephemeral salts are identical")
+	}
+
+	for _, opt := range []ReporterOption{WithStrictSalt(), WithSalt(make([]byte, saltsize)), WithSharedSecret([]byte("secret"))} {
+		if _, err := NewReporter(nil, 32, 0, country, time.Minute, f, WithEphemeralSalt(), opt); err == nil {
+			t.Error("Expected an error due to conflicting options")
+		}
+	}
+}
+
+func TestRotateSalt(t *testing.T) {
+	file, err := ioutil.TempFile("", "choir_salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	defer discardLog()()
+	now := time.Date(2020, time.February, 3, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	r, err := NewReporter(file, 32, 0, country, time.Minute, nil, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := r.(ChannelReporter).Channel(0, "channel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := r.(*reporter).builder.binner.(*hashBinner)
+	old := b.salt
+
+	now = now.AddDate(0, 0, 1)
+	if err := r.(SaltRotator).RotateSalt(); err != nil {
+		t.Fatal(err)
+	}
+	if b.salt == old {
+		t.Error("Salt was not rotated")
+	}
+	if channel.(*reporter).builder.binner.(*hashBinner).salt != b.salt {
+		t.Error("Channel doesn't share the rotated salt")
+	}
+	if !r.(*reporter).builder.saltCreated().Equal(TruncateDate(now)) {
+		t.Errorf("Wrong creation date: %v", r.(*reporter).builder.saltCreated())
+	}
+	// The rotated salt is persisted.
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := newHashBinner(file, 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.salt != b.salt || !reloaded.created.Equal(b.created) {
+		t.Error("Rotated salt was not written to the file")
+	}
+	// Reports dated before the rotation are rejected.
+	if err := r.(DatedReporter).ReportWithDate(TruncateDate(now).AddDate(0, 0, -1), "domain.example"); !errors.Is(err, ErrSaltTooNew) {
+		t.Errorf("Expected ErrSaltTooNew, got %v", err)
+	}
+
+	// Salts that can't be rewritten can't be rotated.
+	for _, opts := range [][]ReporterOption{
+		nil, // A bytes.Buffer can't seek.
+		{WithSharedSecret(make([]byte, minSecretSize))},
+		{WithSalt(make([]byte, saltsize))},
+	} {
+		r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.(SaltRotator).RotateSalt(); err == nil {
+			t.Error("Expected an error")
+		}
+	}
+}
+
+// Salt file whose next write fails after writing all of its data.
+type failingSaltFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failingSaltFile) Write(p []byte) (int, error) {
+	if f.fail {
+		f.fail = false
+		n, _ := f.File.Write(p)
+		return n, errors.New("Disk full")
+	}
+	return f.File.Write(p)
+}
+
+func TestRotateSaltFailure(t *testing.T) {
+	legacy := make([]byte, saltsize)
+	for i := range legacy {
+		legacy[i] = byte(i)
+	}
+	// A new salt file, and a legacy one without a timestamp.
+	for _, contents := range [][]byte{nil, legacy} {
+		file, err := ioutil.TempFile("", "choir_salt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if _, err := file.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReporter(file, 32, 0, country, time.Minute, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, err := ioutil.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		impl := r.(*reporter)
+		impl.builder.saltFile = &failingSaltFile{File: file, fail: true}
+		b := impl.builder.binner.(*hashBinner)
+		old := b.salt
+		created := b.created
+		if err := r.(SaltRotator).RotateSalt(); err == nil {
+			t.Fatal("Expected an error")
+		}
+		if b.salt != old || !b.created.Equal(created) {
+			t.Error("Salt changed despite the failure")
+		}
+		// The file's original contents are restored exactly.
+		restored, err := ioutil.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, original) {
+			t.Errorf("Salt file changed: %x != %x", restored, original)
+		}
+	}
+}
 
-	if r == nil || r.Key != r1.Key || r.Values[0] != r1.Values[0] || r.bin != r1.bin {
-		t.Errorf("Mismatch: %v != %v", r, r1)
+func TestWithoutDailyDedup(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
 	}
-
-	// Report the same domain again with a different value.  The cache should
-	// prevent it from being sent again.  If `sender` is called again, it will panic.
-	v2, _ := NewValue("test2")
-	r2 := r1          // Copy r1
-	r2.Values[0] = v2 // Change the value
-	// This call to Send should be a no-op due to the cache hit.  A cache hit is
-	// not considered an error.
-	r = nil
-	if err := s.Send(r2); err != nil {
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule), WithoutDailyDedup())
+	if err != nil {
 		t.Fatal(err)
 	}
-	if r != nil {
-		t.Error("Send should not have forwarded the duplicate report")
-	}
-
-	// Try the same report on the next day.
-	r3 := r1 // Copy r1
-	r3.Date = r3.Date.Add(24 * time.Hour)
-	if err := s.Send(r3); err != nil {
-		t.Fatal(err)
+	for i := 0; i < 3; i++ {
+		if err := r.Report("domain.example"); err != nil {
+			t.Fatal(err)
+		}
+		scheduler.advance()
 	}
-	// The report should have passed through the cache.
-	if r == nil || r.Key != r3.Key || r.Values[0] != r3.Values[0] || r.bin != r3.bin {
-		t.Errorf("Mismatch: %v != %v", r, r1)
+	if len(reports) != 3 {
+		t.Errorf("Expected every report to be sent, got %v", reports)
 	}
 }
 
@@ -591,11 +4706,11 @@ func TestPopulateFile(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(salt) != 16 {
-		t.Errorf("Wrong buffer size: %d", buf.Len())
+	if len(salt) != saltsize+timestampsize {
+		t.Errorf("Wrong buffer size: %d", len(salt))
 	}
 	foundNonZero := false
-	for _, v := range salt {
+	for _, v := range salt[:saltsize] {
 		if v != 0 {
 			foundNonZero = true
 		}
@@ -607,7 +4722,7 @@ func TestPopulateFile(t *testing.T) {
 
 func TestReuseFile(t *testing.T) {
 	buf1 := new(bytes.Buffer)
-	b1, err := newReportBuilder(buf1, 32, 1, country)
+	b1, err := newReportBuilder(buf1, 32, 1, country, reporterConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -616,7 +4731,7 @@ func TestReuseFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	buf2 := bytes.NewBuffer(salt)
-	b2, err := newReportBuilder(buf2, 32, 1, country)
+	b2, err := newReportBuilder(buf2, 32, 1, country, reporterConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -645,6 +4760,491 @@ func TestReuseFile(t *testing.T) {
 	}
 }
 
+func TestBinFor(t *testing.T) {
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	scheduler := &fakeScheduler{}
+	file := new(bytes.Buffer)
+	r, err := NewReporter(file, 32, 0, country, time.Minute, f, WithScheduler(scheduler.schedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := r.(BinPreviewer).BinFor("Domain.Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Reporter with the same salt agrees.
+	r2, err := NewReporter(bytes.NewBuffer(file.Bytes()), 32, 0, country, time.Minute, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin2, err := r2.(BinPreviewer).BinFor("domain.example"); err != nil || bin2 != bin {
+		t.Errorf("Bin mismatch: %s != %s", bin2, bin)
+	}
+	scheduler.advance()
+	if len(reports) != 0 {
+		t.Error("BinFor should not send anything")
+	}
+	// BinFor doesn't touch the cache, so the domain can still be reported.
+	if err := r.Report("domain.example"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.advance()
+	if len(reports) != 1 || reports[0].bin != bin {
+		t.Errorf("Report doesn't match BinFor %q: %v", bin, reports)
+	}
+	if _, err := r.(BinPreviewer).BinFor(""); !errors.Is(err, ErrEmptyDomain) {
+		t.Errorf("Expected ErrEmptyDomain, got %v", err)
+	}
+}
+
+func TestSaltCreationTime(t *testing.T) {
+	buf := new(bytes.Buffer)
+	b1, err := newHashBinner(buf, 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b1.generated {
+		t.Error("Salt should have been generated")
+	}
+	if !b1.created.Equal(today()) {
+		t.Errorf("Unexpected creation date: %v", b1.created)
+	}
+	b2, err := newHashBinner(bytes.NewBuffer(buf.Bytes()), 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.generated {
+		t.Error("Salt should have been loaded")
+	}
+	if b2.salt != b1.salt || !b2.created.Equal(b1.created) {
+		t.Errorf("Mismatch: %v != %v", b2, b1)
+	}
+}
+
+func TestLegacySaltFile(t *testing.T) {
+	// Older versions wrote only the salt, with no creation time.
+	legacy := bytes.Repeat([]byte{7}, saltsize)
+	buf := bytes.NewBuffer(legacy)
+	b, err := newHashBinner(buf, 32, Base32, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.generated || !b.created.IsZero() {
+		t.Errorf("Legacy salt should be loaded with an unknown creation date: %v", b)
+	}
+	if buf.Len() != 0 {
+		t.Error("Nothing should be written to a legacy salt file")
+	}
+}
+
+func TestSaltTooNew(t *testing.T) {
+	file := bytes.NewBuffer(make([]byte, saltsize))
+	var timestamp [timestampsize]byte
+	tomorrow := today().Add(24 * time.Hour)
+	binary.BigEndian.PutUint64(timestamp[:], uint64(tomorrow.Unix()))
+	file.Write(timestamp[:])
+	b, err := newReportBuilder(file, 32, 1, country, reporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.build("domain.example", testValues[:1]); !errors.Is(err, ErrSaltTooNew) {
+		t.Errorf("Expected ErrSaltTooNew, got %v", err)
+	}
+}
+
+func TestStrictSalt(t *testing.T) {
+	file := new(bytes.Buffer)
+	b, err := newReportBuilder(file, 32, 1, country, reporterConfig{strictSalt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The salt was created today, so strict mode should reject today's reports.
+	if _, err := b.build("domain.example", testValues[:1]); !errors.Is(err, ErrSaltTooNew) {
+		t.Errorf("Expected ErrSaltTooNew, got %v", err)
+	}
+
+	// A salt created yesterday is acceptable.
+	file = bytes.NewBuffer(make([]byte, saltsize))
+	var timestamp [timestampsize]byte
+	yesterday := today().Add(-24 * time.Hour)
+	binary.BigEndian.PutUint64(timestamp[:], uint64(yesterday.Unix()))
+	file.Write(timestamp[:])
+	b, err = newReportBuilder(file, 32, 1, country, reporterConfig{strictSalt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.build("domain.example", testValues[:1]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditReportSender(t *testing.T) {
+	b, err := newReportBuilder(new(bytes.Buffer), 32, 2, country, reporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []Report
+	var f funcReportSender = func(r Report) error {
+		sent = append(sent, r)
+		return nil
+	}
+	auditLog := new(bytes.Buffer)
+	suffix := "metrics.example"
+	a := NewAuditReportSender(auditLog, suffix, QueryOptions{}, f)
+	var reports []Report
+	for _, domain := range []string{"domain1.example", "domain2.example"} {
+		report, err := b.build(domain, testValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Send(report); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+	if len(sent) != 2 {
+		t.Errorf("Expected 2 reports to be sent, got %d", len(sent))
+	}
+
+	queries, err := ReadAuditLog(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 queries, got %d", len(queries))
+	}
+	receiver := Receiver{Suffix: suffix, Values: 2}
+	for i, query := range queries {
+		parsed, err := receiver.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(reports[i]) {
+			t.Errorf("%v != %v", parsed, reports[i])
+		}
+	}
+}
+
+func TestReadAuditLogTruncated(t *testing.T) {
+	if _, err := ReadAuditLog(bytes.NewReader([]byte{0, 10, 1, 2, 3})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+	if queries, err := ReadAuditLog(new(bytes.Buffer)); err != nil || len(queries) != 0 {
+		t.Errorf("Expected an empty log, got %v, %v", queries, err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	q := NewQueueReportSender(buf, 2)
+	fresh := Report{
+		Key: Key{
+			Domain:  "domain.example",
+			Country: country,
+			Date:    testDate.AddDate(0, 0, 1),
+		},
+		Values: testValues,
+		bin:    "q",
+		suffix: "metrics.example",
+	}
+	stale := fresh
+	stale.Domain = "stale.example"
+	stale.Date = testDate
+	if err := q.Send(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Send(fresh); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	sent, err := DrainQueue(buf, f, fresh.Date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || len(reports) != 1 {
+		t.Fatalf("Expected only the fresh report to be sent, got %v", reports)
+	}
+	if !reports[0].Equal(fresh) {
+		t.Errorf("%v != %v", reports[0], fresh)
+	}
+	if reports[0].Suffix() != fresh.Suffix() {
+		t.Errorf("Suffix mismatch: %s != %s", reports[0].Suffix(), fresh.Suffix())
+	}
+}
+
+func TestQueueSendError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	q := NewQueueReportSender(buf, 10)
+	r := Report{
+		Key: Key{
+			Domain:  "domain.example",
+			Country: country,
+			Date:    today(),
+		},
+		Values: testValues,
+		bin:    "q",
+	}
+	q.Send(r)
+	q.Send(r)
+	sendErr := errors.New("Offline")
+	var f funcReportSender = func(r Report) error {
+		return sendErr
+	}
+	if sent, err := DrainQueue(buf, f, today()); sent != 0 || err != sendErr {
+		t.Errorf("Expected the first send error, got %d, %v", sent, err)
+	}
+}
+
+func TestQueueBadVersion(t *testing.T) {
+	buf := bytes.NewBufferString(`{"v":99,"domain":"domain.example"}` + "\n")
+	var f funcReportSender = func(r Report) error {
+		t.Error("Nothing should be sent")
+		return nil
+	}
+	if _, err := DrainQueue(buf, f, today()); err == nil {
+		t.Error("Expected an error due to the unsupported version")
+	}
+}
+
+func TestCompressedQueue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	q := NewCompressedQueueReportSender(buf, 100, 2)
+	var queued []Report
+	for i := 0; i < 5; i++ {
+		r := Report{
+			Key:    NewKey(fmt.Sprintf("domain%d.example", i), country, today()),
+			Values: testValues,
+			bin:    "q",
+		}
+		if err := q.Send(r); err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, r)
+	}
+	// Two complete batches have been written, and one report is pending.
+	complete := buf.Len()
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), gzipMagic) {
+		t.Error("Queue is not compressed")
+	}
+	data := buf.Bytes()
+
+	var reports []Report
+	var f funcReportSender = func(r Report) error {
+		reports = append(reports, r)
+		return nil
+	}
+	sent, err := DrainQueue(bytes.NewReader(data), f, today())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 5 || len(reports) != 5 {
+		t.Fatalf("Expected 5 reports, got %d", sent)
+	}
+	for i, r := range reports {
+		if !r.Equal(queued[i]) {
+			t.Errorf("%v != %v", r, queued[i])
+		}
+	}
+
+	// A truncated queue is recoverable up to the damage.
+	last := 0
+	for n := complete; n < len(data); n++ {
+		reports = nil
+		sent, err := DrainQueue(bytes.NewReader(data[:n]), f, today())
+		if err != nil {
+			t.Fatalf("Truncated at %d: %v", n, err)
+		}
+		if sent < 4 || sent < last {
+			t.Fatalf("Truncated at %d: only %d reports were recovered", n, sent)
+		}
+		last = sent
+	}
+}
+
+func TestCompressedQueueBadVersion(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Comment = "choir queue v99"
+	zw.Write([]byte("{}\n"))
+	zw.Close()
+	var f funcReportSender = func(r Report) error {
+		t.Error("Nothing should be sent")
+		return nil
+	}
+	if _, err := DrainQueue(buf, f, today()); err == nil {
+		t.Error("Expected an error due to the unsupported version")
+	}
+}
+
+// Silences the log for the duration of a benchmark, and returns a function
+// that restores it.
+func discardLog() func() {
+	w := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	return func() { log.SetOutput(w) }
+}
+
+func BenchmarkReport(b *testing.B) {
+	defer discardLog()()
+	var sender funcReportSender = func(Report) error { return nil }
+	noDrain := func(time.Duration, func()) func() { return func() {} }
+	burstSender := newBurstReportSender(sender, burst, reporterConfig{scheduler: noDrain})
+	r := &reporter{
+		// Use a fixed bin, to avoid depending on the salt file.
+		builder:  reportBuilder{values: 2, country: country, binner: testBinner("q"), clock: time.Now},
+		sender:   newOnceADayReportSender(burstSender, reporterConfig{}),
+		mu:       &sync.Mutex{},
+		observer: nopObserver{},
+	}
+	domains := make([]string, maxReports)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("domain%d.example", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.Report(domains[i%len(domains)], testValues...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBin(b *testing.B) {
+	binner := hashBinner{bins: 32, alphabet: Base32}
+	key := Key{
+		Domain:  "destination.example",
+		Country: country,
+		Date:    testDate,
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		binner.bin(key)
+	}
+}
+
+func BenchmarkFormatQuery(b *testing.B) {
+	report := Report{
+		Key: Key{
+			Domain:  "www.destination.example",
+			Country: country,
+			Date:    testDate,
+		},
+		Values: testValues,
+		bin:    "q",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := FormatQuery(report, "metrics.example.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendQuery(b *testing.B) {
+	report := Report{
+		Key: Key{
+			Domain:  "www.destination.example",
+			Country: country,
+			Date:    testDate,
+		},
+		Values: testValues,
+		bin:    "q",
+	}
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendQuery(buf[:0], report, "metrics.example.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseReport(b *testing.B) {
+	r := Receiver{
+		Suffix: "metrics.example.com",
+		Values: 2,
+	}
+	name := "150ms.hsts.q.zz.14131211.www.destination.example.metrics.example.com."
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ParseReport(name); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Feeds b.N reports, spread across `keys` keys and 32 bins, through Filter.
+// Reports the memory retained by the Filter per key, before the input is
+// closed.  Run with -benchtime equal to the number of keys to measure the
+// cost of a dam holding a single report.
+func benchmarkFilter(b *testing.B, keys int) {
+	const threshold = 8
+	v, _ := NewValue("1")
+	reports := make([]Report, keys)
+	for i := range reports {
+		reports[i] = Report{
+			Key: Key{
+				Domain:  fmt.Sprintf("domain%d.example", i),
+				Country: country,
+				Date:    testDate,
+			},
+			Values: []Value{v},
+		}
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	in := make(chan Report)
+	out := Filter(in, threshold)
+	done := make(chan int)
+	go func() {
+		released := 0
+		for range out {
+			released++
+		}
+		done <- released
+	}()
+	for i := 0; i < b.N; i++ {
+		r := reports[i%keys]
+		r.bin = Base32.encode(uint64(i/keys%32), 1)
+		in <- r
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	close(in)
+	<-done
+	retained := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	b.ReportMetric(float64(retained)/float64(keys), "B/key")
+}
+
+func BenchmarkFilter(b *testing.B) {
+	for _, keys := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("keys=%d", keys), func(b *testing.B) {
+			benchmarkFilter(b, keys)
+		})
+	}
+}
+
 func ExampleReporter_Report() {
 	// A real QuerySender should send queries over DNS.
 	var c channelReportSender = make(chan Report)
@@ -0,0 +1,154 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package choirtest implements support for testing implementations of
+// choir.ReportSender.
+package choirtest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/choir"
+)
+
+// The number of goroutines, and reports per goroutine, in the concurrency test.
+const (
+	concurrency = 16
+	perRoutine  = 10
+)
+
+// funcReportSender implements choir.ReportSender by calling a function.
+type funcReportSender func(choir.Report) error
+
+func (f funcReportSender) Send(r choir.Report) error {
+	return f(r)
+}
+
+// Reports returns `n` distinct reports with `values` values each, built by a
+// choir.Reporter with a new salt, as they would be passed to a ReportSender.
+func Reports(n, values int) ([]choir.Report, error) {
+	var mu sync.Mutex
+	var reports []choir.Report
+	var capture funcReportSender = func(r choir.Report) error {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, r)
+		return nil
+	}
+	// Drain each burst after its only report, so that every report is
+	// captured.
+	var drains []func()
+	schedule := func(d time.Duration, f func()) func() {
+		drains = append(drains, f)
+		return func() {}
+	}
+	reporter, err := choir.NewReporter(new(bytes.Buffer), 32, values, "zz", 0, capture, choir.WithScheduler(schedule))
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]choir.Value, values)
+	for i := 0; i < n; i++ {
+		for j := range vs {
+			if vs[j], err = choir.NewValue(fmt.Sprintf("v%d-%d", i, j)); err != nil {
+				return nil, err
+			}
+		}
+		if err := reporter.Report(fmt.Sprintf("domain%d.example", i), vs...); err != nil {
+			return nil, err
+		}
+		for _, drain := range drains {
+			drain()
+		}
+		drains = nil
+	}
+	return reports, nil
+}
+
+// TestReportSender checks that the ReportSenders returned by `factory`
+// satisfy the contract of choir.ReportSender: Send accepts valid reports
+// (including reports with no values), does not modify the report that it is
+// passed, and is safe for concurrent use.  Each check uses a new ReportSender
+// from `factory`.  The concurrency check is most effective when the test is
+// run with the race detector.
+func TestReportSender(t *testing.T, factory func() choir.ReportSender) {
+	t.Helper()
+	t.Run("Send", func(t *testing.T) {
+		for _, values := range []int{0, 1, 3} {
+			reports, err := Reports(3, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender := factory()
+			for _, r := range reports {
+				if err := sender.Send(r); err != nil {
+					t.Errorf("Send failed for a report with %d values: %v", values, err)
+				}
+			}
+		}
+	})
+
+	t.Run("NoModification", func(t *testing.T) {
+		reports, err := Reports(3, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender := factory()
+		for _, r := range reports {
+			before := r.String()
+			values := append([]choir.Value(nil), r.Values...)
+			if err := sender.Send(r); err != nil {
+				t.Fatal(err)
+			}
+			if after := r.String(); after != before {
+				t.Errorf("Send modified the report: %s != %s", after, before)
+			}
+			for i, v := range values {
+				if r.Values[i] != v {
+					t.Errorf("Send modified the values: %v != %v", r.Values, values)
+					break
+				}
+			}
+		}
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		reports, err := Reports(concurrency*perRoutine, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender := factory()
+		errs := make(chan error, len(reports))
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func(reports []choir.Report) {
+				defer wg.Done()
+				for _, r := range reports {
+					errs <- sender.Send(r)
+				}
+			}(reports[i*perRoutine : (i+1)*perRoutine])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Concurrent Send failed: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choirtest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/choir"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A ReportSender that discards every report.
+var discard funcReportSender = func(choir.Report) error { return nil }
+
+func TestReports(t *testing.T) {
+	reports, err := Reports(5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 5 {
+		t.Fatalf("Expected 5 reports, got %d", len(reports))
+	}
+	for _, r := range reports {
+		if len(r.Values) != 2 {
+			t.Errorf("Wrong number of values: %v", r)
+		}
+	}
+}
+
+func TestQueueReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewQueueReportSender(ioutil.Discard, 1000)
+	})
+}
+
+func TestCompressedQueueReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewCompressedQueueReportSender(ioutil.Discard, 1000, 7)
+	})
+}
+
+func TestAuditReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewAuditReportSender(ioutil.Discard, "metrics.example", choir.QueryOptions{}, discard)
+	})
+}
+
+func TestSigningReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewSigningReportSender([]byte("0123456789abcdef"), discard)
+	})
+}
+
+func TestQueryReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewQueryReportSender("metrics.example", choir.QueryOptions{}, func([]byte, choir.Report) error { return nil })
+	})
+}
+
+// Returns a response to `query` with the NXDOMAIN code, as the metrics server
+// would send.
+func nxdomain(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Error(err)
+		return nil
+	}
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: msg.Questions,
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return packed
+}
+
+func TestDNSReportSender(t *testing.T) {
+	// A resolver that answers every query with NXDOMAIN until it is closed.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(nxdomain(t, buf[:n]), addr)
+		}
+	}()
+	TestReportSender(t, func() choir.ReportSender {
+		return &choir.DNSReportSender{Resolver: conn.LocalAddr().String(), Suffix: "metrics.example"}
+	})
+}
+
+func TestDoHReportSender(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(nxdomain(t, query))
+	}))
+	defer server.Close()
+	TestReportSender(t, func() choir.ReportSender {
+		return &choir.DoHReportSender{URL: server.URL, Suffix: "metrics.example", Client: server.Client()}
+	})
+}
+
+func TestBeaconReportSender(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	TestReportSender(t, func() choir.ReportSender {
+		return &choir.BeaconReportSender{URL: server.URL, Suffix: "metrics.example", Client: server.Client()}
+	})
+}
+
+func TestLimitedReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewLimitedReportSender(discard, 4, true)
+	})
+}
+
+func TestDedupReportSender(t *testing.T) {
+	TestReportSender(t, func() choir.ReportSender {
+		return choir.NewDedupReportSender(discard, time.Minute, 100)
+	})
+}
@@ -24,6 +24,8 @@ import (
 	"io"
 	"log"
 	"math/big"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,6 +35,32 @@ import (
 
 const saltsize = 16 // # of bytes of local salt for bin assignments
 
+// # of bytes of the salt creation time, which follows the salt in the file.
+const timestampsize = 8
+
+// ErrSaltTooNew indicates that a report's date is not covered by the salt.
+// Bins for such a report would not be consistent with any reports that this
+// client made on that date using a previous salt, so the client might be
+// counted twice.
+var ErrSaltTooNew = errors.New("Salt was created after the report date")
+
+// ErrNoValues indicates that a Reporter that requires values was configured
+// for reports without any values.  See WithRequireValues.
+var ErrNoValues = errors.New("Reports must have at least one value")
+
+// ErrAmbiguousValue indicates that a value could be confused with a fixed
+// field of the report name.  See WithRejectAmbiguousValues.
+var ErrAmbiguousValue = errors.New("Value could be confused with a fixed field")
+
+// ErrSaltTimeout indicates that the salt could not be loaded in time.  See
+// WithSaltTimeout.
+var ErrSaltTimeout = errors.New("Timed out loading the salt")
+
+// ErrOffline indicates that a report was not sent because the client is
+// offline.  The report was not recorded in the daily cache, so it can be
+// reported again later.  See WithConnectivityProbe.
+var ErrOffline = errors.New("Client is offline")
+
 // Including a huge number of values is impractical for reasonable DNS
 // queries, and is unlikely if Choir is being used as intended.
 const maxValues = 255
@@ -41,34 +69,116 @@ const maxValues = 255
 // All date objects are in UTC at time 00:00:00.
 const dateForm = "20060102"
 
+// Compact dates are the number of days since compactDateEpoch, encoded in
+// Base32 with a fixed width of compactDateWidth characters, which covers
+// about 89 years.  See WithCompactDate.
+var compactDateEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const compactDateWidth = 3
+
+// Returns the label that encodes `date`, which must be midnight UTC (and in
+// range, if `compact`).
+func formatDate(date time.Time, compact bool) string {
+	if !compact {
+		return date.Format(dateForm)
+	}
+	days := date.Sub(compactDateEpoch) / (24 * time.Hour)
+	return Base32.encode(uint64(days), compactDateWidth)
+}
+
+// Reports whether `date` can be encoded as a compact date.
+func compactDateInRange(date time.Time) bool {
+	end := compactDateEpoch.AddDate(0, 0, 1<<(5*compactDateWidth))
+	return !date.Before(compactDateEpoch) && date.Before(end)
+}
+
+// Inverts formatDate(date, true).
+func parseCompactDate(label string) (time.Time, error) {
+	if len(label) != compactDateWidth || !Base32.contains(label) {
+		return time.Time{}, fmt.Errorf("Invalid compact date: %q", label)
+	}
+	return compactDateEpoch.AddDate(0, 0, int(Base32.decode(label))), nil
+}
+
 // Maximum number of reports per day.  This is used to limit cache memory
 // usage.  If individual users are reporting more than 1000 unique
 // domains per day, this library is probably not being used in the intended
 // manner.
 const maxReports = 1000
 
+// RecommendedBurst is the recommended minimum burst duration, which covers
+// the load time of a typical webpage.  Reports triggered by a single page
+// load are then treated as one burst, so at most one of them is sent.
+const RecommendedBurst = 5 * time.Second
+
 // ReportSender is a general interface for sending a Report to a metrics server.
 type ReportSender interface {
 	// Send is required to be safe for concurrent execution.
 	Send(Report) error
 }
 
+// BatchReportSender is an optional interface for a ReportSender that can send
+// several reports together, e.g. over a single connection.  If the sender
+// passed to NewReporter implements BatchReportSender, all the reports that
+// are selected from each burst are passed to SendBatch together, instead of
+// to Send one at a time.
+type BatchReportSender interface {
+	// SendBatch sends `reports`, which are not empty.  It is required to be
+	// safe for concurrent execution.
+	SendBatch(reports []Report) error
+}
+
+// Scheduler arranges for `f` to be called once, after at least `d` has
+// elapsed, and returns a function that cancels the call if it has not yet
+// happened.  time.AfterFunc is the canonical implementation.
+type Scheduler func(d time.Duration, f func()) (cancel func())
+
+// afterFunc implements Scheduler using time.AfterFunc.
+func afterFunc(d time.Duration, f func()) func() {
+	t := time.AfterFunc(d, f)
+	return func() { t.Stop() }
+}
+
 // burstReportSender implements ReportSender.  It wraps another ReportSender,
-// suppressing bursts of queries by only passing one randomly selected report
-// in each `burst` and silently dropping the remainder.
+// suppressing bursts of queries by only passing the reports selected by a
+// BurstStrategy in each `burst` and silently dropping the remainder.
 type burstReportSender struct {
-	burst   time.Duration
-	sender  ReportSender
-	mu      sync.Mutex // Protects `count` and `pending`.
-	count   int64      // Number of reports in the current burst.
-	pending Report     // Current selected report from (if count > 0).
+	burst     time.Duration
+	jitter    time.Duration // Maximum random offset from `burst`.
+	sender    ReportSender
+	scheduler Scheduler // Schedules the drain at the end of each burst.
+	// Creates the BurstStrategy for each burst.
+	newStrategy func() BurstStrategy
+	// If true, the number of reports in the burst is appended to each
+	// selected report as an additional value.
+	countValue bool
+	observer   Observer
+	mu         sync.Mutex    // Protects `count` and `strategy`.
+	count      int64         // Number of reports in the current burst.
+	strategy   BurstStrategy // Strategy for the current burst (if count > 0).
 }
 
-func newBurstReportSender(sender ReportSender, burst time.Duration) ReportSender {
-	if burst < 5*time.Second {
+func newBurstReportSender(sender ReportSender, burst time.Duration, config reporterConfig) ReportSender {
+	if burst < RecommendedBurst {
 		log.Println("Warning: Burst duration is too low for most use cases")
 	}
-	return &burstReportSender{burst: burst, sender: sender}
+	scheduler := config.scheduler
+	if scheduler == nil {
+		scheduler = afterFunc
+	}
+	newStrategy := config.newStrategy
+	if newStrategy == nil {
+		newStrategy = NewReservoirStrategy
+	}
+	return &burstReportSender{
+		burst:       burst,
+		jitter:      time.Duration(config.burstJitter * float64(burst)),
+		sender:      sender,
+		scheduler:   scheduler,
+		newStrategy: newStrategy,
+		countValue:  config.burstCount,
+		observer:    observer(config),
+	}
 }
 
 func (l *burstReportSender) Send(r Report) error {
@@ -76,100 +186,307 @@ func (l *burstReportSender) Send(r Report) error {
 	defer l.mu.Unlock()
 	// Keep track of how many reports have been received.
 	l.count++
-	// Maintain a uniformly random selection by replacing the pending report
-	// with decreasing probability (reservoir sampling).
-	i, err := rand.Int(rand.Reader, big.NewInt(l.count))
-	if err != nil {
-		return err
-	} else if i.Int64() == 0 {
-		// The probability of reaching this point is 1/count.
-		l.pending = r
-	}
-
 	if l.count == 1 {
 		// This is the first report in the burst.  Schedule a drain.
-		time.AfterFunc(l.burst, l.drain)
+		l.strategy = l.newStrategy()
+		l.scheduler(l.delay(), l.drain)
 	}
-	return nil // Errors from downstream senders are lost
+	// The report is held until the drain, so it must not share its values
+	// with the caller.  Errors from downstream senders are lost, since they
+	// occur in drain().
+	return l.strategy.Observe(r.Clone())
+}
+
+// Returns the duration of a new burst, which is `burst` offset by a uniformly
+// random amount in [-jitter, +jitter].
+func (l *burstReportSender) delay() time.Duration {
+	if l.jitter <= 0 {
+		return l.burst
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(2*int64(l.jitter)+1))
+	if err != nil {
+		// Fall back to the unjittered duration, which is still a valid burst.
+		log.Println("Failed to generate burst jitter", err)
+		return l.burst
+	}
+	return l.burst - l.jitter + time.Duration(i.Int64())
 }
 
 func (l *burstReportSender) drain() {
 	l.mu.Lock()
-	r := l.pending
+	strategy := l.strategy
+	count := l.count
 	l.count = 0
+	l.strategy = nil
 	l.mu.Unlock()
-	// Send the selected report.
-	if err := l.sender.Send(r); err != nil {
+	selected := strategy.Selected()
+	if suppressed := int(count) - len(selected); suppressed > 0 {
+		l.observer.Observe(EventSuppressed, suppressed)
+	}
+	reports := make([]Report, len(selected))
+	for i, r := range selected {
+		if l.countValue {
+			// Clone the report, so that the strategy's copy is not modified.
+			r = r.Clone()
+			r.Values = append(r.Values, NewCountValue(count))
+		}
+		reports[i] = r
+	}
+	if batch, ok := l.sender.(BatchReportSender); ok {
+		if len(reports) > 0 {
+			l.send(len(reports), func() error { return batch.SendBatch(reports) })
+		}
+		return
+	}
+	for _, r := range reports {
+		// Send the selected report.
+		l.send(1, func() error { return l.sender.Send(r) })
+	}
+}
+
+// Calls `send`, which sends `n` reports, and notifies the Observer.
+func (l *burstReportSender) send(n int, send func() error) {
+	done := l.observer.StartSend()
+	err := send()
+	done(err)
+	if err != nil {
 		// Since drain() runs asynchronously, there is no way to return
 		// errors to the caller.
 		log.Println("Error encountered in burst report sender", err)
+		l.observer.Observe(EventFailed, n)
+	} else {
+		l.observer.Observe(EventSent, n)
 	}
 }
 
-// Encapsulates the domain and value, along with other information
-// needed for correct anonymous reconstruction.
-func name(report Report, suffix string) string {
-	labels := make([]string, len(report.Values))
+// Returns the labels of the name that encodes `report`, not including the
+// suffix.  The domain is a single entry, which may contain several labels.
+func labels(report Report) []string {
+	labels := make([]string, len(report.Values), len(report.Values)+6)
 	for i, v := range report.Values {
 		labels[i] = v.String()
 	}
 	labels = append(labels,
 		report.bin,
 		report.Country,
-		report.Date.Format(dateForm),
-		report.Domain,
-		suffix)
-	return strings.Join(labels, ".")
+		formatDate(report.Date, report.compactDate),
+		report.Domain)
+	if report.tag != "" {
+		labels = append(labels, report.tag)
+	}
+	return labels
 }
 
-func formatQuery(name string) ([]byte, error) {
+// Encapsulates the domain and value, along with other information
+// needed for correct anonymous reconstruction.
+func name(report Report, suffix string) string {
+	return strings.Join(append(labels(report), suffix), ".")
+}
+
+// Returns the length of name(report, suffix) for a suffix of length
+// `suffixLength`, without constructing it.
+func nameLength(report Report, suffixLength int) int {
+	length := suffixLength
+	for _, l := range labels(report) {
+		length += len(l) + 1 // Including the following "."
+	}
+	return length
+}
+
+// MaxReportNameLength returns the worst-case length of the name that encodes
+// a report with this many `values`, each at most `maxValueLen` characters, for
+// `suffix` and this number of `bins` (encoded in Base32), not including the
+// domain.  The domain can therefore use at most
+// MaxNameLength - MaxReportNameLength(...) characters.  This allows a schema
+// to be checked for an adequate domain budget before it is deployed.  Options
+// that add labels (e.g. WithBurstCount or NewSigningReportSender) reduce the
+// budget further.
+func MaxReportNameLength(values, maxValueLen int, suffix string, bins int) int {
+	// Each label is followed by a ".".
+	length := values * (maxValueLen + 1)
+	length += Base32.width(bins) + 1
+	length += len(NoCountry) + 1
+	length += len(dateForm) + 1
+	length++ // The "." after the domain
+	return length + len(normalizeForReport(suffix))
+}
+
+// The maximum size of a query, which is also the UDP payload size that we
+// advertise using EDNS0.
+const udpLimit = 4096
+
+// QueryOptions configures optional features of the DNS queries produced by
+// FormatQueryWithOptions.  The zero value is the default.
+type QueryOptions struct {
+	// If positive, the query is padded to a multiple of this many bytes using
+	// the EDNS0 Padding option (RFC 7830).  This hides the length of the
+	// report from observers of an encrypted transport (e.g. DNS over HTTPS
+	// or TLS).  RFC 8467 recommends a block size of 128 for queries.
+	// Padding is useless without encryption, since the name is visible.
+	Padding int
+	// The type of the query.  The default is TXT.  Collectors may prefer
+	// another type (e.g. NULL) to avoid colliding with real TXT records.
+	Type dnsmessage.Type
+	// The class of the query.  The default is INET.
+	Class dnsmessage.Class
+	// If set, the query asks the resolver to forward this subnet to the
+	// authoritative server using EDNS Client Subnet (e.g. 203.0.113.0/24).
+	// This is only intended for testing how a collector handles ECS.  It
+	// reveals the client's approximate location, which defeats much of the
+	// purpose of Choir, so it must never be used in production.  By default,
+	// the query instructs the resolver not to forward the client's subnet.
+	ClientSubnet *net.IPNet
+	// If true, the query has no EDNS Client Subnet option at all, so the
+	// resolver may forward the client's subnet to the authoritative server.
+	// This is only intended as a fallback for resolvers that reject the
+	// option (see DNSReportSender.ECSFallback).  It can't be combined with
+	// ClientSubnet.
+	OmitClientSubnet bool
+	// If positive, names longer than this (not including the trailing ".")
+	// are rejected with ErrNameTooLong, to limit the size of queries.  It
+	// can't exceed MaxNameLength, which is the default.  See
+	// WithMaxNameLength.
+	MaxNameLength int
+}
+
+// Applies the default query type and class to `t` and `c`.
+func questionType(t dnsmessage.Type, c dnsmessage.Class) (dnsmessage.Type, dnsmessage.Class) {
+	if t == 0 {
+		t = dnsmessage.TypeTXT
+	}
+	if c == 0 {
+		c = dnsmessage.ClassINET
+	}
+	return t, c
+}
+
+// Returns the payload of the EDNS Client Subnet option (RFC 7871 section 6)
+// for `subnet`, or an option that disables ECS if `subnet` is nil.
+func formatECS(subnet *net.IPNet) ([]byte, error) {
+	if subnet == nil {
+		// Address family 2 is IPv6.  This value should have no effect, but according to
+		// RFC 7871, "at least one major authoritative server will ignore the option if
+		// FAMILY is not 1 or 2, even though it is irrelevant if there are no ADDRESS bits".
+		const ecsFamily = 2
+		const ecsPrefixLength = 0 // ECS disabled
+		var ecsPayload [4]byte
+		binary.BigEndian.PutUint16(ecsPayload[0:], ecsFamily)
+		binary.BigEndian.PutUint16(ecsPayload[2:], ecsPrefixLength)
+		return ecsPayload[:], nil
+	}
+
+	prefixLength, bits := subnet.Mask.Size()
+	var family uint16
+	var ip net.IP
+	if ip = subnet.IP.To4(); ip != nil && bits == 8*net.IPv4len {
+		family = 1
+	} else if ip = subnet.IP.To16(); ip != nil && bits == 8*net.IPv6len {
+		family = 2
+	} else {
+		return nil, fmt.Errorf("Invalid client subnet: %v", subnet)
+	}
+	// The address is truncated to the prefix, with the remaining bits zero.
+	address := ip.Mask(subnet.Mask)[:(prefixLength+7)/8]
+	payload := make([]byte, 4, 4+len(address))
+	binary.BigEndian.PutUint16(payload[0:], family)
+	payload[2] = byte(prefixLength) // Source prefix length
+	payload[3] = 0                  // Scope prefix length
+	return append(payload, address...), nil
+}
+
+func formatQuery(name string, opts QueryOptions) ([]byte, error) {
+	return appendQuery(nil, name, opts)
+}
+
+// Appends the query for `name` to `dst`.  On error, `dst` is returned
+// unchanged.
+func appendQuery(dst []byte, name string, opts QueryOptions) ([]byte, error) {
+	if opts.Padding < 0 || opts.Padding > udpLimit {
+		return dst, fmt.Errorf("Unreasonable padding block size: %d", opts.Padding)
+	}
 	if !strings.HasSuffix(name, ".") {
 		// NewName requires names to be in "canonical form" with a trailing ".".
 		name = name + "."
 	}
+	if opts.MaxNameLength < 0 || opts.MaxNameLength > MaxNameLength {
+		return dst, fmt.Errorf("Unreasonable maximum name length: %d", opts.MaxNameLength)
+	}
+	// NewName permits longer names than fit in a DNS message, which can only
+	// hold MaxNameLength characters, plus the trailing ".".
+	limit := MaxNameLength
+	if opts.MaxNameLength > 0 {
+		limit = opts.MaxNameLength
+	}
+	if len(name) > limit+1 {
+		return dst, fmt.Errorf("%w: %d > %d", ErrNameTooLong, len(name)-1, limit)
+	}
 	n, err := dnsmessage.NewName(name)
 	if err != nil {
-		return nil, err
+		return dst, err
 	}
 
+	qtype, qclass := questionType(opts.Type, opts.Class)
+
 	optHeader := dnsmessage.ResourceHeader{}
-	udpLimit := 4096
 	dummyRcode := dnsmessage.RCode(0)
 	// Setting DNSSEC OK to true would request RRSIGs for the TXT record we are
 	// querying.  Since we know that this TXT record doesn't exist, and we aren't
 	// even checking the response, there's no need to request signatures for it.
 	dnssecOK := false
 	if err := optHeader.SetEDNS0(udpLimit, dummyRcode, dnssecOK); err != nil {
-		return nil, err
+		return dst, err
 	}
 
-	// Address family 2 is IPv6.  This value should have no effect, but according to
-	// RFC 7871, "at least one major authoritative server will ignore the option if
-	// FAMILY is not 1 or 2, even though it is irrelevant if there are no ADDRESS bits".
-	const ecsFamily = 2
-	const ecsPrefixLength = 0 // ECS disabled
-	var ecsPayload [4]byte
-	binary.BigEndian.PutUint16(ecsPayload[0:], ecsFamily)
-	binary.BigEndian.PutUint16(ecsPayload[2:], ecsPrefixLength)
-
+	opt := &dnsmessage.OPTResource{}
+	if opts.OmitClientSubnet {
+		if opts.ClientSubnet != nil {
+			return dst, errors.New("Can't omit the client subnet option and also set it")
+		}
+	} else {
+		ecsPayload, err := formatECS(opts.ClientSubnet)
+		if err != nil {
+			return dst, err
+		}
+		opt.Options = append(opt.Options, dnsmessage.Option{
+			Code: 0x8, // EDNS Client Subnet
+			Data: ecsPayload,
+		})
+	}
 	msg := &dnsmessage.Message{
 		Header: dnsmessage.Header{RecursionDesired: true},
 		Questions: []dnsmessage.Question{{
 			Name:  n,
-			Type:  dnsmessage.TypeTXT,
-			Class: dnsmessage.ClassINET,
+			Type:  qtype,
+			Class: qclass,
 		}},
 		Additionals: []dnsmessage.Resource{{
 			Header: optHeader,
-			Body: &dnsmessage.OPTResource{
-				Options: []dnsmessage.Option{{
-					Code: 0x8, // EDNS Client Subnet
-					Data: ecsPayload[:],
-				}},
-			},
+			Body:   opt,
 		}},
 	}
-	return msg.Pack()
+	query, err := msg.AppendPack(dst)
+	if err != nil {
+		return dst, err
+	} else if opts.Padding == 0 {
+		return query, nil
+	}
+
+	// Each option adds a 4-byte header (code and length) to the message.
+	const optionHeaderSize = 4
+	length := len(query) - len(dst)
+	paddingSize := (opts.Padding - (length+optionHeaderSize)%opts.Padding) % opts.Padding
+	opt.Options = append(opt.Options, dnsmessage.Option{
+		Code: 0xc, // Padding
+		Data: make([]byte, paddingSize),
+	})
+	// Overwrite the unpadded query.
+	if query, err = msg.AppendPack(query[:len(dst)]); err != nil {
+		return dst, err
+	}
+	if length := len(query) - len(dst); length > udpLimit {
+		return dst, fmt.Errorf("Padded query is too large: %d > %d", length, udpLimit)
+	}
+	return query, nil
 }
 
 // FormatQuery returns a fully serialized DNS query for a TXT record at a name
@@ -179,62 +496,153 @@ func formatQuery(name string) ([]byte, error) {
 // Subnet extension, as described in
 // https://tools.ietf.org/html/rfc7871#section-7.1.2.
 func FormatQuery(report Report, suffix string) ([]byte, error) {
-	return formatQuery(name(report, suffix))
+	return FormatQueryWithOptions(report, suffix, QueryOptions{})
 }
 
-// Cache of domains that have already been reported today.
+// FormatQueryWithOptions is like FormatQuery, with optional features
+// configured by `opts`.
+func FormatQueryWithOptions(report Report, suffix string, opts QueryOptions) ([]byte, error) {
+	if err := checkSuffix(suffix); err != nil {
+		return nil, err
+	}
+	return formatQuery(name(report, suffix), opts)
+}
+
+// ReportName returns the name that encodes `report` as a subdomain of
+// `suffix`, without a trailing ".".  This is the name that FormatQuery places
+// in the question, and that Receiver.ParseReport inverts, so it can be used
+// to carry reports over other transports (see BeaconReportSender).
+func ReportName(report Report, suffix string) (string, error) {
+	if err := checkSuffix(suffix); err != nil {
+		return "", err
+	}
+	n := name(report, strings.TrimSuffix(suffix, "."))
+	if len(n) > MaxNameLength {
+		return "", fmt.Errorf("%w: %d > %d", ErrNameTooLong, len(n), MaxNameLength)
+	}
+	return n, nil
+}
+
+// AppendQuery is like FormatQuery, but appends the query to `dst` and returns
+// the extended buffer, so that the caller can reuse a buffer for many
+// queries.  On error, `dst` is returned unchanged.
+func AppendQuery(dst []byte, report Report, suffix string) ([]byte, error) {
+	return AppendQueryWithOptions(dst, report, suffix, QueryOptions{})
+}
+
+// AppendQueryWithOptions is like AppendQuery, with optional features
+// configured by `opts`.
+func AppendQueryWithOptions(dst []byte, report Report, suffix string, opts QueryOptions) ([]byte, error) {
+	if err := checkSuffix(suffix); err != nil {
+		return dst, err
+	}
+	return appendQuery(dst, name(report, suffix), opts)
+}
+
+// Cache of domains that have already been reported today on each channel.
 // The cache is flushed on the first report of each day.
 type cache struct {
-	date  time.Time // Today's date.
-	cache map[string]observed
+	date time.Time // Today's date.
+	// The number of reports admitted today for each entry.
+	counts map[string]int
+	// The number of reports admitted for each entry each day.  Zero means 1.
+	budget int
+	// If non-nil, entries are hashed and persisted to this file.
+	file *cacheFile
 }
 
-// Add this key to the cache.  Returns false if adding failed, because the
-// key is already in the cache or is too old.
-func (c *cache) Add(key Key) (added bool, err error) {
+// Add this key to the cache within `scope` (e.g. a channel).  Keys in
+// different scopes are distinct.  Returns false if adding failed, because the
+// key's budget for today is exhausted or the key is too old.
+func (c *cache) Add(key Key, scope string) (added bool, err error) {
+	if err := key.validate(); err != nil {
+		return false, err
+	}
 	if !key.Date.Equal(c.date) {
 		if key.Date.Before(c.date) {
 			// `key` has an old date.  Reject it.
 			return false, fmt.Errorf("Old date: %v < %v", key.Date, c.date)
 		}
 		// Date has changed.  Flush the cache
-		c.cache = make(map[string]observed)
+		if c.file != nil {
+			if err := c.file.reset(key.Date); err != nil {
+				return false, err
+			}
+		}
+		c.counts = make(map[string]int)
 		c.date = key.Date
 	}
-	if _, ok := c.cache[key.Domain]; ok {
-		// Key is already in the map
+	// The length prefix makes the entry unambiguous.
+	entry := strconv.Itoa(len(scope)) + ":" + scope + key.Domain
+	if c.file != nil {
+		entry = c.file.hash(entry)
+	}
+	n := c.counts[entry]
+	if n >= c.limit() {
+		// Key has already been reported enough times today.
 		return false, nil
 	}
-	if len(c.cache) >= maxReports {
+	if n == 0 && len(c.counts) >= maxReports {
 		// Too many reports today.  Cancel further reports to avoid unbounded
 		// cache memory usage.
 		return false, errors.New("Cache is full")
 	}
-	c.cache[key.Domain] = observed{}
+	if c.file != nil {
+		if err := c.file.add(entry); err != nil {
+			return false, err
+		}
+	}
+	c.counts[entry]++
 	return true, nil
 }
 
+// Returns the number of reports admitted for each entry each day.
+func (c *cache) limit() int {
+	if c.budget < 1 {
+		return 1
+	}
+	return c.budget
+}
+
 // Implements reportSender by wrapping another reportSender.  Only one report is permitted
-// for each domain each day; duplicate reports are dropped.
+// for each domain (or each domain and values, if dedupValues) each day, or
+// more if configured by WithDailyBudget; duplicate reports are dropped.
 type onceADayReportSender struct {
 	sender ReportSender
-	mu     sync.Mutex // Protects cache
+	// If true, reports with different values are not duplicates.
+	dedupValues bool
+	observer    Observer
+	mu          sync.Mutex // Protects cache
 	cache
 }
 
-func newOnceADayReportSender(sender ReportSender) ReportSender {
-	return &onceADayReportSender{sender: sender}
+func newOnceADayReportSender(sender ReportSender, config reporterConfig) *onceADayReportSender {
+	return &onceADayReportSender{
+		sender:      sender,
+		dedupValues: config.dedupValues,
+		observer:    observer(config),
+		cache:       cache{budget: config.dailyBudget},
+	}
 }
 
 func (s *onceADayReportSender) Send(report Report) error {
+	scope := report.channel
+	if s.dedupValues {
+		scope = strconv.Itoa(len(scope)) + ":" + scope + report.Fingerprint()
+	}
+	// Checking and updating the cache under one lock ensures that
+	// concurrent duplicates can't both be admitted.  The lock is released
+	// before sending, so a slow sender doesn't block other reports.
 	s.mu.Lock()
-	added, err := s.cache.Add(report.Key)
+	added, err := s.cache.Add(report.Key, scope)
 	s.mu.Unlock()
 	if err != nil {
 		log.Printf("Failed to add report to cache: %v", err)
+		s.observer.Observe(EventDropped, 1)
 		return nil
 	} else if !added {
 		log.Println("Dropping duplicate report")
+		s.observer.Observe(EventDuplicate, 1)
 		return nil
 	}
 	return s.sender.Send(report)
@@ -243,99 +651,363 @@ func (s *onceADayReportSender) Send(report Report) error {
 type binner interface {
 	// Given a report key, compute a pseudorandom, consistent string.
 	bin(Key) string
+	// The UTC date when the salt was created, or the zero time if unknown.
+	saltCreated() time.Time
 }
 
 // hashBinner implements binner using a hash function with a secret local salt.
 type hashBinner struct {
-	salt [saltsize]byte
-	bins int
+	salt     [saltsize]byte
+	bins     int
+	alphabet Alphabet
+	// The UTC date when the salt was created, or the zero time if unknown.
+	created time.Time
+	// True if the salt was generated, rather than loaded from the file.
+	generated bool
 }
 
-func newHashBinner(file io.ReadWriter, bins int) (binner, error) {
+// The salt file contains the salt, followed by its creation time in
+// big-endian Unix seconds.  Files written by older versions contain only the
+// salt, so the creation time is treated as unknown.
+func newHashBinner(file io.ReadWriter, bins int, alphabet Alphabet, now time.Time) (hashBinner, error) {
 	if bins <= 0 {
-		return nil, errors.New("Users must be assigned to at least one bin")
+		return hashBinner{}, errors.New("Users must be assigned to at least one bin")
 	}
-	var salt [saltsize]byte
-	n, err := file.Read(salt[:])
+	b := hashBinner{bins: bins, alphabet: alphabet}
+	n, err := file.Read(b.salt[:])
 	if err != nil && !errors.Is(err, io.EOF) {
-		return nil, err
+		return hashBinner{}, err
 	} else if n < saltsize {
 		extra := make([]byte, saltsize-n)
 		if _, err := rand.Read(extra); err != nil {
-			return nil, err
+			return hashBinner{}, err
 		}
-		if _, err := file.Write(extra); err != nil {
-			return nil, err
+		var timestamp [timestampsize]byte
+		binary.BigEndian.PutUint64(timestamp[:], uint64(now.Unix()))
+		if _, err := file.Write(append(extra, timestamp[:]...)); err != nil {
+			return hashBinner{}, err
 		}
-		copy(salt[n:], extra)
+		copy(b.salt[n:], extra)
+		b.created = TruncateDate(now)
+		b.generated = true
+		log.Println("Warning: Generated a new salt.  If this client previously had a different salt, it may be counted twice today.")
+		return b, nil
 	}
-	return hashBinner{salt, bins}, nil
+	if b.created, err = readSaltCreated(file); err != nil {
+		return hashBinner{}, err
+	}
+	return b, nil
 }
 
-// See encodeStd in encoding/base32
-const base32 = "abcdefghijklmnopqrstuvwxyz234567"
+// Like newHashBinner, but generates a salt in memory, without a file.
+func newTemporaryHashBinner(bins int, alphabet Alphabet, now time.Time) (hashBinner, error) {
+	if bins <= 0 {
+		return hashBinner{}, errors.New("Users must be assigned to at least one bin")
+	}
+	b := hashBinner{bins: bins, alphabet: alphabet, created: TruncateDate(now), generated: true}
+	if _, err := rand.Read(b.salt[:]); err != nil {
+		return hashBinner{}, err
+	}
+	return b, nil
+}
 
-// Count the number of characters required to represent val in base32.
-func base32size(val uint) int {
-	if val == 0 {
-		// Representing "0" requires one character, not zero.
-		return 1
+// Like newHashBinner, but reads the salt from a read-only source in the same
+// format, and never generates or writes a salt.  The source must contain a
+// complete salt.
+func newReadOnlyHashBinner(r io.Reader, bins int, alphabet Alphabet) (hashBinner, error) {
+	if bins <= 0 {
+		return hashBinner{}, errors.New("Users must be assigned to at least one bin")
 	}
-	size := 0
-	for v := val; v != 0; v >>= 5 {
-		size++
+	b := hashBinner{bins: bins, alphabet: alphabet}
+	if _, err := io.ReadFull(r, b.salt[:]); err != nil {
+		return hashBinner{}, fmt.Errorf("Failed to read the salt: %w", err)
 	}
-	return size
+	var err error
+	if b.created, err = readSaltCreated(r); err != nil {
+		return hashBinner{}, err
+	}
+	return b, nil
 }
 
-// Returns a fixed-length base32 string representing the bin, given a
+// Reads the optional creation time that follows the salt, and returns its
+// UTC date, or the zero time if it is absent.
+func readSaltCreated(r io.Reader) (time.Time, error) {
+	var timestamp [timestampsize]byte
+	if _, err := io.ReadFull(r, timestamp[:]); err == nil {
+		created := time.Unix(int64(binary.BigEndian.Uint64(timestamp[:])), 0)
+		return TruncateDate(created), nil
+	} else if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return time.Time{}, err
+	}
+	return time.Time{}, nil
+}
+
+// Calls `load`, but gives up after `timeout`, if it is positive.  On timeout,
+// returns ErrSaltTimeout, or the result of `fallback` if `useFallback`.  The
+// call to `load` continues in the background, and its result is discarded.
+func loadSalt(load func() (hashBinner, error), timeout time.Duration, useFallback bool, fallback func() (hashBinner, error)) (hashBinner, error) {
+	if timeout <= 0 {
+		return load()
+	}
+	type result struct {
+		binner hashBinner
+		err    error
+	}
+	loaded := make(chan result, 1)
+	go func() {
+		b, err := load()
+		loaded <- result{b, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-loaded:
+		return r.binner, r.err
+	case <-timer.C:
+	}
+	if !useFallback {
+		return hashBinner{}, ErrSaltTimeout
+	}
+	log.Println("Warning: Timed out loading the salt.  Using a temporary in-memory salt instead.")
+	return fallback()
+}
+
+// Returns a fixed-length string representing the bin, given a
 // slice of pseudorandom bytes.
 func (b hashBinner) bin(k Key) string {
+	return hashBin(b.salt[:], b.bins, b.alphabet, k)
+}
+
+func (b hashBinner) saltCreated() time.Time {
+	return b.created
+}
+
+// Replaces the salt with a new random salt, created at `now`, and writes it
+// to the beginning of `file`, replacing the old salt.  If writing fails, the
+// file's original contents are written back, and the salt is unchanged.
+func (b *hashBinner) rotate(file io.ReadWriteSeeker, now time.Time) error {
+	var salt [saltsize + timestampsize]byte
+	if _, err := rand.Read(salt[:saltsize]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(salt[saltsize:], uint64(now.Unix()))
+	// Legacy salt files have no timestamp, so the original may be shorter.
+	var old [saltsize + timestampsize]byte
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(file, old[:])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	if err := writeSalt(file, salt[:]); err != nil {
+		if restoreErr := restoreSalt(file, old[:n]); restoreErr != nil {
+			return fmt.Errorf("Failed to restore the old salt (%v) after: %w", restoreErr, err)
+		}
+		return err
+	}
+	copy(b.salt[:], salt[:saltsize])
+	b.created = TruncateDate(now)
+	b.generated = true
+	return nil
+}
+
+// Writes back the original contents `old` of a salt file after a failed
+// rotation, truncating it to their length if `file` supports it.
+func restoreSalt(file io.WriteSeeker, old []byte) error {
+	if err := writeSalt(file, old); err != nil {
+		return err
+	}
+	if truncater, ok := file.(interface{ Truncate(int64) error }); ok {
+		return truncater.Truncate(int64(len(old)))
+	}
+	return nil
+}
+
+// Writes `salt` to the beginning of `file`, and syncs it to storage if `file`
+// supports it.
+func writeSalt(file io.WriteSeeker, salt []byte) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if n, err := file.Write(salt); err != nil {
+		return err
+	} else if n < len(salt) {
+		return io.ErrShortWrite
+	}
+	if syncer, ok := file.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Computes the bin for `k` using `salt`.
+func hashBin(salt []byte, bins int, alphabet Alphabet, k Key) string {
 	// Compute assigned bin.  This behavior can be arbitrary, so long as it
 	// is pseudorandom and depends only on the domain, country and date.
 	components := [...]string{k.Domain, k.Country, k.Date.Format(dateForm)}
-	h := hmac.New(sha256.New, b.salt[:])
+	h := hmac.New(sha256.New, salt)
 	io.WriteString(h, strings.Join(components[:], ";"))
 	code := h.Sum(nil)
-	bin := binary.LittleEndian.Uint64(code) % uint64(b.bins)
+	bin := binary.LittleEndian.Uint64(code) % uint64(bins)
+	return alphabet.encode(bin, alphabet.width(bins))
+}
+
+// The minimum length of a shared secret.  See WithSharedSecret.
+const minSecretSize = saltsize
 
-	// Perform base32 encoding.  Doing this explicitly here is easier than
-	// cleaning up the output of the encoding/base32 package, which requires
-	// its input to be sized in whole bytes, and adds padding to both ends
-	// of its output.
-	maxBin := b.bins - 1
-	size := base32size(uint(maxBin))
-	chars := make([]byte, size)
-	for i := size - 1; i >= 0; i-- { // Big-endian representation
-		chars[i] = base32[bin&0x1f]
-		bin >>= 5
+// secretBinner implements binner using a salt that is derived from a shared
+// secret for each day, so that every client with the secret uses the same
+// bins.
+type secretBinner struct {
+	secret   []byte
+	bins     int
+	alphabet Alphabet
+}
+
+func newSecretBinner(secret []byte, bins int, alphabet Alphabet) (secretBinner, error) {
+	if bins <= 0 {
+		return secretBinner{}, errors.New("Users must be assigned to at least one bin")
 	}
-	return string(chars)
+	if len(secret) < minSecretSize {
+		return secretBinner{}, fmt.Errorf("Shared secret is too short: %d < %d", len(secret), minSecretSize)
+	}
+	return secretBinner{
+		secret:   append([]byte(nil), secret...),
+		bins:     bins,
+		alphabet: alphabet,
+	}, nil
+}
+
+// Derives the salt for `date` using HKDF-SHA256 (RFC 5869), with the date as
+// the context information.  The output is a single block, so the expansion
+// step is one HMAC.
+func (b secretBinner) salt(date time.Time) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(b.secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	io.WriteString(expand, "choir salt "+date.Format(dateForm))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:saltsize]
+}
+
+func (b secretBinner) bin(k Key) string {
+	return hashBin(b.salt(k.Date), b.bins, b.alphabet, k)
+}
+
+// The salt for each day is derived from the secret, so it has no creation
+// date.
+func (b secretBinner) saltCreated() time.Time {
+	return time.Time{}
 }
 
 type reportBuilder struct {
 	values  int
 	country string
 	binner
+	// The length of the longest suffix that will be used with these reports.
+	suffixLength int
+	// The maximum length of a report's name.  Zero means MaxNameLength.  See
+	// WithMaxNameLength.
+	maxNameLength int
+	// If set, each report is assigned one of these suffixes at random.
+	suffixes []string
+	// The length of any values that will be added after building.
+	extraLength int
+	// The file that the salt was loaded from, if it can be rotated.  See
+	// SaltRotator.
+	saltFile io.ReadWriter
+	// If true, reports are only built after the salt's creation date.
+	strictSalt bool
+	// If true, dates are encoded compactly.  See WithCompactDate.
+	compactDate bool
+	// If true, values that look like fixed fields are rejected.
+	rejectAmbiguous bool
+	// If true, reports must have at least one value.
+	requireValues bool
+	// The width of each bin label.
+	binWidth int
+	// If true, the burst count is appended to each report after building.
+	burstCount bool
+	// If true, domains with a single label are permitted.
+	singleLabel bool
+	// The alphabet used to encode bins.
+	alphabet Alphabet
+	// If positive, only reports in the first `activeBins` bins are sent.
+	activeBins int
+	// The policy for the value at each position, if any.
+	policies []ValuePolicy
+	// The suffix of this builder's channel, or "" if it is not a channel.
+	channel string
+	// The source of the current time.
+	clock Clock
 }
 
+// Clock returns the current time.  time.Now is the canonical implementation.
+type Clock func() time.Time
+
 func today() time.Time {
-	year, month, day := time.Now().UTC().Date()
-	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return TruncateDate(time.Now())
 }
 
 // Encapsulates the domain and values, along with other information
 // needed for correct anonymous reconstruction.  All inputs must be lower-case
 // ASCII text, and each entry in the value must be at most 63 characters.
 func (b reportBuilder) build(domain string, values []Value) (Report, error) {
+	return b.buildWithDate(TruncateDate(b.clock()), domain, values)
+}
+
+// The number of days before today that ReportWithDate accepts.
+const maxReplayDays = 1
+
+// Checks that `date` is a UTC midnight that ReportWithDate can accept today.
+func (b reportBuilder) validateReplayDate(date time.Time) error {
+	if !date.Equal(TruncateDate(date)) {
+		return fmt.Errorf("Date is not midnight UTC: %v", date)
+	}
+	today := TruncateDate(b.clock())
+	if date.After(today) {
+		return fmt.Errorf("Date is in the future: %v > %v", date, today)
+	}
+	if oldest := today.AddDate(0, 0, -maxReplayDays); date.Before(oldest) {
+		return fmt.Errorf("Date is too old to replay: %v < %v", date, oldest)
+	}
+	return nil
+}
+
+// Like build, but reports on `date` instead of today.
+func (b reportBuilder) buildWithDate(date time.Time, domain string, values []Value) (Report, error) {
 	if len(values) != b.values {
 		return Report{}, fmt.Errorf("Wrong number of values: %d != %d", len(values), b.values)
 	}
-	if _, err := dnsmessage.NewName(domain); err != nil {
+	if b.requireValues && len(values) == 0 {
+		return Report{}, ErrNoValues
+	}
+	for i, policy := range b.policies {
+		if policy == nil {
+			continue
+		}
+		if err := policy(values[i]); err != nil {
+			return Report{}, &ValueError{Index: i, Err: err}
+		}
+	}
+	if b.rejectAmbiguous {
+		for _, v := range values {
+			if b.ambiguous(v) {
+				return Report{}, fmt.Errorf("%w: %s", ErrAmbiguousValue, v)
+			}
+		}
+	}
+	domain, err := normalizeDomain(domain, b.singleLabel)
+	if err != nil {
 		return Report{}, err
 	}
-	date := today()
-	domain = normalizeForReport(domain)
+	if created := b.saltCreated(); date.Before(created) || (b.strictSalt && !date.After(created)) {
+		return Report{}, ErrSaltTooNew
+	}
+	if b.compactDate && !compactDateInRange(date) {
+		return Report{}, fmt.Errorf("Date can't be encoded compactly: %v", date)
+	}
 
 	key := Key{
 		Domain:  domain,
@@ -345,26 +1017,209 @@ func (b reportBuilder) build(domain string, values []Value) (Report, error) {
 
 	bin := b.binner.bin(key)
 
-	return Report{
-		Key:    key,
-		Values: values,
-		bin:    bin,
-	}, nil
+	report := Report{
+		Key: key,
+		// Copy the values, so that the caller can reuse its slice while
+		// this report is pending.
+		Values:      append([]Value(nil), values...),
+		bin:         bin,
+		channel:     b.channel,
+		compactDate: b.compactDate,
+	}
+	suffixLength := b.suffixLength
+	if len(b.suffixes) > 0 {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(b.suffixes))))
+		if err != nil {
+			return Report{}, err
+		}
+		report.suffix = b.suffixes[i.Int64()]
+		if len(report.suffix) > suffixLength {
+			suffixLength = len(report.suffix)
+		}
+	}
+	if length, limit := nameLength(report, suffixLength)+b.extraLength, b.nameLimit(); length > limit {
+		return Report{}, fmt.Errorf("%w: %d > %d", ErrNameTooLong, length, limit)
+	}
+	return report, nil
 }
 
-func newReportBuilder(file io.ReadWriter, bins, values int, country string) (*reportBuilder, error) {
+// Returns the maximum length of a report's name.
+func (b reportBuilder) nameLimit() int {
+	if b.maxNameLength == 0 {
+		return MaxNameLength
+	}
+	return b.maxNameLength
+}
+
+// Reports whether `v` looks like one of the fixed fields that follow the
+// values in the name: a bin, a country code, or a date.
+func (b reportBuilder) ambiguous(v Value) bool {
+	s := v.String()
+	if len(s) == b.binWidth && b.alphabet.contains(s) {
+		return true
+	}
+	if _, err := NewCountry(s); err == nil {
+		return true
+	}
+	if b.compactDate {
+		_, err := parseCompactDate(s)
+		return err == nil
+	}
+	_, err := time.Parse(dateForm, s)
+	return len(s) == len(dateForm) && err == nil
+}
+
+// Checks that reports can have this many `values`, and returns the space to
+// reserve in the name for values that are added after building.
+func extraLength(values int, burstCount bool) (int, error) {
 	if values < 0 || values > maxValues {
-		return nil, fmt.Errorf("Unreasonable number of values: %d", values)
+		return 0, fmt.Errorf("Unreasonable number of values: %d", values)
 	}
-	if len(country) != 2 {
-		return nil, errors.New("Country code should be two characters")
+	extra := 0
+	if burstCount {
+		if values == maxValues {
+			return 0, fmt.Errorf("No room for the burst count value: %d", values)
+		}
+		extra += maxBucketLength + 1
 	}
-	country = strings.ToLower(country)
-	binner, err := newHashBinner(file, bins)
+	return extra, nil
+}
+
+func newReportBuilder(file io.ReadWriter, bins, values int, country string, config reporterConfig) (*reportBuilder, error) {
+	extraLength, err := extraLength(values, config.burstCount)
 	if err != nil {
 		return nil, err
 	}
-	return &reportBuilder{values, country, binner}, nil
+	if config.requireValues && values == 0 {
+		return nil, ErrNoValues
+	}
+	if len(config.policies) > values {
+		return nil, fmt.Errorf("More value policies than values: %d > %d", len(config.policies), values)
+	}
+	c, err := NewCountry(country)
+	if err != nil {
+		return nil, err
+	}
+	alphabet := config.alphabet
+	if alphabet == "" {
+		alphabet = Base32
+	}
+	if err := alphabet.validate(); err != nil {
+		return nil, err
+	}
+	clock := config.clock
+	if clock == nil {
+		clock = time.Now
+	}
+	var binner binner
+	var saltFile io.ReadWriter
+	if config.ephemeral {
+		if config.sharedSecret != nil || config.saltSource != nil {
+			return nil, errors.New("Can't use an ephemeral salt with another source of the salt")
+		}
+		if config.strictSalt {
+			return nil, errors.New("Can't use a strict salt with an ephemeral salt")
+		}
+		b, err := newTemporaryHashBinner(bins, alphabet, clock())
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Warning: Using an ephemeral salt.  Bins are not stable across runs, so this client may be counted more than once today.")
+		binner = &b
+	} else if config.sharedSecret != nil {
+		if config.saltSource != nil {
+			return nil, errors.New("Can't use both a shared secret and a salt source")
+		}
+		if binner, err = newSecretBinner(config.sharedSecret, bins, alphabet); err != nil {
+			return nil, err
+		}
+	} else {
+		load := func() (hashBinner, error) {
+			if config.saltSource != nil {
+				return newReadOnlyHashBinner(config.saltSource, bins, alphabet)
+			}
+			return newHashBinner(file, bins, alphabet, clock())
+		}
+		fellBack := false
+		hashBinner, err := loadSalt(load, config.saltTimeout, config.saltFallback, func() (hashBinner, error) {
+			fellBack = true
+			return newTemporaryHashBinner(bins, alphabet, clock())
+		})
+		if err != nil {
+			return nil, err
+		}
+		// The binner is shared by all the channels, so that they all see a
+		// rotated salt.
+		binner = &hashBinner
+		if config.saltSource == nil && !fellBack {
+			saltFile = file
+		}
+	}
+	if config.activeBins < 0 || config.activeBins > bins {
+		return nil, fmt.Errorf("Active bins out of range: %d", config.activeBins)
+	}
+	if config.maxName < 0 || config.maxName > MaxNameLength {
+		return nil, fmt.Errorf("Unreasonable maximum name length: %d", config.maxName)
+	}
+	if config.suffixLength < 0 || config.suffixLength >= MaxNameLength || (config.maxName > 0 && config.suffixLength >= config.maxName) {
+		return nil, fmt.Errorf("Unreasonable suffix length: %d", config.suffixLength)
+	}
+	suffixes := make([]string, len(config.suffixes))
+	for i, suffix := range config.suffixes {
+		suffixes[i] = normalizeForReport(suffix)
+		if _, err := dnsmessage.NewName(suffixes[i] + "."); err != nil || suffixes[i] == "" {
+			return nil, fmt.Errorf("Invalid suffix: %q", suffix)
+		}
+	}
+	return &reportBuilder{
+		values:          values,
+		country:         string(c),
+		binner:          binner,
+		suffixLength:    config.suffixLength,
+		maxNameLength:   config.maxName,
+		suffixes:        suffixes,
+		extraLength:     extraLength,
+		saltFile:        saltFile,
+		strictSalt:      config.strictSalt,
+		compactDate:     config.compactDate,
+		rejectAmbiguous: config.rejectAmbiguous,
+		requireValues:   config.requireValues,
+		binWidth:        alphabet.width(bins),
+		burstCount:      config.burstCount,
+		singleLabel:     config.singleLabel,
+		alphabet:        alphabet,
+		activeBins:      config.activeBins,
+		policies:        config.policies,
+		clock:           clock,
+	}, nil
+}
+
+// Reports whether `report` is in one of the active bins, and should be sent.
+func (b reportBuilder) active(report Report) bool {
+	return b.activeBins == 0 || b.alphabet.decode(report.bin) < uint64(b.activeBins)
+}
+
+// Returns a copy of this builder that builds reports with this many `values`
+// for the channel `suffix`.
+func (b reportBuilder) newChannel(values int, suffix string) (*reportBuilder, error) {
+	extraLength, err := extraLength(values, b.burstCount)
+	if err != nil {
+		return nil, err
+	}
+	if b.requireValues && values == 0 {
+		return nil, ErrNoValues
+	}
+	normalized := normalizeForReport(suffix)
+	if _, err := dnsmessage.NewName(normalized + "."); err != nil || normalized == "" {
+		return nil, fmt.Errorf("Invalid suffix: %q", suffix)
+	}
+	b.values = values
+	b.extraLength = extraLength
+	// The policies describe the parent's values, not the channel's.
+	b.policies = nil
+	b.suffixes = []string{normalized}
+	b.channel = normalized
+	return &b, nil
 }
 
 // Reporter wraps values into queries and sends them to a metrics server.
@@ -373,6 +1228,72 @@ type Reporter interface {
 	Report(domain string, values ...Value) error
 }
 
+// ErrNotSupported indicates that a Reporter doesn't support an optional
+// operation, e.g. because it wraps a Reporter that doesn't.
+var ErrNotSupported = errors.New("Not supported by this Reporter")
+
+// DatedReporter is a Reporter that can report events on a past date.  The
+// Reporters returned by NewReporter implement it, so callers can check for
+// it with a type assertion.
+type DatedReporter interface {
+	Reporter
+	// ReportWithDate is like Report, but reports the event on `date`, which
+	// must be midnight UTC today or yesterday, instead of today.  This allows
+	// queued events to be replayed with their original date.  Replayed
+	// reports pass through the same duplicate and burst suppression as live
+	// reports.  The daily cache only holds one date, so a report is dropped
+	// if a later date has already been reported; replay queued events before
+	// reporting new ones.  Dates before the salt was created are rejected
+	// with ErrSaltTooNew, and replaying with a different salt (e.g. after the
+	// salt file was lost) will not bin consistently with live reports.
+	ReportWithDate(date time.Time, domain string, values ...Value) error
+}
+
+// SaltRotator is implemented by the Reporters returned by NewReporter, which
+// can replace their salt.
+type SaltRotator interface {
+	// RotateSalt replaces the salt with a new random salt, writes it to the
+	// salt file, and uses it for all subsequent reports (on every channel),
+	// e.g. after a suspected compromise of the salt file.  The salt file
+	// must support io.Seeker (e.g. *os.File), so that the old salt can be
+	// overwritten.  Reporters that use WithSharedSecret, WithSaltSource or a
+	// fallback salt (see WithSaltFallback) can't rotate their salt.
+	//
+	// Rotation reassigns every bin immediately, so a client that already
+	// reported a Key today with the old salt is likely to be counted twice
+	// if it reports the Key again.  Salts should normally only be rotated at
+	// the end of a day (UTC).  The new salt is treated as created today (see
+	// WithStrictSalt), and reports dated before today are rejected with
+	// ErrSaltTooNew.
+	RotateSalt() error
+}
+
+// BinPreviewer is implemented by the Reporters returned by NewReporter, which
+// can show the bin that a report would be assigned to.
+type BinPreviewer interface {
+	// BinFor returns the bin that a report for `domain` would be assigned to
+	// today, without building or sending a report.  This allows a developer
+	// to check that the salt is stable, or an application to show the user
+	// which bin they share with other users.  The bin can help to link a
+	// user's reports, so it must not be sent anywhere.
+	BinFor(domain string) (string, error)
+}
+
+// ChannelReporter is a Reporter that can create channels for other types of
+// reports.  The Reporters returned by NewReporter implement it.
+type ChannelReporter interface {
+	Reporter
+	// Channel returns a Reporter for a different type of report, with this
+	// many `values`, that is sent to `suffix` (see Report.Suffix).  The
+	// channel shares this Reporter's salt, so a client is assigned the same
+	// bin on every channel, and its burst window, which limits the client's
+	// total rate of reports.  Duplicate reports are suppressed separately on
+	// each channel, and each channel rejects reports with the wrong number of
+	// values.  Channels with the same suffix share a daily cache.  The
+	// channel implements the same optional interfaces as its parent.
+	Channel(values int, suffix string) (Reporter, error)
+}
+
 // Implementation of Reporter.
 // Reports are sent to the metrics server through a recursive resolver,
 // preventing the metrics server from learning the client's IP address.
@@ -386,6 +1307,18 @@ type Reporter interface {
 type reporter struct {
 	builder reportBuilder
 	sender  ReportSender
+	// Serializes building and sending, so that reports reach the cache in
+	// the order of their dates.  Otherwise, a report built just before
+	// midnight could reach the cache after a report from the next day, and
+	// be rejected as old.  It is shared by all of a Reporter's channels.
+	mu       *sync.Mutex
+	observer Observer
+	// Reports whether the client is online, if set.  See
+	// WithConnectivityProbe.
+	probe func() bool
+	// The sender for reports while offline, if any.  Such reports are
+	// routed by a connectivityReportSender instead of dropped by send.
+	offline ReportSender
 }
 
 // NewReporter returns a reporter that uses the salt in `file` (which may
@@ -393,17 +1326,52 @@ type reporter struct {
 // of the specified number of `bins` for the client's `country`.  Bursts
 // of reports are accumulated for the specified duration, and one report from
 // each burst is passed asynchronously to `sender` as a Report ready to send.
-func NewReporter(file io.ReadWriter, bins, values int, country string, burst time.Duration, sender ReportSender) (Reporter, error) {
+// Optional behavior can be configured by passing ReporterOptions.
+func NewReporter(file io.ReadWriter, bins, values int, country string, burst time.Duration, sender ReportSender, opts ...ReporterOption) (Reporter, error) {
+	var config reporterConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if burst < config.minBurst {
+		return nil, fmt.Errorf("Burst duration is below the minimum: %v < %v", burst, config.minBurst)
+	}
+	if config.dailyBudget < 0 {
+		return nil, fmt.Errorf("Daily budget must not be negative: %d", config.dailyBudget)
+	}
+	if config.burstJitter < 0 || config.burstJitter > 1 {
+		return nil, fmt.Errorf("Burst jitter must be in [0, 1]: %v", config.burstJitter)
+	}
 	// Pipeline: builder -> onceADaySender -> burstSender -> sender
-	builder, err := newReportBuilder(file, bins, values, country)
+	// The onceADaySender is omitted if the daily dedup is disabled.
+	builder, err := newReportBuilder(file, bins, values, country, config)
 	if err != nil {
 		return nil, err
 	}
-	burstSender := newBurstReportSender(sender, burst)
-	onceADaySender := newOnceADayReportSender(burstSender)
+	burstSender := newBurstReportSender(sender, burst, config)
+	if config.probe != nil && config.offline != nil {
+		burstSender = &connectivityReportSender{
+			probe:    config.probe,
+			online:   burstSender,
+			offline:  config.offline,
+			observer: observer(config),
+		}
+	}
+	if !config.noDailyDedup {
+		once := newOnceADayReportSender(burstSender, config)
+		if config.cacheFile != nil {
+			if once.cache, err = loadCache(config.cacheFile, config.dailyBudget); err != nil {
+				return nil, fmt.Errorf("Failed to load the cache file: %w", err)
+			}
+		}
+		burstSender = once
+	}
 	return &reporter{
-		builder: *builder,
-		sender:  onceADaySender,
+		builder:  *builder,
+		sender:   burstSender,
+		mu:       &sync.Mutex{},
+		observer: observer(config),
+		probe:    config.probe,
+		offline:  config.offline,
 	}, nil
 }
 
@@ -412,9 +1380,117 @@ func NewReporter(file io.ReadWriter, bins, values int, country string, burst tim
 // sent to the metrics server.  All inputs must be lower-case ASCII text,
 // and each value must be at most 63 characters.
 func (r *reporter) Report(domain string, values ...Value) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	report, err := r.builder.build(domain, values)
 	if err != nil {
+		return r.buildFailed(err)
+	}
+	return r.send(report)
+}
+
+func (r *reporter) ReportWithDate(date time.Time, domain string, values ...Value) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.builder.validateReplayDate(date); err != nil {
 		return err
 	}
+	report, err := r.builder.buildWithDate(date, domain, values)
+	if err != nil {
+		return r.buildFailed(err)
+	}
+	return r.send(report)
+}
+
+// Notifies the Observer of a failure to build a report, if it is of interest
+// to operators, and returns `err`.
+func (r *reporter) buildFailed(err error) error {
+	if errors.Is(err, ErrNameTooLong) {
+		r.observer.Observe(EventTooLong, 1)
+	}
+	return err
+}
+
+// Sends a built report, unless it is outside the active bins.  The caller
+// must hold r.mu.
+func (r *reporter) send(report Report) error {
+	r.observer.Observe(EventBuilt, 1)
+	if !r.builder.active(report) {
+		// This user is not sampled for this Key today.
+		r.observer.Observe(EventInactive, 1)
+		return nil
+	}
+	if r.probe != nil && r.offline == nil && !r.probe() {
+		// Drop the report before it reaches the daily cache, so that it can
+		// be reported again when the client is online.
+		r.observer.Observe(EventOffline, 1)
+		return ErrOffline
+	}
 	return r.sender.Send(report)
 }
+
+// connectivityReportSender implements ReportSender by passing each report to
+// `offline` if `probe` reports that the client is offline, and to `online`
+// otherwise.  See WithConnectivityProbe.
+type connectivityReportSender struct {
+	probe    func() bool
+	online   ReportSender
+	offline  ReportSender
+	observer Observer
+}
+
+func (s *connectivityReportSender) Send(r Report) error {
+	if s.probe() {
+		return s.online.Send(r)
+	}
+	s.observer.Observe(EventOffline, 1)
+	return s.offline.Send(r)
+}
+
+func (r *reporter) RotateSalt() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.builder.binner.(*hashBinner)
+	if !ok || r.builder.saltFile == nil {
+		return errors.New("This Reporter's salt can't be rotated")
+	}
+	file, ok := r.builder.saltFile.(io.ReadWriteSeeker)
+	if !ok {
+		return errors.New("Salt file doesn't support seeking")
+	}
+	if err := b.rotate(file, r.builder.clock()); err != nil {
+		return err
+	}
+	log.Println("Rotated the salt.  Clients may be counted twice today.")
+	return nil
+}
+
+func (r *reporter) BinFor(domain string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	domain, err := normalizeDomain(domain, r.builder.singleLabel)
+	if err != nil {
+		return "", err
+	}
+	key := Key{
+		Domain:  domain,
+		Country: r.builder.country,
+		Date:    TruncateDate(r.builder.clock()),
+	}
+	return r.builder.bin(key), nil
+}
+
+func (r *reporter) Channel(values int, suffix string) (Reporter, error) {
+	builder, err := r.builder.newChannel(values, suffix)
+	if err != nil {
+		return nil, err
+	}
+	return &reporter{
+		builder:  *builder,
+		sender:   r.sender,
+		mu:       r.mu,
+		observer: r.observer,
+		probe:    r.probe,
+		offline:  r.offline,
+	}, nil
+}
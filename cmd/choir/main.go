@@ -0,0 +1,79 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command choir provides tools for operating a Choir metrics server.
+//
+// Usage:
+//
+//	choir validate -suffix metrics.example.com -values 2 NAME...
+//
+// The validate subcommand parses each report name (e.g. from a query log)
+// with the given Receiver configuration, and prints the decoded report or
+// the reason that it doesn't parse.  It exits with status 1 if any name
+// fails to parse.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Jigsaw-Code/choir"
+	"github.com/Jigsaw-Code/choir/validate"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: choir validate [flags] NAME...")
+	os.Exit(2)
+}
+
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	suffix := flags.String("suffix", "", "The name of the metrics server, e.g. metrics.example.com")
+	values := flags.Int("values", 0, "The number of values in each report")
+	alphabet := flags.String("alphabet", "", "The alphabet used to encode bins (default Base32)")
+	noCountry := flags.Bool("nocountry", false, "Reports use the NoCountry placeholder")
+	compactDate := flags.Bool("compactdate", false, "Reports use compact dates")
+	flags.Parse(args)
+	if *suffix == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	receiver := &choir.Receiver{
+		Suffix:      *suffix,
+		Values:      *values,
+		Alphabet:    choir.Alphabet(*alphabet),
+		NoCountry:   *noCountry,
+		CompactDate: *compactDate,
+	}
+	status := 0
+	for _, name := range flags.Args() {
+		if _, err := validate.Name(os.Stdout, receiver, name); err != nil {
+			status = 1
+		}
+	}
+	return status
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(runValidate(os.Args[2:]))
+	default:
+		usage()
+	}
+}
@@ -15,17 +15,120 @@
 package choir
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+// MaxNameLength is the maximum length of a DNS name in text form, not
+// including the trailing ".".  This corresponds to the limit of 255 bytes
+// on the wire.
+const MaxNameLength = 253
+
+// ErrNameTooLong indicates that the name encoding a report would exceed
+// the maximum length.
+var ErrNameTooLong = errors.New("Name is too long")
+
+// ErrEmptySuffix indicates that the suffix (the name of the metrics server)
+// is empty, typically because it was not configured.
+var ErrEmptySuffix = errors.New("Suffix is empty")
+
+// ErrSingleLabelDomain indicates that a domain has only one label (e.g.
+// "localhost").  Such names are not meaningful subjects for metrics.
+// See WithSingleLabelDomains.
+var ErrSingleLabelDomain = errors.New("Domain must have at least two labels")
+
+// ErrEmptyDomain indicates that a domain is empty, or is the root (".").
+// There is no "no domain" report: every report must have a subject domain,
+// so that its Key is meaningful and it is protected by k-anonymity.  Reports
+// that are not about a particular domain should use a fixed placeholder
+// domain that the server recognizes.
+var ErrEmptyDomain = errors.New("Domain is empty")
+
 // Key is the Quasi-Identifying information associated with a report.
 // It is protected by k-anonymity when using bin count filtering.
 type Key struct {
 	Domain  string
 	Country string
-	Date    time.Time
+	// Date must be midnight UTC, so that Keys for the same day are equal.
+	// Use NewKey or TruncateDate to construct a valid Date.
+	Date time.Time
+}
+
+// NoCountry is a placeholder country code for reports that are not
+// segmented by country.  Passing it to NewReporter places every user in a
+// single global group for each domain and date, so the server reaches its
+// k-anonymity threshold sooner and a wrong or unusual country can't single
+// out a user.  The cost is that the server can't distinguish problems that
+// only affect some countries.  It uses digits so that it can never be
+// mistaken for an ISO 3166 code.  The Receiver must set NoCountry to match.
+const NoCountry = "00"
+
+// Country is a normalized country code for a Key: either a lower-case ISO
+// 3166-1 alpha-2 code (e.g. "us"), UnknownCountry, or NoCountry.  Use
+// NewCountry to construct a valid Country.
+type Country string
+
+// UnknownCountry is the country code for a client whose country can't be
+// determined.  "zz" is reserved for user assignment by ISO 3166, and is
+// conventionally used for an unknown country.  Unlike NoCountry, reports
+// with UnknownCountry are segmented from the reports of clients in known
+// countries.
+const UnknownCountry Country = "zz"
+
+// NewCountry normalizes `country` to lower case, and checks that it is two
+// ASCII letters or NoCountry.
+func NewCountry(country string) (Country, error) {
+	if country == NoCountry {
+		return NoCountry, nil
+	}
+	if len(country) != 2 {
+		return "", fmt.Errorf("Country code should be two characters: %q", country)
+	}
+	country = strings.ToLower(country)
+	for i := 0; i < len(country); i++ {
+		if country[i] < 'a' || country[i] > 'z' {
+			return "", fmt.Errorf("Country code should be two letters: %q", country)
+		}
+	}
+	return Country(country), nil
+}
+
+// NewKey returns a Key with the domain and country normalized to lower case,
+// and the date truncated to midnight UTC.
+func NewKey(domain, country string, date time.Time) Key {
+	return Key{
+		Domain:  normalizeForReport(domain),
+		Country: strings.ToLower(country),
+		Date:    TruncateDate(date),
+	}
+}
+
+// TruncateDate returns midnight UTC on the date of `t` in UTC.
+func TruncateDate(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Returns an error if the Key's date is not midnight UTC.  Such a Key would
+// never be equal to the Key of another report from the same day.
+func (k Key) validate() error {
+	if k.Date != TruncateDate(k.Date) {
+		return fmt.Errorf("Date is not midnight UTC: %v", k.Date)
+	}
+	return nil
+}
+
+// String returns a readable representation of the Key, in the form
+// "domain=www.example.com country=us date=20191218".  The format is stable,
+// and each field is a single token.
+func (k Key) String() string {
+	return fmt.Sprintf("domain=%s country=%s date=%s", k.Domain, k.Country, k.Date.Format(dateForm))
 }
 
 // Value represents a string that has been validated as correctly formatted for
@@ -41,6 +144,24 @@ func (v Value) String() string {
 	return v.v
 }
 
+// MarshalText implements encoding.TextMarshaler, so that Values (and the
+// types that contain them, such as DamState) can be serialized, e.g. with
+// encoding/json.
+func (v Value) MarshalText() ([]byte, error) {
+	return []byte(v.v), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.  It returns an error if
+// the text is not a valid Value (see NewValue).
+func (v *Value) UnmarshalText(text []byte) error {
+	parsed, err := NewValue(string(text))
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
 // NewValue converts `v` to a Value, or returns an error if `v` is not a valid value.
 func NewValue(v string) (Value, error) {
 	if strings.ContainsRune(v, '.') {
@@ -70,12 +191,313 @@ type Report struct {
 	// or different values, but only one report will be sent for each Key.
 	Values []Value
 	bin    string
+	// Optional authentication tag.  See NewSigningReportSender.
+	tag string
+	// Optional suffix chosen by the Reporter.  See WithSuffixes.
+	suffix string
+	// The channel that built this report, or "" for the parent Reporter.
+	// See ChannelReporter.
+	channel string
+	// If true, the date is encoded compactly in the name.  See
+	// WithCompactDate.
+	compactDate bool
+}
+
+// Suffix returns the suffix that the Reporter chose for this report, or ""
+// if the Reporter was not configured with any suffixes or a Channel.  ReportSenders
+// should send the report to this suffix if it is set.  The choice is made
+// once, when the report is built, so retries of the same report always go
+// to the same suffix.
+func (r Report) Suffix() string {
+	return r.suffix
+}
+
+// Bin returns the bin of a report that was built by a Reporter or parsed by
+// a Receiver, or "" for a report that was released by Filter.  The bin is
+// only meaningful within a single Key (see Occupancy), and it can help to
+// link reports from the same user, so it should not be logged or stored
+// longer than necessary.
+func (r Report) Bin() string {
+	return r.bin
+}
+
+// Clone returns a copy of the report that doesn't share its Values with the
+// original.  Copying a Report by assignment copies only the slice header, so
+// modifying a value of the copy would also modify the original.
+func (r Report) Clone() Report {
+	if r.Values != nil {
+		r.Values = append([]Value(nil), r.Values...)
+	}
+	return r
+}
+
+// NewReportWithBin returns a Report for `key` and `values` that is assigned
+// to `bin`, which must be a label in `alphabet`, the Alphabet of the Reporter
+// that assigned it.  It is intended
+// only for trusted backfill, e.g. re-sending historical reports with the
+// bins recovered from old logs, because the salt that assigned them may no
+// longer exist, and recomputing them for a past date would be wrong.  The
+// Report can be passed directly to a ReportSender.
+//
+// This is dangerous.  The server's k-anonymity accounting assumes that each
+// user has exactly one bin for each Key, so reports with arbitrary bins can
+// make a single user appear to be many, and release Keys that should have
+// been withheld.  Never pass bins that did not come from a Reporter.
+func NewReportWithBin(key Key, values []Value, bin string, alphabet Alphabet) (Report, error) {
+	if err := key.validate(); err != nil {
+		return Report{}, err
+	}
+	if err := alphabet.validate(); err != nil {
+		return Report{}, err
+	}
+	if bin == "" || len(bin) > 63 || !alphabet.contains(bin) {
+		return Report{}, fmt.Errorf("Invalid bin: %q", bin)
+	}
+	return Report{Key: key, Values: values, bin: bin}.Clone(), nil
+}
+
+// Fingerprint returns a string that uniquely identifies the tuple of Values
+// in this report.  Two reports have the same Fingerprint if and only if they
+// have the same number of values and the values are equal in order.  Since
+// Key is comparable, a struct containing the Key and the Fingerprint can be
+// used to group reports in a map.
+//
+// The format is stable: it consists of the number of values in decimal,
+// followed by ":" and the values joined by ".".  This is unambiguous because
+// Values cannot contain ".".
+func (r Report) Fingerprint() string {
+	labels := make([]string, len(r.Values))
+	for i, v := range r.Values {
+		labels[i] = v.String()
+	}
+	return strconv.Itoa(len(labels)) + ":" + strings.Join(labels, ".")
+}
+
+// String returns a readable representation of the Report, consisting of its
+// Key followed by its values joined by ".", e.g.
+// "domain=www.example.com country=us date=20191218 values=[http.404]".
+// This is unambiguous because Values cannot contain ".".  The bin is omitted,
+// because it can help to link reports from the same user, which logs should
+// not make easier.
+func (r Report) String() string {
+	labels := make([]string, len(r.Values))
+	for i, v := range r.Values {
+		labels[i] = v.String()
+	}
+	return fmt.Sprintf("%v values=[%s]", r.Key, strings.Join(labels, "."))
+}
+
+// ToMap returns a flat representation of the Report, for templating and
+// logging.  The keys are "domain", "country", "date" (in the form
+// "20191218", even if the report uses WithCompactDate), "bin" (if the report
+// has one, see Bin), and "value0", "value1", etc. for each value.  The
+// format is stable.  Callers that log the map should consider omitting the
+// bin.
+func (r Report) ToMap() map[string]string {
+	m := map[string]string{
+		"domain":  r.Domain,
+		"country": r.Country,
+		"date":    r.Date.Format(dateForm),
+	}
+	if r.bin != "" {
+		m["bin"] = r.bin
+	}
+	for i, v := range r.Values {
+		m["value"+strconv.Itoa(i)] = v.String()
+	}
+	return m
+}
+
+// Equal reports whether `r` and `other` have the same Key, Values, and bin.
+func (r Report) Equal(other Report) bool {
+	if r.Key != other.Key || r.bin != other.bin || len(r.Values) != len(other.Values) {
+		return false
+	}
+	for i, v := range r.Values {
+		if other.Values[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Alphabet is the set of characters used to encode bins as DNS labels.  Each
+// character represents one digit, in order of increasing value.  The client
+// and server must use the same Alphabet.
+type Alphabet string
+
+const (
+	// Base32 is the default Alphabet.  It matches the lowercase form of the
+	// RFC 4648 base32 alphabet (see encodeStd in encoding/base32).
+	Base32 Alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	// Base36 uses all the digits and lowercase letters, so it packs slightly
+	// more bins into each character.
+	Base36 Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+)
+
+// An Alphabet must have at least two distinct characters, each of which must
+// be a lowercase ASCII letter, a digit, or '-', so that encoded bins are valid
+// Values and survive case-insensitive DNS processing.
+func (a Alphabet) validate() error {
+	if len(a) < 2 {
+		return fmt.Errorf("Alphabet is too short: %q", a)
+	}
+	for i, c := range a {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("Alphabet contains a disallowed character: %q", c)
+		}
+		if strings.IndexRune(string(a), c) != i {
+			return fmt.Errorf("Alphabet contains a repeated character: %q", c)
+		}
+	}
+	return nil
+}
+
+// Returns the number of characters required to represent every bin in
+// 0..bins-1 using this alphabet.
+func (a Alphabet) width(bins int) int {
+	radix := uint64(len(a))
+	// Representing "0" requires one character, not zero.
+	size := 1
+	for v := uint64(bins-1) / radix; v != 0; v /= radix {
+		size++
+	}
+	return size
+}
+
+// Returns a fixed-length, big-endian representation of `n`.  Doing this
+// explicitly here is easier than cleaning up the output of the encoding/base32
+// package, which requires its input to be sized in whole bytes, and adds
+// padding to both ends of its output.
+func (a Alphabet) encode(n uint64, width int) string {
+	radix := uint64(len(a))
+	chars := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		chars[i] = a[n%radix]
+		n /= radix
+	}
+	return string(chars)
+}
+
+// BinLabels returns the labels of all the bins for this number of `bins`, in
+// order.  These are the only labels that a Reporter with the same number of
+// bins and Alphabet can produce, which is useful for displaying occupancy
+// against the full set of bins, or for validating observed bins.
+func (a Alphabet) BinLabels(bins int) ([]string, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	if bins <= 0 {
+		return nil, errors.New("Users must be assigned to at least one bin")
+	}
+	width := a.width(bins)
+	labels := make([]string, bins)
+	for i := range labels {
+		labels[i] = a.encode(uint64(i), width)
+	}
+	return labels, nil
+}
+
+// Returns the number encoded by `label`, which must consist only of
+// characters in the alphabet.  This inverts encode.
+func (a Alphabet) decode(label string) uint64 {
+	radix := uint64(len(a))
+	var n uint64
+	for i := 0; i < len(label); i++ {
+		n = n*radix + uint64(strings.IndexByte(string(a), label[i]))
+	}
+	return n
+}
+
+// Reports whether `label` consists only of characters in the alphabet.
+func (a Alphabet) contains(label string) bool {
+	for _, c := range label {
+		if !strings.ContainsRune(string(a), c) {
+			return false
+		}
+	}
+	return true
 }
 
 // Used in the implementation of sets as map[...]observed.
 type observed struct{}
 
+// A set of strings.  The zero value is an empty set that can't be modified;
+// use newStringSet to create a set.
+type stringSet map[string]observed
+
+func newStringSet() stringSet {
+	return make(stringSet)
+}
+
+// Adds `v` to the set.
+func (s stringSet) add(v string) {
+	s[v] = observed{}
+}
+
+// Reports whether `v` is in the set.
+func (s stringSet) contains(v string) bool {
+	_, ok := s[v]
+	return ok
+}
+
+// Returns the number of distinct strings in the set.
+func (s stringSet) len() int {
+	return len(s)
+}
+
+// Adds every member of `other` to the set.  Sets of bins must always be
+// combined by union, not by adding their sizes: the same user can appear in
+// both sets, so summing would overstate the number of distinct users and
+// break the k-anonymity guarantee.
+func (s stringSet) union(other stringSet) {
+	for v := range other {
+		s.add(v)
+	}
+}
+
+// Returns the members of the set in sorted order.
+func (s stringSet) sorted() []string {
+	members := make([]string, 0, len(s))
+	for v := range s {
+		members = append(members, v)
+	}
+	sort.Strings(members)
+	return members
+}
+
 // Domains are always handled in lower case, without the trailing ".".
 func normalizeForReport(domain string) string {
 	return strings.ToLower(strings.TrimSuffix(domain, "."))
 }
+
+// Returns ErrEmptySuffix if `suffix` is empty or the root.
+func checkSuffix(suffix string) error {
+	if normalizeForReport(suffix) == "" {
+		return ErrEmptySuffix
+	}
+	return nil
+}
+
+// NormalizeDomain returns `domain` in the form used in reports: lower case,
+// without the trailing ".".  It returns an error if `domain` is not a valid
+// DNS name, if it is empty (ErrEmptyDomain), or if it has only one label
+// (ErrSingleLabelDomain).
+func NormalizeDomain(domain string) (string, error) {
+	return normalizeDomain(domain, false)
+}
+
+// Like NormalizeDomain, but permits single-label domains if `singleLabel`.
+func normalizeDomain(domain string, singleLabel bool) (string, error) {
+	if _, err := dnsmessage.NewName(domain); err != nil {
+		return "", err
+	}
+	normalized := normalizeForReport(domain)
+	if normalized == "" {
+		return "", ErrEmptyDomain
+	}
+	if !singleLabel && !strings.Contains(normalized, ".") {
+		return "", fmt.Errorf("%w: %q", ErrSingleLabelDomain, domain)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Counter counts events for each domain (and values) during each day, and
+// reports each count as it crosses into a new bucket of NewCountValue.  The
+// bucket is appended to the values of each report, so the Reporter must be
+// configured with one more value than is passed to Increment, and with
+// WithDedupValues, so that each bucket is reported at most once per day.
+// Each user therefore sends at most about log2(count) reports per domain and
+// values each day.
+//
+// The server can estimate the distribution of counts from these reports: the
+// number of distinct users who reported bucket B for a Key is the number of
+// users whose count reached B, so the number of users with a count in
+// [B, 2B) is the difference between the numbers for B and 2B.  Burst
+// suppression can drop some of these reports, so the estimates are lower
+// bounds, especially for the higher buckets.
+type Counter struct {
+	reporter Reporter
+	clock    Clock
+	mu       sync.Mutex // Protects `date` and `counts`.
+	date     time.Time
+	// The count for each domain and values today.
+	counts map[string]int64
+}
+
+// NewCounter returns a Counter that reports to `r`.  The days are measured by
+// the Clock of `r` (see WithClock), if it was returned by NewReporter.
+func NewCounter(r Reporter) *Counter {
+	return &Counter{reporter: r, clock: reporterClock(r)}
+}
+
+// Returns the Clock that `r` uses to date its reports.
+func reporterClock(r Reporter) Clock {
+	switch impl := r.(type) {
+	case *reporter:
+		return impl.builder.clock
+	case *SamplingReporter:
+		return reporterClock(impl.Reporter)
+	}
+	return time.Now
+}
+
+// Increment adds one to the count for `domain` and `values` today, and
+// reports the count if it has reached a new bucket.
+func (c *Counter) Increment(domain string, values ...Value) error {
+	domain, err := normalizeDomain(domain, true)
+	if err != nil {
+		return err
+	}
+	id := Report{Key: Key{Domain: domain}, Values: values}
+	// The length prefix makes the entry unambiguous.
+	entry := strconv.Itoa(len(domain)) + ":" + domain + id.Fingerprint()
+
+	c.mu.Lock()
+	if date := TruncateDate(c.clock()); !date.Equal(c.date) {
+		c.counts = make(map[string]int64)
+		c.date = date
+	}
+	count, ok := c.counts[entry]
+	if !ok && len(c.counts) >= maxReports {
+		c.mu.Unlock()
+		return errors.New("Counter is full")
+	}
+	count++
+	c.counts[entry] = count
+	c.mu.Unlock()
+
+	if powerOfTwoBucket(count) != powerOfTwoBucket(count-1) {
+		// Limit the capacity to force a copy, so that the caller's slice is
+		// not modified.
+		values = append(values[:len(values):len(values)], NewCountValue(count))
+		return c.reporter.Report(domain, values...)
+	}
+	return nil
+}
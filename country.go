@@ -0,0 +1,70 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultCountryTimeout is the timeout for FetchCountry if the context has no
+// deadline.  A client that can't determine its country should report with
+// UnknownCountry rather than delay its startup.
+const DefaultCountryTimeout = 10 * time.Second
+
+// The longest response that FetchCountry reads.
+const maxCountryResponse = 64
+
+// FetchCountry requests `url` from an IP geolocation service that responds
+// with the client's two-letter country code as plain text (e.g.
+// "https://ipinfo.io/country"), using `client`, or http.DefaultClient if it
+// is nil.  If `ctx` has no deadline, the request times out after
+// DefaultCountryTimeout, so a stalled service can't block the caller
+// indefinitely.
+//
+// The service learns the client's IP address, so it should be one that the
+// application already trusts with it.
+func FetchCountry(ctx context.Context, client *http.Client, url string) (Country, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCountryTimeout)
+		defer cancel()
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client country: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to get client country: HTTP status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCountryResponse))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read client country: %w", err)
+	}
+	return NewCountry(strings.TrimSpace(string(body)))
+}
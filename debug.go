@@ -0,0 +1,66 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build choirdebug
+// +build choirdebug
+
+package choir
+
+import "errors"
+
+// BurstState describes the reports held by a Reporter's burst suppression.
+//
+// This is an unstable diagnostic interface, which is only available when
+// building with the "choirdebug" tag.  It must not be used in production.
+type BurstState struct {
+	// The number of reports in the current burst.
+	Count int64
+	// The reports that would be sent if the burst ended now, without their
+	// bins.
+	Pending []Report
+}
+
+// DebugBurstState returns the current BurstState of `r`, which must have been
+// returned by NewReporter (or ChannelReporter.Channel).  This allows a
+// developer to check their integration during the burst, without waiting for
+// the drain.
+//
+// This is an unstable diagnostic interface, which is only available when
+// building with the "choirdebug" tag.  It must not be used in production.
+func DebugBurstState(r Reporter) (BurstState, error) {
+	impl, ok := r.(*reporter)
+	if !ok {
+		return BurstState{}, errors.New("Not a Reporter from NewReporter")
+	}
+	sender := impl.sender
+	if once, ok := sender.(*onceADayReportSender); ok {
+		sender = once.sender
+	}
+	if c, ok := sender.(*connectivityReportSender); ok {
+		sender = c.online
+	}
+	burst, ok := sender.(*burstReportSender)
+	if !ok {
+		return BurstState{}, errors.New("Reporter has no burst suppression")
+	}
+	burst.mu.Lock()
+	defer burst.mu.Unlock()
+	state := BurstState{Count: burst.count}
+	if burst.strategy != nil {
+		for _, p := range burst.strategy.Selected() {
+			state.Pending = append(state.Pending, Report{Key: p.Key, Values: p.Values})
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build choirdebug
+// +build choirdebug
+
+package choir
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDebugBurstState(t *testing.T) {
+	var f funcReportSender = func(r Report) error { return nil }
+	scheduler := &fakeScheduler{}
+	r, err := NewReporter(new(bytes.Buffer), 32, 2, country, time.Minute, f, WithScheduler(scheduler.schedule), WithBurstStrategy(NewFirstStrategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := DebugBurstState(r); err != nil || state.Count != 0 || len(state.Pending) != 0 {
+		t.Errorf("Expected an empty burst, got %v, %v", state, err)
+	}
+	for _, domain := range []string{"domain1.example", "domain2.example"} {
+		if err := r.Report(domain, testValues...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := DebugBurstState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Count != 2 || len(state.Pending) != 1 || state.Pending[0].Domain != "domain1.example" {
+		t.Errorf("Unexpected state: %v", state)
+	}
+	if state.Pending[0].bin != "" {
+		t.Error("The bin should be removed")
+	}
+	scheduler.advance()
+	if state, _ := DebugBurstState(r); state.Count != 0 {
+		t.Errorf("Expected an empty burst after the drain, got %v", state)
+	}
+}
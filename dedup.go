@@ -0,0 +1,140 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// recentSet remembers the items added within a window, up to a fixed number
+// of the most recent ones.  Items must be comparable.  It is not safe for
+// concurrent use.
+type recentSet struct {
+	window time.Duration
+	size   int
+	// Recent items, oldest first.
+	recent *list.List
+	// The element of `recent` for each item.
+	index map[interface{}]*list.Element
+}
+
+// An entry in a recentSet.
+type recentItem struct {
+	id    interface{}
+	added time.Time
+}
+
+func newRecentSet(window time.Duration, size int) recentSet {
+	if size < 1 {
+		size = 1
+	}
+	return recentSet{
+		window: window,
+		size:   size,
+		recent: list.New(),
+		index:  make(map[interface{}]*list.Element),
+	}
+}
+
+// Adds `id` at time `now`, and returns its element, unless it was added
+// within the window, in which case it returns nil.  Items that were added
+// before the window are forgotten, as is the oldest item if the set is full.
+func (s *recentSet) add(id interface{}, now time.Time) *list.Element {
+	for e := s.recent.Front(); e != nil && now.Sub(e.Value.(recentItem).added) >= s.window; e = s.recent.Front() {
+		s.remove(e)
+	}
+	if _, ok := s.index[id]; ok {
+		return nil
+	}
+	if s.recent.Len() >= s.size {
+		s.remove(s.recent.Front())
+	}
+	e := s.recent.PushBack(recentItem{id: id, added: now})
+	s.index[id] = e
+	return e
+}
+
+// Forgets the item added as `e`, if it is still present.
+func (s *recentSet) remove(e *list.Element) {
+	id := e.Value.(recentItem).id
+	if s.index[id] == e {
+		s.recent.Remove(e)
+		delete(s.index, id)
+	}
+}
+
+// DedupReportSender implements ReportSender by passing reports to another
+// ReportSender, and dropping any report that would produce the same query as
+// one that was sent within a short window.  This is a guard against wasted
+// network traffic from callers that report the same thing many times in
+// quick succession, e.g. with WithoutDailyDedup.  It is unrelated to the
+// Reporter's daily limit, which protects privacy, and it doesn't affect
+// reports that differ in any value, because they produce different queries.
+type DedupReportSender struct {
+	sender ReportSender
+	clock  Clock
+
+	mu         sync.Mutex
+	recent     recentSet // Recently sent queries.
+	duplicates int
+}
+
+// NewDedupReportSender returns a DedupReportSender that drops reports whose
+// query was sent (or is being sent) within `window`, remembering at most
+// the `size` most recent queries.  A `size` below 1 is treated as 1, and a
+// `window` that is not positive disables deduplication.
+func NewDedupReportSender(sender ReportSender, window time.Duration, size int) *DedupReportSender {
+	return &DedupReportSender{
+		sender: sender,
+		clock:  time.Now,
+		recent: newRecentSet(window, size),
+	}
+}
+
+// Send passes `r` to the wrapped ReportSender, unless it is a duplicate of
+// a recent report, in which case it returns nil.  If sending fails, the
+// report is forgotten, so that a retry is not dropped.
+func (s *DedupReportSender) Send(r Report) error {
+	// The name identifies the query, including its tag and date encoding.
+	// Reports without a Suffix all go to the wrapped sender's suffix.
+	id := name(r, r.suffix)
+	s.mu.Lock()
+	e := s.recent.add(id, s.clock())
+	if e == nil {
+		s.duplicates++
+	}
+	s.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	err := s.sender.Send(r)
+	if err != nil {
+		s.mu.Lock()
+		s.recent.remove(e)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Duplicates returns the number of reports that have been dropped as
+// duplicates.
+func (s *DedupReportSender) Duplicates() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duplicates
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNotConfirmed indicates that the response to a report did not contain the
+// expected confirmation (see DNSReportSender.Confirmation).
+var ErrNotConfirmed = errors.New("Report delivery was not confirmed")
+
+// The default timeout for a DNSReportSender query.
+const defaultDNSTimeout = 5 * time.Second
+
+// DNSReportSender implements ReportSender by sending each report as a DNS
+// query over UDP to a recursive resolver.  The resolver forwards the query
+// to the metrics server, which never learns the client's IP address.  An
+// encrypted transport is recommended if available.
+type DNSReportSender struct {
+	// The address of the recursive resolver, e.g. "192.0.2.53:53".
+	Resolver string
+	// The name of the metrics server, e.g. "metrics.example.com".  Reports
+	// with their own Suffix are sent there instead.
+	Suffix string
+	// Options for formatting each query.
+	Options QueryOptions
+	// Some resolvers reject queries that carry the EDNS Client Subnet
+	// option, responding with FORMERR or REFUSED instead of forwarding the
+	// query.  If ECSFallback is true, such a query is retried once without
+	// the option, and the fallback is logged.  The retry no longer asks the
+	// resolver to withhold the client's subnet, so the resolver may reveal
+	// the client's approximate location to the metrics server.  The default
+	// is not to retry, which preserves privacy at the cost of losing reports
+	// on those networks.
+	ECSFallback bool
+	// The timeout for each query.  The default is 5 seconds.
+	Timeout time.Duration
+	// If non-empty, the metrics server is expected to answer each report
+	// with a TXT record containing Confirmation (see ConfirmationResponse),
+	// and any other response, including NXDOMAIN, is ErrNotConfirmed.  The
+	// default is to accept NXDOMAIN, which can't distinguish a delivered
+	// report from one that a resolver answered itself, e.g. from a cached
+	// denial of the suffix (RFC 8198).  Confirmation is only useful if the
+	// deployment controls the metrics server.
+	//
+	// The confirmation is not authenticated: it detects reports that were
+	// lost, but a resolver or network attacker that knows the token can
+	// forge it, and a resolver can replay a cached answer for an identical
+	// name.  The metrics server should answer with a TTL of zero.
+	Confirmation string
+}
+
+// Send formats `r` as a query, sends it to the resolver, and waits for the
+// response.  The metrics server is expected to respond with NXDOMAIN (or an
+// empty answer), or with the Confirmation if it is set; any other response
+// is an error.
+func (s *DNSReportSender) Send(r Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = s.Suffix
+	}
+	query, err := FormatQueryWithOptions(r, suffix, s.Options)
+	if err != nil {
+		return err
+	}
+	response, rcode, err := s.exchange(query)
+	if err != nil {
+		return err
+	}
+	if s.ECSFallback && s.Options.ClientSubnet == nil && !s.Options.OmitClientSubnet &&
+		(rcode == dnsmessage.RCodeFormatError || rcode == dnsmessage.RCodeRefused) {
+		log.Printf("Resolver rejected the client subnet option (%v).  Retrying without it.", rcode)
+		opts := s.Options
+		opts.OmitClientSubnet = true
+		if query, err = FormatQueryWithOptions(r, suffix, opts); err != nil {
+			return err
+		}
+		if response, _, err = s.exchange(query); err != nil {
+			return err
+		}
+	}
+	return checkResponse(response, s.Confirmation)
+}
+
+// Checks that `response` is an expected response from the metrics server,
+// containing a TXT record with `confirmation` if it is non-empty.
+func checkResponse(response []byte, confirmation string) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(response)
+	if err != nil {
+		return fmt.Errorf("Bad response: %w", err)
+	}
+	if confirmation == "" {
+		return checkRCode(h.RCode)
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("%w: %v", ErrNotConfirmed, h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return fmt.Errorf("Bad response: %w", err)
+	}
+	for {
+		a, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return ErrNotConfirmed
+		} else if err != nil {
+			return fmt.Errorf("Bad response: %w", err)
+		}
+		if a.Type != dnsmessage.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return fmt.Errorf("Bad response: %w", err)
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return fmt.Errorf("Bad response: %w", err)
+		}
+		for _, t := range txt.TXT {
+			if t == confirmation {
+				return nil
+			}
+		}
+	}
+}
+
+// Checks that `rcode` is an expected response from the metrics server.
+func checkRCode(rcode dnsmessage.RCode) error {
+	if rcode != dnsmessage.RCodeNameError && rcode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("Unexpected response: %v", rcode)
+	}
+	return nil
+}
+
+// Sends `query` with a random ID, and returns the response and its code.
+func (s *DNSReportSender) exchange(query []byte) ([]byte, dnsmessage.RCode, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	copy(query, id[:])
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", s.Resolver)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to reach resolver: %w", err)
+	}
+	defer c.Close()
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+	if _, err := c.Write(query); err != nil {
+		return nil, 0, fmt.Errorf("Query failed: %w", err)
+	}
+
+	buf := make([]byte, udpLimit)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Reading response failed: %w", err)
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || !h.Response || h.ID != binary.BigEndian.Uint16(id[:]) {
+			// Ignore stray or spoofed packets until the deadline.
+			continue
+		}
+		return buf[:n], h.RCode, nil
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// The media type of DNS messages in DNS over HTTPS (RFC 8484).
+const dnsMessageType = "application/dns-message"
+
+// The HTTP client for senders that don't have their own.  Unlike
+// http.DefaultClient, it has a timeout, so a stalled server can't block the
+// sender indefinitely.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// DoHReportSender implements ReportSender by sending each report as a DNS
+// query to a DNS over HTTPS (RFC 8484) resolver, which forwards it to the
+// metrics server.  The transport is encrypted, so observers of the network
+// don't see the report, and the resolver hides the client's IP address from
+// the metrics server.
+//
+// It only uses net/http, so it also works in WebAssembly in a browser (with
+// GOOS=js), where net/http uses the Fetch API and raw sockets are
+// unavailable.  A browser client has no salt file either, so it should pass
+// a bytes.Buffer containing the salt that it saved previously (e.g. in
+// localStorage), or an empty one, to NewReporter, and save the contents of
+// the buffer afterward, in case a new salt was generated.  Alternatively,
+// the host can provision the salt using WithSalt.
+type DoHReportSender struct {
+	// The URL of the resolver's DoH endpoint, e.g.
+	// "https://dns.example/dns-query".
+	URL string
+	// The name of the metrics server, e.g. "metrics.example.com".  Reports
+	// with their own Suffix are sent there instead.
+	Suffix string
+	// Options for formatting each query.  Padding (e.g. to 128 bytes) is
+	// recommended, to hide the length of the report from observers.
+	Options QueryOptions
+	// The HTTP client for queries.  The default is a client with a 30 second
+	// timeout.
+	Client *http.Client
+	// If non-empty, the metrics server is expected to confirm delivery.  See
+	// DNSReportSender.Confirmation.
+	Confirmation string
+}
+
+// Send formats `r` as a query, posts it to the resolver, and checks the
+// response.  The metrics server is expected to respond with NXDOMAIN (or an
+// empty answer), or with the Confirmation if it is set; any other response
+// is an error.
+func (s *DoHReportSender) Send(r Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = s.Suffix
+	}
+	query, err := FormatQueryWithOptions(r, suffix, s.Options)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	client := s.Client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Query failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected HTTP status: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, udpLimit))
+	if err != nil {
+		return fmt.Errorf("Reading response failed: %w", err)
+	}
+	return checkResponse(body, s.Confirmation)
+}
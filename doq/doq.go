@@ -0,0 +1,195 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package doq provides a choir.ReportSender that sends reports over DNS over
+// QUIC (RFC 9250).  It is a separate package so that the core choir package
+// does not depend on a QUIC implementation.
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/choir"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The ALPN token for DNS over QUIC.
+const alpn = "doq"
+
+// The default timeout for each report, including connection setup.
+const defaultTimeout = 5 * time.Second
+
+// ReportSender implements choir.ReportSender by sending each report as a DNS
+// query to a DNS over QUIC resolver, which forwards it to the metrics server.
+// The transport is encrypted, so observers of the network don't see the
+// report, and the resolver hides the client's IP address from the metrics
+// server.
+//
+// A single QUIC connection is reused for all reports, with a new stream for
+// each query, so the handshake cost is only paid once.  The connection is
+// redialed if it is closed, e.g. by the resolver's idle timeout.
+type ReportSender struct {
+	addr      string
+	tlsConfig *tls.Config
+	suffix    string
+	opts      choir.QueryOptions
+	// The timeout for each report.  The default is 5 seconds.
+	Timeout time.Duration
+
+	mu   sync.Mutex // Protects conn.
+	conn *quic.Conn
+}
+
+// NewReportSender returns a ReportSender for the resolver at `addr` (e.g.
+// "dns.example:853"), which sends reports to the metrics server `suffix`,
+// unless they have their own Suffix, formatted with `opts`.  Padding (e.g. to
+// 128 bytes) is recommended, to hide the length of the report from
+// observers.  `tlsConfig` may be nil, in which case the default configuration
+// is used.  Its NextProtos are set to "doq" if they are empty.
+func NewReportSender(addr string, tlsConfig *tls.Config, suffix string, opts choir.QueryOptions) *ReportSender {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{alpn}
+	}
+	return &ReportSender{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		suffix:    suffix,
+		opts:      opts,
+	}
+}
+
+// Send formats `r` as a query, sends it to the resolver on a new stream, and
+// checks the response.  The metrics server is expected to respond with
+// NXDOMAIN (or an empty answer); any other response code is an error.
+func (s *ReportSender) Send(r choir.Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = s.suffix
+	}
+	query, err := choir.FormatQueryWithOptions(r, suffix, s.opts)
+	if err != nil {
+		return err
+	}
+	// The message ID must be zero (RFC 9250, Section 4.2.1).
+	query[0], query[1] = 0, 0
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := s.openStream(ctx)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := stream.Write(append(msg, query...)); err != nil {
+		stream.CancelRead(0)
+		return fmt.Errorf("Query failed: %w", err)
+	}
+	// Closing the send direction indicates that the query is complete.
+	stream.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return fmt.Errorf("Reading response failed: %w", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, response); err != nil {
+		return fmt.Errorf("Reading response failed: %w", err)
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(response)
+	if err != nil {
+		return fmt.Errorf("Bad response: %w", err)
+	}
+	if h.RCode != dnsmessage.RCodeNameError && h.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("Unexpected response: %v", h.RCode)
+	}
+	return nil
+}
+
+// Opens a stream on the current connection, dialing a new connection if
+// there is none or it has been closed.  The lock is only held to read or
+// replace the connection, so a slow dial or a full stream limit doesn't
+// block other reports.
+func (s *ReportSender) openStream(ctx context.Context) (*quic.Stream, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err == nil {
+			return stream, nil
+		}
+		if conn.Context().Err() == nil {
+			// The connection is still open, e.g. the stream limit was not
+			// lifted before the deadline, so keep it for other reports.
+			return nil, err
+		}
+		// The connection was closed, e.g. by the resolver's idle timeout.
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	conn, err := quic.DialAddr(ctx, s.addr, s.tlsConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach resolver: %w", err)
+	}
+	s.mu.Lock()
+	if s.conn == nil {
+		s.conn = conn
+	} else {
+		// Another report dialed concurrently.  Share its connection.
+		conn.CloseWithError(0, "")
+		conn = s.conn
+	}
+	s.mu.Unlock()
+	return conn.OpenStreamSync(ctx)
+}
+
+// Close closes the connection to the resolver, if any.  The ReportSender
+// can still be used afterward, and will dial a new connection.
+func (s *ReportSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.CloseWithError(0, "")
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/choir"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Returns a self-signed certificate for "localhost".
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Starts a DoQ resolver that responds to each query with NXDOMAIN, and
+// reports each query and the number of connections.
+func testResolver(t *testing.T, queries chan<- []byte, conns chan<- struct{}) (addr string, pool *x509.CertPool) {
+	cert, pool := testCertificate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{alpn}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns <- struct{}{}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var length [2]byte
+					if _, err := io.ReadFull(stream, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(stream, query); err != nil {
+						return
+					}
+					queries <- query
+					var q dnsmessage.Message
+					if err := q.Unpack(query); err != nil {
+						t.Error(err)
+						return
+					}
+					response := dnsmessage.Message{
+						Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+						Questions: q.Questions,
+					}
+					packed, err := response.Pack()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					binary.BigEndian.PutUint16(length[:], uint16(len(packed)))
+					stream.Write(append(length[:], packed...))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), pool
+}
+
+// Returns a report for `domain`, with a bin.
+func testReport(t *testing.T, domain string) choir.Report {
+	receiver := choir.Receiver{Suffix: "metrics.example"}
+	report, err := receiver.ParseReport("q.us.20200203." + domain + ".metrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *report
+}
+
+func TestReportSender(t *testing.T) {
+	queries := make(chan []byte, 2)
+	conns := make(chan struct{}, 2)
+	addr, pool := testResolver(t, queries, conns)
+	sender := NewReportSender(addr, &tls.Config{RootCAs: pool, ServerName: "localhost"}, "metrics.example", choir.QueryOptions{Padding: 128})
+	defer sender.Close()
+
+	receiver := choir.Receiver{Suffix: "metrics.example"}
+	for _, domain := range []string{"a.example", "b.example"} {
+		if err := sender.Send(testReport(t, domain)); err != nil {
+			t.Fatal(err)
+		}
+		query := <-queries
+		if query[0] != 0 || query[1] != 0 {
+			t.Error("Message ID must be zero")
+		}
+		parsed, err := receiver.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Domain != domain {
+			t.Errorf("Wrong domain: %s != %s", parsed.Domain, domain)
+		}
+	}
+	// The connection is reused.
+	if len(conns) != 1 {
+		t.Errorf("Expected 1 connection, got %d", len(conns))
+	}
+	// After Close, a new connection is dialed.
+	sender.Close()
+	if err := sender.Send(testReport(t, "c.example")); err != nil {
+		t.Fatal(err)
+	}
+	<-queries
+	if len(conns) != 2 {
+		t.Errorf("Expected 2 connections, got %d", len(conns))
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/Jigsaw-Code/choir/doq
+
+go 1.26.0
+
+require (
+	github.com/Jigsaw-Code/choir v0.0.0
+	github.com/quic-go/quic-go v0.63.0
+	golang.org/x/net v0.56.0
+)
+
+require (
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+)
+
+replace github.com/Jigsaw-Code/choir => ../
@@ -23,11 +23,8 @@ package main
 import (
 	"bufio"
 	"context"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -37,97 +34,17 @@ import (
 	"time"
 
 	"github.com/Jigsaw-Code/choir"
-	"golang.org/x/net/dns/dnsmessage"
 )
 
-// Extract the IP (and port) of the user's current default resolver.
-func getRecursiveAddress() string {
-	var serverAddress string
-	// This fake Dial function serves to capture the address argument, which is
-	// the IP address of the recursive resolver.  Go has built-in functionality
-	// to determine the recursive resolver IP address from platform-specific
-	// configuration, but does not otherwise expose this information.
-	fakeDial := func(ctx context.Context, network, address string) (net.Conn, error) {
-		serverAddress = address
-		return nil, errors.New("Fake dialer")
-	}
-
-	(&net.Resolver{
-		PreferGo: true,
-		Dial:     fakeDial,
-	}).LookupTXT(context.Background(), "noname.example")
-
-	return serverAddress
-}
-
 // This is the domain where the customized authoritative DNS server is logging
 // incoming reports.
 const metricsDomain = "metrics.example"
 
-// This example ReportSender encodes the report as a DNS query and sends it over UDP.
-// An encrypted transport is recommended if available.
-type udpDNSReportSender struct {
-	serverAddress string
-}
-
-func (s udpDNSReportSender) Send(r choir.Report) error {
-	query, err := choir.FormatQuery(r, metricsDomain)
-	if err != nil {
-		return err
-	}
-	msg := &dnsmessage.Message{}
-	if err := msg.Unpack(query); err != nil {
-		log.Fatal(err)
-	}
-	name := msg.Questions[0].Name.String()
-	log.Printf("Querying %s via %s\n", name, s.serverAddress)
-	c, err := net.Dial("udp", s.serverAddress)
-	if err != nil {
-		return fmt.Errorf("Failed to reach resolver: %w", err)
-	}
-	defer c.Close()
-
-	if _, err := c.Write(query); err != nil {
-		return fmt.Errorf("Query failed: %w", err)
-	}
-
-	var buf [4096]byte
-	c.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := c.Read(buf[:])
-	if err != nil {
-		return fmt.Errorf("Reading response failed: %w", err)
-	}
-
-	var response dnsmessage.Message
-	if err := response.Unpack(buf[:n]); err != nil {
-		return fmt.Errorf("Bad response: %w", err)
-	}
-	if response.Header.RCode != dnsmessage.RCodeNameError {
-		// We expect an NXDOMAIN response.  Anything else is surprising.
-		return fmt.Errorf("Unexpected response: %v", response.Header.RCode)
-	}
-
-	log.Printf("Report complete")
-	return nil
-}
-
-// Get the user's current country from an IP geolocation service.
-func getClientCountry() string {
-	resp, err := http.Get("https://ipinfo.io/country")
-	if err != nil {
-		log.Fatal("Failed to get client country:", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Fatal("Failed to get client country:", resp.StatusCode)
-	}
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal("Failed to read response body")
-	}
-	resp.Body.Close()
-	clientCountry := string(contents[:2])
-	return clientCountry
-}
+// HTTP client for all requests made by this example.  Unlike
+// http.DefaultClient, it has a timeout, so a stalled server can't hang the
+// application.  Applications that route traffic through a proxy should
+// configure its Transport accordingly.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
 
 func mustMakeReporter() choir.Reporter {
 	// This filename is consistent across invocations, ensuring that
@@ -138,10 +55,27 @@ func mustMakeReporter() choir.Reporter {
 		log.Fatal(err)
 	}
 	const bins = 32
-	clientCountry := getClientCountry()
+	// Bound the time spent on discovery, so that startup can't hang.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Get the user's current country from an IP geolocation service.
+	clientCountry, err := choir.FetchCountry(ctx, httpClient, "https://ipinfo.io/country")
+	if err != nil {
+		log.Println(err)
+		clientCountry = choir.UnknownCountry
+	}
 	const burst = 10 * time.Second
-	sender := udpDNSReportSender{getRecursiveAddress()}
-	reporter, err := choir.NewReporter(file, bins, 2, clientCountry, burst, sender)
+	// The user's current default resolver, which may be IPv4 or IPv6.
+	resolver, err := choir.RecursiveResolverContext(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// An encrypted transport is recommended if available.
+	sender := &choir.DNSReportSender{
+		Resolver: resolver,
+		Suffix:   metricsDomain,
+	}
+	reporter, err := choir.NewReporter(file, bins, 2, string(clientCountry), burst, sender)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -152,10 +86,11 @@ func mustMakeReporter() choir.Reporter {
 var reporter = mustMakeReporter()
 
 func checkURL(rawurl string) error {
-	resp, err := http.Get(rawurl)
+	resp, err := httpClient.Get(rawurl)
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Queueing report for %s with status %d\n", rawurl, resp.StatusCode)
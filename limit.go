@@ -0,0 +1,87 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrTooManySends is returned by a LimitedReportSender that drops reports
+// when it is at its limit.
+var ErrTooManySends = errors.New("Too many concurrent sends")
+
+// LimitedReportSender implements ReportSender by passing reports to another
+// ReportSender, with at most a fixed number of calls to Send in flight at
+// once.  This bounds the number of sockets or connections that a process
+// opens, e.g. when many Reporters drain their bursts at the same time, to
+// protect file descriptor limits.
+type LimitedReportSender struct {
+	sender ReportSender
+	// Holds a token for each call in flight.
+	slots chan struct{}
+	block bool
+	// The number of calls in flight, for InFlight.
+	inFlight int64
+}
+
+// NewLimitedReportSender returns a LimitedReportSender that allows up to
+// `max` concurrent calls to `sender`.  When the limit is reached, further
+// calls to Send wait for a call to finish if `block` is true, or fail
+// immediately with ErrTooManySends if it is false.
+//
+// Blocking preserves every report, but delays it, and each waiting call
+// holds a goroutine (e.g. a Reporter's drain), so a sender that hangs can
+// accumulate goroutines without bound; the wrapped sender should have a
+// timeout.  Dropping keeps the cost of a stalled sender fixed, at the cost
+// of losing reports, which an Observer counts as EventFailed.
+//
+// The wrapped sender is hidden from the Reporter, so it is never used as a
+// BatchReportSender.
+func NewLimitedReportSender(sender ReportSender, max int, block bool) *LimitedReportSender {
+	if max < 1 {
+		max = 1
+	}
+	return &LimitedReportSender{
+		sender: sender,
+		slots:  make(chan struct{}, max),
+		block:  block,
+	}
+}
+
+// Send passes `r` to the wrapped ReportSender, if the limit allows.
+func (s *LimitedReportSender) Send(r Report) error {
+	if s.block {
+		s.slots <- struct{}{}
+	} else {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return ErrTooManySends
+		}
+	}
+	atomic.AddInt64(&s.inFlight, 1)
+	defer func() {
+		atomic.AddInt64(&s.inFlight, -1)
+		<-s.slots
+	}()
+	return s.sender.Send(r)
+}
+
+// InFlight returns the number of calls to the wrapped ReportSender that are
+// currently in progress.
+func (s *LimitedReportSender) InFlight() int {
+	return int(atomic.LoadInt64(&s.inFlight))
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+// Event is a stage of the Reporter pipeline that is reported to an Observer.
+type Event int
+
+const (
+	// EventBuilt means that a report was built.
+	EventBuilt Event = iota
+	// EventInactive means that a report was dropped because it is not in an
+	// active bin (see WithActiveBins).
+	EventInactive
+	// EventDuplicate means that a report was dropped because it was already
+	// reported today.
+	EventDuplicate
+	// EventDropped means that a report was dropped by the daily cache,
+	// because it was too old or the cache was full.
+	EventDropped
+	// EventSuppressed means that a report was dropped by burst suppression.
+	EventSuppressed
+	// EventSent means that a report was passed to the ReportSender, which
+	// succeeded.  A successful batch counts every report in the batch.
+	EventSent
+	// EventFailed means that a report was passed to the ReportSender, which
+	// returned an error.
+	EventFailed
+	// EventOffline means that the connectivity probe reported that the
+	// client was offline, so a report was dropped before the daily cache, or
+	// passed to the offline sender.  See WithConnectivityProbe.
+	EventOffline
+	// EventTooLong means that a report could not be built because its name
+	// would be too long (ErrNameTooLong).  A steady rate of these indicates
+	// that reports for long domains are systematically lost, which may call
+	// for reducing domains (e.g. to their registrable domain), fewer or
+	// shorter values, or a shorter suffix.  A ReportSender that fails with
+	// ErrNameTooLong is counted as EventFailed.
+	EventTooLong
+)
+
+var eventNames = [...]string{"built", "inactive", "duplicate", "dropped", "suppressed", "sent", "failed", "offline", "too_long"}
+
+func (e Event) String() string {
+	if e < 0 || int(e) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[e]
+}
+
+// Observer receives notifications about the progress of reports through a
+// Reporter's pipeline, e.g. to export metrics or traces.  Observers are only
+// told how many reports reached each stage, and never see their contents, so
+// that telemetry can't leak the data that Choir protects.  Every method must
+// be safe for concurrent execution, and must return quickly, since it may be
+// called while the pipeline holds a lock.  See WithObserver.
+type Observer interface {
+	// Observe is called when `n` reports reach the stage `event`.
+	Observe(event Event, n int)
+	// StartSend is called immediately before a report (or a batch, see
+	// BatchReportSender) is passed to the ReportSender.  The returned
+	// function is called with the result when the ReportSender returns.  The
+	// ReportSender is called outside of any locks, so it is safe to measure
+	// its latency.
+	StartSend() (done func(error))
+}
+
+// nopObserver implements Observer by ignoring every notification.
+type nopObserver struct{}
+
+func (nopObserver) Observe(Event, int)     {}
+func (nopObserver) StartSend() func(error) { return func(error) {} }
+
+// Returns the Observer in `config`, or a no-op Observer if it is unset.
+func observer(config reporterConfig) Observer {
+	if config.observer == nil {
+		return nopObserver{}
+	}
+	return config.observer
+}
@@ -0,0 +1,457 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Optional configuration for NewReporter.  The zero value is the default.
+type reporterConfig struct {
+	scheduler       Scheduler
+	alphabet        Alphabet
+	strictSalt      bool
+	compactDate     bool
+	rejectAmbiguous bool
+	requireValues   bool
+	// The length of the longest suffix that will be used with these reports.
+	suffixLength int
+	maxName      int
+	suffixes     []string
+	burstCount   bool
+	minBurst     time.Duration
+	burstJitter  float64
+	singleLabel  bool
+	newStrategy  func() BurstStrategy
+	sharedSecret []byte
+	saltSource   io.Reader
+	saltTimeout  time.Duration
+	saltFallback bool
+	ephemeral    bool
+	dedupValues  bool
+	noDailyDedup bool
+	dailyBudget  int
+	cacheFile    io.ReadWriteSeeker
+	activeBins   int
+	clock        Clock
+	observer     Observer
+	probe        func() bool
+	policies     []ValuePolicy
+	offline      ReportSender
+}
+
+// ReporterOption configures optional behavior of a Reporter.
+type ReporterOption func(*reporterConfig)
+
+// WithScheduler sets the Scheduler used to drain each burst.  The default is
+// time.AfterFunc.  This allows tests to use a fake clock, and allows
+// embedders to control when and where drains run.
+func WithScheduler(s Scheduler) ReporterOption {
+	return func(c *reporterConfig) {
+		c.scheduler = s
+	}
+}
+
+// WithAlphabet sets the Alphabet used to encode bins.  The default is Base32.
+// The Receiver must be configured with the same Alphabet.
+func WithAlphabet(a Alphabet) ReporterOption {
+	return func(c *reporterConfig) {
+		c.alphabet = a
+	}
+}
+
+// WithStrictSalt prevents the Reporter from sending any report dated on or
+// before the day its salt was created.  If the salt file is lost and a new
+// salt is generated, the client's reports for the rest of that day might be
+// assigned to different bins than its earlier reports, so it could be counted
+// twice.  Strict mode avoids this, at the cost of sending no reports on the
+// first day after installation (or after the salt file is lost).
+func WithStrictSalt() ReporterOption {
+	return func(c *reporterConfig) {
+		c.strictSalt = true
+	}
+}
+
+// WithMaxSuffixLength declares the length of the longest suffix that will be
+// used with these reports (e.g. by FormatQuery).  Reports whose names would
+// then exceed MaxNameLength are rejected by Report with ErrNameTooLong,
+// rather than failing later when they are formatted.  The default is zero,
+// which only detects names that are too long even without a suffix.
+func WithMaxSuffixLength(n int) ReporterOption {
+	return func(c *reporterConfig) {
+		c.suffixLength = n
+	}
+}
+
+// WithMaxNameLength lowers the maximum length of the name that encodes each
+// report below the DNS limit of MaxNameLength, e.g. to keep queries small
+// enough for a constrained network.  Reports whose names would exceed `n`
+// (including the suffix declared by WithMaxSuffixLength) are rejected by
+// Report with ErrNameTooLong.  Senders should set QueryOptions.MaxNameLength
+// to the same limit.  The default is MaxNameLength.
+func WithMaxNameLength(n int) ReporterOption {
+	return func(c *reporterConfig) {
+		c.maxName = n
+	}
+}
+
+// WithBurstCount appends an additional value to each report that is sent,
+// containing the number of reports in the burst that it was selected from.
+// This allows the server to weight each sample by the volume that it
+// represents.  The count is rounded down to a power of two (1, 2, 4, 8, ...)
+// to avoid revealing its precise value.  The Receiver must be configured with
+// one more value than the Reporter.
+//
+// This reveals the client's approximate reporting volume, which is otherwise
+// hidden by the burst suppression.  It should only be enabled when that
+// volume is not sensitive.
+func WithBurstCount() ReporterOption {
+	return func(c *reporterConfig) {
+		c.burstCount = true
+	}
+}
+
+// WithSuffixes assigns each report one of `suffixes`, chosen at random, which
+// is available to the ReportSender as Report.Suffix.  Spreading reports across
+// several collectors (e.g. operated by different parties) further limits what
+// any one collector can learn or link, and can also be used to compare two
+// collectors.  Each collector sees only a sample of the reports, so its bin
+// counts are correspondingly lower.
+func WithSuffixes(suffixes ...string) ReporterOption {
+	return func(c *reporterConfig) {
+		c.suffixes = append(c.suffixes, suffixes...)
+	}
+}
+
+// WithMinBurst causes NewReporter to fail if the burst duration is less than
+// `min`.  A short burst does little to prevent correlated reports from being
+// sent, which silently weakens the privacy of the reports.  By default, a
+// short burst only causes a warning, so that tests can use short bursts.
+// Production code should typically use WithMinBurst(RecommendedBurst).
+func WithMinBurst(min time.Duration) ReporterOption {
+	return func(c *reporterConfig) {
+		c.minBurst = min
+	}
+}
+
+// WithBurstJitter randomizes the duration of each burst, which is otherwise
+// exactly the burst duration passed to NewReporter, by up to `fraction` of
+// that duration in either direction (e.g. 0.2 for ±20%).  `fraction` must be
+// between 0 and 1, and the default is 0, which disables jitter.
+//
+// Without jitter, each drain fires at a fixed offset after the report that
+// started the burst, so the timing of the queries that reach the resolver
+// reveals when that report occurred, and is identical across clients and
+// across a client's own bursts.  Jitter blurs this timing.  Note that the
+// shortest burst is then shorter than the configured duration, which is the
+// value checked by WithMinBurst.
+func WithBurstJitter(fraction float64) ReporterOption {
+	return func(c *reporterConfig) {
+		c.burstJitter = fraction
+	}
+}
+
+// WithCompactDate encodes the date in each report name as the number of days
+// since 2020-01-01 in three Base32 characters, instead of eight digits
+// (YYYYMMDD).  This saves five characters of every name for longer domains
+// or more values.  The Receiver must set CompactDate to match.  Reports
+// dated outside the range of the encoding (before 2020, or after 2109) fail
+// to build.
+func WithCompactDate() ReporterOption {
+	return func(c *reporterConfig) {
+		c.compactDate = true
+	}
+}
+
+// WithRejectAmbiguousValues rejects reports with a value that looks like one
+// of the fixed fields that follow the values in the name (a bin, a country
+// code, or a date), with ErrAmbiguousValue.
+//
+// The name is positional, so a Receiver with the correct number of values
+// always parses such a value correctly.  However, if the Receiver expects
+// the wrong number of values, the checks on the fixed fields are the only
+// way to detect the mismatch, and a value that resembles the field it is
+// shifted into defeats them, so the report is silently misparsed.  Such
+// values also make names harder to read when debugging.
+func WithRejectAmbiguousValues() ReporterOption {
+	return func(c *reporterConfig) {
+		c.rejectAmbiguous = true
+	}
+}
+
+// WithRequireValues rejects reports without any values with ErrNoValues, for
+// deployments where such a report is meaningless and can only come from a
+// bug.  NewReporter (and ChannelReporter.Channel) fail if they are configured
+// with zero values.  By default, reports may have zero values, in which case
+// the name starts with the bin (see Receiver.Values).
+func WithRequireValues() ReporterOption {
+	return func(c *reporterConfig) {
+		c.requireValues = true
+	}
+}
+
+// WithSingleLabelDomains permits reports for domains with only one label
+// (e.g. intranet hosts like "wiki").  By default, these are rejected with
+// ErrSingleLabelDomain, because a bare label is usually not a meaningful
+// subject for metrics.  Operators that intentionally report internal names
+// can use this option.
+func WithSingleLabelDomains() ReporterOption {
+	return func(c *reporterConfig) {
+		c.singleLabel = true
+	}
+}
+
+// WithBurstStrategy sets the function that creates the BurstStrategy for each
+// burst, which selects the reports that are sent.  The default is
+// NewReservoirStrategy.  See BurstStrategy for the privacy implications of
+// selecting more than one report.
+func WithBurstStrategy(newStrategy func() BurstStrategy) ReporterOption {
+	return func(c *reporterConfig) {
+		c.newStrategy = newStrategy
+	}
+}
+
+// WithSharedSecret derives the salt for each day from `secret` (which must be
+// at least 16 bytes), instead of using a random salt stored in the Reporter's
+// file, which is then unused and may be nil.  Every client with the same
+// secret is assigned the same bins, so their reports aggregate consistently,
+// and the bins still change every day, so they can't be linked across days.
+//
+// This is a strong trade-off.  Clients that share a secret always share a
+// bin, so the number of distinct bins counts groups of clients (e.g. fleets),
+// not users, and the k-anonymity threshold must be interpreted accordingly.
+// Anyone who obtains the secret can compute the bin of every report from the
+// whole fleet, which links those reports to the fleet.  The default, a random
+// local salt, avoids both problems.
+func WithSharedSecret(secret []byte) ReporterOption {
+	return func(c *reporterConfig) {
+		c.sharedSecret = secret
+	}
+}
+
+// WithSaltSource reads the salt from `r` instead of the salt file, which is
+// then ignored (and may be nil).  `r` must contain a complete salt in the
+// format of the salt file, e.g. a salt file that was provisioned by a secret
+// manager or embedded in a read-only image.  The salt is never generated or
+// written back, so NewReporter fails if `r` is too short.  The provisioner is
+// responsible for giving each client a different salt: clients that share a
+// salt always share a bin (see BinDistribution).
+func WithSaltSource(r io.Reader) ReporterOption {
+	return func(c *reporterConfig) {
+		c.saltSource = r
+	}
+}
+
+// WithSalt is like WithSaltSource, with the contents of the salt file in
+// `salt`.
+func WithSalt(salt []byte) ReporterOption {
+	return func(c *reporterConfig) {
+		c.saltSource = bytes.NewReader(salt)
+	}
+}
+
+// WithSaltTimeout bounds the time that NewReporter spends loading the salt
+// (including generating and writing a new salt), e.g. if the salt file is on
+// a slow network filesystem.  If loading takes longer than `timeout`,
+// NewReporter fails with ErrSaltTimeout, unless WithSaltFallback is also
+// set.  The I/O is not canceled, so it may still complete (and write a new
+// salt) in the background.  The default is to wait indefinitely.
+func WithSaltTimeout(timeout time.Duration) ReporterOption {
+	return func(c *reporterConfig) {
+		c.saltTimeout = timeout
+	}
+}
+
+// WithSaltFallback makes NewReporter generate a temporary in-memory salt if
+// the salt can't be loaded within the timeout set by WithSaltTimeout, instead
+// of failing.  This keeps reporting available on clients with unreliable
+// storage, at a cost: the temporary salt is not saved, so the client's bins
+// are not stable across runs.  A client that reports the same Key again with
+// a different salt is likely to be counted twice, inflating the estimated
+// number of users, and the temporary salt is treated as created today (see
+// WithStrictSalt).
+func WithSaltFallback() ReporterOption {
+	return func(c *reporterConfig) {
+		c.saltFallback = true
+	}
+}
+
+// WithEphemeralSalt makes NewReporter generate a salt in memory, for clients
+// that have no writable storage, such as one-shot command-line tools and
+// serverless functions.  The salt file is ignored, and may be nil.  This
+// replaces passing an empty bytes.Buffer as the salt file, and makes the
+// consequences explicit: each run has a new salt, so bins are not stable
+// across runs, and the once-a-day limit only applies within a run.  A
+// client that runs several times in a day is therefore likely to be counted
+// several times, inflating the estimated number of users.  NewReporter logs
+// a warning to this effect.  It can't be combined with WithStrictSalt, which
+// would suppress every report, or with another source of the salt.
+func WithEphemeralSalt() ReporterOption {
+	return func(c *reporterConfig) {
+		c.ephemeral = true
+	}
+}
+
+// WithDedupValues permits one report per day for each distinct combination of
+// domain and values, instead of one report per day for each domain.  This is
+// useful for metrics where each value is a separate observation, rather than
+// errors where the first report is sufficient.  The total number of distinct
+// reports per day is still limited to 1000.
+//
+// This increases the number of reports that a single user can send about a
+// domain.  Those reports all have the same bin, so the server can tell that
+// they probably came from the same user, and learn which combinations of
+// values that user observed.
+func WithDedupValues() ReporterOption {
+	return func(c *reporterConfig) {
+		c.dedupValues = true
+	}
+}
+
+// WithDailyBudget permits up to `n` reports per day for each domain (or each
+// combination of domain and values, with WithDedupValues), instead of one,
+// e.g. to capture a few distinct errors for the same domain.  Further
+// reports are dropped as duplicates.  The number of distinct domains per day
+// is still limited to 1000, so a client sends at most 1000n reports per day.
+//
+// A client's reports for a domain on the same day all have the same bin, so
+// the server can tell that they probably came from the same user, and the
+// bin still counts that user only once.
+func WithDailyBudget(n int) ReporterOption {
+	return func(c *reporterConfig) {
+		c.dailyBudget = n
+	}
+}
+
+// WithoutDailyDedup removes the daily duplicate suppression, so every report
+// is passed to the burst suppression, even if the same domain (and values)
+// has already been reported today.  This is only appropriate for volume
+// metrics, such as counting the total number of events, where the number of
+// unique users is not the goal.
+//
+// WARNING: This changes the privacy model.  A user can be counted any number
+// of times for the same Key, so the number of distinct bins no longer
+// estimates the number of unique users, and a single user can reach the
+// k-anonymity threshold on their own.  Their repeated reports all have the
+// same bin, so the server can also tell that they probably came from the same
+// user.  Burst suppression still limits the client's total rate of reports.
+// This overrides WithDedupValues.
+func WithoutDailyDedup() ReporterOption {
+	return func(c *reporterConfig) {
+		c.noDailyDedup = true
+	}
+}
+
+// WithCacheFile persists the daily duplicate suppression in `file` (which may
+// initially be empty), so that it survives a restart.  By default, the cache
+// of reports sent today is only held in memory, so a client that restarts
+// can report the same domain again on the same day, which could cause it to
+// be counted twice or allow its reports to be linked by their bins.
+//
+// Each report is recorded in the file when it enters the burst, before it is
+// sent, so a report that is still waiting for the burst to drain when the
+// process exits is also not admitted again after the restart.  Such a report
+// is lost: delivery is at most once per day.  The file is not synced, so this
+// survives a restart of the process, but not necessarily of the operating
+// system.  Failure to write the file causes the report to be dropped.
+//
+// The file records that the client was active, but not what it reported:
+// each entry is an HMAC with a random key, which is stored in the file and
+// replaced every day.  Anyone who can read the file can test whether a
+// particular domain was reported today, just as they could by inspecting
+// the process's memory.  This option has no effect with WithoutDailyDedup.
+func WithCacheFile(file io.ReadWriteSeeker) ReporterOption {
+	return func(c *reporterConfig) {
+		c.cacheFile = file
+	}
+}
+
+// WithActiveBins only sends reports that are assigned to the first `k` bins,
+// and silently drops the rest.  Bins are assigned uniformly at random for
+// each Key, so this samples k/bins of the users for each Key, without any
+// additional randomness.  The sample is stable for each Key during a day, so
+// a sampled user's reports are all sent, and an unsampled user's are not.
+// The default is to send reports in every bin.
+//
+// The server must divide its counts by the sampling fraction k/bins to
+// estimate the total.  Reports can only arrive in the first `k` bins, so the
+// k-anonymity threshold must not exceed `k`.
+func WithActiveBins(k int) ReporterOption {
+	return func(c *reporterConfig) {
+		c.activeBins = k
+	}
+}
+
+// WithClock sets the source of the current time, which determines the date of
+// each report and of a newly generated salt.  The default is time.Now.  This
+// allows tests to control the date, including around midnight UTC.
+func WithClock(clock Clock) ReporterOption {
+	return func(c *reporterConfig) {
+		c.clock = clock
+	}
+}
+
+// WithObserver arranges for `o` to be notified as reports pass through the
+// pipeline, e.g. to export metrics.  See the otel subpackage for an Observer
+// that uses OpenTelemetry.
+func WithObserver(o Observer) ReporterOption {
+	return func(c *reporterConfig) {
+		c.observer = o
+	}
+}
+
+// WithConnectivityProbe calls `probe` before sending each report, to check
+// whether the client is online.  `probe` is called while the Reporter holds
+// a lock, so it must return quickly, e.g. by checking a cached network state
+// rather than sending a request.
+//
+// If `offline` is nil, a report that is built while the client is offline is
+// rejected with ErrOffline before it reaches the daily cache, so it doesn't
+// use the domain's daily slot (see WithDailyBudget), and the same domain can
+// be reported again when the client is back online.  Without a probe, such a
+// report would be recorded in the daily cache and then fail to send, so the
+// domain couldn't be reported again until the next day.
+//
+// If `offline` is set (e.g. a QueueReportSender), a report that is built
+// while the client is offline is recorded in the daily cache as usual, and
+// then passed to `offline` instead of the burst suppression, so it is not
+// reported again when the client is back online.  The application is
+// responsible for sending the queued reports later (see DrainQueue).  They
+// bypass burst suppression, so correlated reports from the same burst may
+// all be queued and sent.
+func WithConnectivityProbe(probe func() bool, offline ReportSender) ReporterOption {
+	return func(c *reporterConfig) {
+		c.probe = probe
+		c.offline = offline
+	}
+}
+
+// WithValuePolicies checks the value at each position of every report
+// against the corresponding policy, and rejects reports that violate a
+// policy with a *ValueError identifying the position.  Positions beyond the
+// end of `policies`, and nil policies, only require a valid Value.  There
+// must not be more policies than values.  The policies don't apply to the
+// Reporter's channels, which have their own values.
+//
+// Policies catch schema violations before they are sent, and document the
+// structure of the reports, e.g. WithValuePolicies(AllowedValues("http",
+// "https"), nil) for a report whose first value is a scheme.
+func WithValuePolicies(policies ...ValuePolicy) ReporterOption {
+	return func(c *reporterConfig) {
+		c.policies = policies
+	}
+}
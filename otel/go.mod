@@ -0,0 +1,17 @@
+module github.com/Jigsaw-Code/choir/otel
+
+go 1.25.0
+
+require (
+	github.com/Jigsaw-Code/choir v0.0.0
+	go.opentelemetry.io/otel v1.46.0
+	go.opentelemetry.io/otel/metric v1.46.0
+	go.opentelemetry.io/otel/trace v1.46.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2 // indirect
+)
+
+replace github.com/Jigsaw-Code/choir => ../
@@ -0,0 +1,89 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otel provides a choir.Observer that exports metrics and traces for
+// the Reporter pipeline using OpenTelemetry.  It is a separate package so
+// that the core choir package does not depend on OpenTelemetry.
+//
+// The Observer never sees the contents of reports, so the exported telemetry
+// contains only counts and latencies.
+package otel
+
+import (
+	"context"
+	"time"
+
+	"github.com/Jigsaw-Code/choir"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name of the instrumentation scope for meters and tracers.
+const instrumentationName = "github.com/Jigsaw-Code/choir/otel"
+
+// The attribute that records the choir.Event for each counted report.
+const eventKey = attribute.Key("choir.event")
+
+type observer struct {
+	reports metric.Int64Counter
+	latency metric.Float64Histogram
+	tracer  trace.Tracer
+}
+
+// NewObserver returns a choir.Observer that exports a counter of reports
+// ("choir.reports", with a "choir.event" attribute for each choir.Event) and
+// a histogram of ReportSender latency ("choir.send.duration") to `mp`, and a
+// span ("choir.Send") for each call to the ReportSender to `tp`.  Pass the
+// Observer to choir.NewReporter using choir.WithObserver.
+func NewObserver(mp metric.MeterProvider, tp trace.TracerProvider) (choir.Observer, error) {
+	meter := mp.Meter(instrumentationName)
+	reports, err := meter.Int64Counter("choir.reports",
+		metric.WithDescription("Reports that reached each stage of the Choir pipeline"),
+		metric.WithUnit("{report}"))
+	if err != nil {
+		return nil, err
+	}
+	latency, err := meter.Float64Histogram("choir.send.duration",
+		metric.WithDescription("Duration of each call to the Choir ReportSender"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &observer{
+		reports: reports,
+		latency: latency,
+		tracer:  tp.Tracer(instrumentationName),
+	}, nil
+}
+
+func (o *observer) Observe(event choir.Event, n int) {
+	o.reports.Add(context.Background(), int64(n), metric.WithAttributes(eventKey.String(event.String())))
+}
+
+func (o *observer) StartSend() func(error) {
+	start := time.Now()
+	ctx, span := o.tracer.Start(context.Background(), "choir.Send", trace.WithSpanKind(trace.SpanKindClient))
+	return func(err error) {
+		event := choir.EventSent
+		if err != nil {
+			event = choir.EventFailed
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		o.latency.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(eventKey.String(event.String())))
+		span.End()
+	}
+}
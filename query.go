@@ -0,0 +1,55 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+// QueryFunc receives a ready-to-send DNS query, along with the Report that it
+// encodes.  See NewQueryReportSender.
+type QueryFunc func(query []byte, report Report) error
+
+// queryReportSender implements ReportSender by formatting each report as a
+// query, and passing it to a QueryFunc.
+type queryReportSender struct {
+	suffix string
+	opts   QueryOptions
+	f      QueryFunc
+}
+
+// NewQueryReportSender returns a ReportSender that formats each report as a
+// DNS query for `suffix` (unless the report has its own Suffix) with `opts`,
+// and passes the query to `f` instead of sending it.  This allows an
+// application with its own DNS transport to use the full Reporter pipeline,
+// including duplicate and burst suppression, by passing this ReportSender to
+// NewReporter.  `f` is called asynchronously from the burst drain, so it must
+// be safe for concurrent execution, and it must send the query through a
+// recursive resolver (see ReportSender).  `f` owns the query.
+func NewQueryReportSender(suffix string, opts QueryOptions, f QueryFunc) ReportSender {
+	return &queryReportSender{
+		suffix: suffix,
+		opts:   opts,
+		f:      f,
+	}
+}
+
+func (s *queryReportSender) Send(r Report) error {
+	suffix := r.Suffix()
+	if suffix == "" {
+		suffix = s.suffix
+	}
+	query, err := FormatQueryWithOptions(r, suffix, s.opts)
+	if err != nil {
+		return err
+	}
+	return s.f(query, r)
+}
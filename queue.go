@@ -0,0 +1,281 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+// Version of the queue record format.
+const queueVersion = 1
+
+// The Comment in the gzip header of each compressed batch, which identifies
+// the version of the records in the batch.
+var queueComment = fmt.Sprintf("choir queue v%d", queueVersion)
+
+// The first bytes of a gzip stream (RFC 1952).  JSON records always start
+// with "{", so this distinguishes compressed queues from uncompressed ones.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ErrQueueFull is returned by a QueueReportSender that has reached its
+// capacity.
+var ErrQueueFull = errors.New("Queue is full")
+
+// queueRecord is the serialized form of a Report in a queue.  Each record
+// is written as a single line of JSON.
+type queueRecord struct {
+	Version int      `json:"v"`
+	Domain  string   `json:"domain"`
+	Country string   `json:"country"`
+	Date    string   `json:"date"`
+	Values  []string `json:"values"`
+	Bin     string   `json:"bin"`
+	Tag     string   `json:"tag,omitempty"`
+	Suffix  string   `json:"suffix,omitempty"`
+	// True if the date is encoded compactly in the report name.
+	CompactDate bool `json:"compact_date,omitempty"`
+}
+
+func newQueueRecord(r Report) queueRecord {
+	values := make([]string, len(r.Values))
+	for i, v := range r.Values {
+		values[i] = v.String()
+	}
+	return queueRecord{
+		Version:     queueVersion,
+		Domain:      r.Domain,
+		Country:     r.Country,
+		Date:        r.Date.Format(dateForm),
+		Values:      values,
+		Bin:         r.bin,
+		Tag:         r.tag,
+		Suffix:      r.suffix,
+		CompactDate: r.compactDate,
+	}
+}
+
+func (q queueRecord) report() (Report, error) {
+	if q.Version != queueVersion {
+		return Report{}, fmt.Errorf("Unsupported queue version: %d", q.Version)
+	}
+	date, err := time.Parse(dateForm, q.Date)
+	if err != nil {
+		return Report{}, err
+	}
+	values := make([]Value, len(q.Values))
+	for i, v := range q.Values {
+		if values[i], err = NewValue(v); err != nil {
+			return Report{}, err
+		}
+	}
+	return Report{
+		Key: Key{
+			Domain:  q.Domain,
+			Country: q.Country,
+			Date:    date,
+		},
+		Values:      values,
+		bin:         q.Bin,
+		tag:         q.Tag,
+		suffix:      q.Suffix,
+		compactDate: q.CompactDate,
+	}, nil
+}
+
+// QueueReportSender implements ReportSender by appending each report to a
+// durable queue, instead of sending it.  This is useful for clients that are
+// not always connected: pass a QueueReportSender to NewReporter, and call
+// DrainQueue to replay the queue through a real ReportSender when
+// connectivity returns.
+//
+// The queue contains the full contents of each report, including the bin, so
+// it must be protected in the same way as the salt file.
+type QueueReportSender struct {
+	mu    sync.Mutex // Protects `w`, `count` and `pending`.
+	w     io.Writer
+	max   int
+	count int
+	// If positive, records are compressed in batches of this size.
+	batch int
+	// Records that have not been written yet, if batch > 0.
+	pending  []byte
+	npending int
+}
+
+// NewQueueReportSender returns a QueueReportSender that writes to `w`
+// (typically a file opened for appending), and accepts at most `max` reports.
+func NewQueueReportSender(w io.Writer, max int) *QueueReportSender {
+	return &QueueReportSender{w: w, max: max}
+}
+
+// NewCompressedQueueReportSender is like NewQueueReportSender, but it writes
+// the reports in gzip-compressed batches of `batch` reports, which is much
+// more compact for large queues.  Reports are held in memory until their
+// batch is complete, so Flush must be called to write a partial batch (e.g.
+// before the app exits).  If a batch is only partly written (e.g. due to a
+// crash), DrainQueue recovers every complete report that precedes the damage.
+func NewCompressedQueueReportSender(w io.Writer, max, batch int) *QueueReportSender {
+	return &QueueReportSender{w: w, max: max, batch: batch}
+}
+
+// Send appends `r` to the queue, or returns ErrQueueFull if the queue has
+// reached its capacity.
+func (q *QueueReportSender) Send(r Report) error {
+	line, err := json.Marshal(newQueueRecord(r))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count >= q.max {
+		return ErrQueueFull
+	}
+	if q.batch > 0 {
+		q.pending = append(q.pending, line...)
+		q.npending++
+		q.count++
+		if q.npending >= q.batch {
+			return q.flush()
+		}
+		return nil
+	}
+	if _, err := q.w.Write(line); err != nil {
+		return err
+	}
+	q.count++
+	return nil
+}
+
+// Flush writes any reports that are waiting for their batch to be completed.
+// It has no effect on an uncompressed queue.
+func (q *QueueReportSender) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.flush()
+}
+
+// Writes the pending reports as a single gzip member.  Callers must hold `mu`.
+func (q *QueueReportSender) flush() error {
+	if q.npending == 0 {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Comment = queueComment
+	if _, err := zw.Write(q.pending); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if _, err := q.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	q.pending = nil
+	q.npending = 0
+	return nil
+}
+
+// DrainQueue reads the reports written by a QueueReportSender from `queue`
+// and passes them to `sender`.  Reports that are not dated `date` (normally
+// today, according to the Reporter's Clock) are stale, and are silently
+// dropped: their bins are only meaningful for their own date, and the client
+// has already moved on to a new day's reports.
+// DrainQueue stops at the first error, returning the number of reports that
+// were sent successfully.  Compressed queues are detected automatically.
+func DrainQueue(queue io.Reader, sender ReportSender, date time.Time) (sent int, err error) {
+	date = TruncateDate(date)
+	replay := func(line []byte) error {
+		var record queueRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		report, err := record.report()
+		if err != nil {
+			return err
+		}
+		if !report.Date.Equal(date) {
+			log.Println("Dropping stale report from queue")
+			return nil
+		}
+		if err := sender.Send(report); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	}
+	r := bufio.NewReader(queue)
+	if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		return sent, drainCompressed(r, replay)
+	}
+	return sent, drainLines(r, replay)
+}
+
+// Calls `replay` with each line of `r`, stopping at the first error.
+func drainLines(r io.Reader, replay func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := replay(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Calls `replay` with each line of each compressed batch in `r`.  If the
+// last batch is truncated, the complete lines that it contains are replayed.
+func drainCompressed(r *bufio.Reader, replay func([]byte) error) error {
+	for {
+		zr, err := gzip.NewReader(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The queue ends here, possibly in the middle of a header.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if zr.Comment != queueComment {
+			return fmt.Errorf("Unsupported compressed queue: %q", zr.Comment)
+		}
+		// Read one batch at a time, so that a truncated batch can be detected.
+		zr.Multistream(false)
+		batch, err := ioutil.ReadAll(zr)
+		truncated := errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !truncated {
+			return err
+		}
+		if truncated {
+			// Discard the incomplete record at the end of the batch.
+			batch = batch[:bytes.LastIndexByte(batch, '\n')+1]
+		}
+		if err := drainLines(bytes.NewReader(batch), replay); err != nil {
+			return err
+		}
+		if truncated {
+			log.Println("Compressed queue is truncated")
+			return nil
+		}
+	}
+}
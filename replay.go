@@ -0,0 +1,102 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers the names of reports that were received recently,
+// so that a query that arrives more than once (e.g. because the client or a
+// resolver retried it) is only counted once.  Without it, each copy adds an
+// observation to the dam for its Key, so the released reports overstate the
+// number of observations, although the number of distinct bins (and
+// therefore the k-anonymity threshold) is unaffected, because bins are
+// counted as a set.
+//
+// A consumer reserves each parsed name with Reserve before delivering the
+// report (e.g. passing it to Filter), and calls Forget if delivery fails, so
+// that a retry is not dropped.  BeaconHandler does this when its Replay is
+// set.  ParseQuery doesn't use a ReplayCache, so a DNS server must call
+// Reserve and Forget itself to drop replayed queries.
+//
+// Two different users in the same bin who report identical values on the
+// same day produce identical names, so within the TTL, the second of them is
+// also dropped as a replay.  This never releases a Key early, but it can
+// undercount genuine observations, so the TTL should be just long enough to
+// cover retries (e.g. a minute).
+//
+// A ReplayCache is safe for concurrent use, and may be shared by several
+// consumers.
+type ReplayCache struct {
+	clock Clock
+
+	mu     sync.Mutex
+	recent recentSet // Hashes of recently reserved names.
+	hits   int
+}
+
+// NewReplayCache returns a ReplayCache that treats a name as a replay if it
+// was reserved within `ttl`, remembering at most the `size` most recent names.
+// Each name costs roughly 200 bytes.
+func NewReplayCache(ttl time.Duration, size int) *ReplayCache {
+	return &ReplayCache{
+		clock:  time.Now,
+		recent: newRecentSet(ttl, size),
+	}
+}
+
+// Returns the identity of `name`, ignoring case.  Names are up to 253 bytes,
+// so this is a hash that is long enough to avoid accidental collisions.
+func replayID(name string) [16]byte {
+	var id [16]byte
+	sum := sha256.Sum256([]byte(normalizeForReport(name)))
+	copy(id[:], sum[:])
+	return id
+}
+
+// Reserve records `name`, and returns true, unless it was reserved within
+// the TTL, in which case the report should be treated as delivered, but not
+// delivered again, and it returns false.  Each such name counts as a hit.
+func (c *ReplayCache) Reserve(name string) bool {
+	id := replayID(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recent.add(id, c.clock()) == nil {
+		c.hits++
+		return false
+	}
+	return true
+}
+
+// Forget removes the reservation of `name`, e.g. because its report could not
+// be delivered, so that a retry is accepted.
+func (c *ReplayCache) Forget(name string) {
+	id := replayID(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.recent.index[id]; ok {
+		c.recent.remove(e)
+	}
+}
+
+// Hits returns the number of names that have been rejected as replays.
+func (c *ReplayCache) Hits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The port of a resolver address that doesn't specify one.
+const defaultDNSPort = "53"
+
+// RecursiveResolver is like RecursiveResolverContext, with a background
+// context.
+func RecursiveResolver() (string, error) {
+	return RecursiveResolverContext(context.Background())
+}
+
+// RecursiveResolverContext returns the address of the system's default recursive
+// resolver as "host:port", suitable for DNSReportSender.Resolver.  IPv6
+// addresses are bracketed (e.g. "[2001:db8::1]:53"), so the result can be
+// dialed directly in either address family.
+//
+// Go determines the resolver from platform-specific configuration (e.g.
+// /etc/resolv.conf), but doesn't expose it, so this captures the address of
+// the first server that Go's own resolver would query, without sending
+// anything.  This only reads local configuration, so it doesn't need a
+// timeout, but it fails if `ctx` is already done.
+func RecursiveResolverContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var address string
+	// This fake Dial function serves to capture the address argument, which
+	// is the address of the recursive resolver.
+	fakeDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if address == "" {
+			address = addr
+		}
+		return nil, errors.New("Fake dialer")
+	}
+	(&net.Resolver{
+		PreferGo: true,
+		Dial:     fakeDial,
+	}).LookupTXT(ctx, "noname.example")
+	if address == "" {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("No recursive resolver is configured")
+	}
+	return normalizeResolverAddress(address)
+}
+
+// Converts `address`, an IP address with an optional port, to a dialable
+// "host:port", with brackets around IPv6 addresses.
+func normalizeResolverAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// There is no port, or an IPv6 address is missing its brackets.
+		host, port = strings.Trim(address, "[]"), defaultDNSPort
+	}
+	// An IPv6 address may have a zone (e.g. "fe80::1%eth0").
+	ip := host
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		ip = host[:i]
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("Resolver address is not an IP address: %q", address)
+	}
+	if parsed.To4() != nil {
+		// Use the dotted form for IPv4-mapped IPv6 addresses.
+		host = parsed.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Random draws are made with this many bits of precision, which is the
+// precision of a float64 in [0, 1).
+const samplingBits = 53
+
+// SamplingReporter implements Reporter by forwarding a random fraction of
+// calls to another Reporter, and silently dropping the rest before any work
+// is done to build them.
+//
+// Sampling changes the statistical weight of each report at the server:
+// every report that is received represents 1/p calls on average.  The server
+// must therefore know the sampling rate to estimate the true volume.  Note
+// that a key that is sampled by fewer clients also appears in fewer bins, so
+// sampling makes the k-anonymity threshold harder to reach.
+type SamplingReporter struct {
+	Reporter
+	// The probability that each call is forwarded, in [0, 1].
+	p float64
+	// The threshold that a random draw must be below to be forwarded.
+	threshold *big.Int
+}
+
+// NewSamplingReporter returns a SamplingReporter that forwards each call to
+// `r` with probability `p`.
+func NewSamplingReporter(r Reporter, p float64) (*SamplingReporter, error) {
+	if !(p >= 0 && p <= 1) {
+		return nil, fmt.Errorf("Sampling probability is not in [0, 1]: %v", p)
+	}
+	threshold := new(big.Float).SetFloat64(p)
+	threshold.SetMantExp(threshold, samplingBits)
+	t, _ := threshold.Int(nil)
+	return &SamplingReporter{
+		Reporter:  r,
+		p:         p,
+		threshold: t,
+	}, nil
+}
+
+// Report forwards the call to the underlying Reporter with the sampling
+// probability.  Otherwise, it returns nil immediately.
+func (s *SamplingReporter) Report(domain string, values ...Value) error {
+	if sampled, err := s.sample(); err != nil || !sampled {
+		return err
+	}
+	return s.Reporter.Report(domain, values...)
+}
+
+// ReportWithDate forwards the call to the underlying Reporter with the
+// sampling probability.  Otherwise, it returns nil immediately.  It returns
+// ErrNotSupported if the underlying Reporter is not a DatedReporter.
+func (s *SamplingReporter) ReportWithDate(date time.Time, domain string, values ...Value) error {
+	dated, ok := s.Reporter.(DatedReporter)
+	if !ok {
+		return ErrNotSupported
+	}
+	if sampled, err := s.sample(); err != nil || !sampled {
+		return err
+	}
+	return dated.ReportWithDate(date, domain, values...)
+}
+
+// RotateSalt rotates the salt of the underlying Reporter, or returns
+// ErrNotSupported if it is not a SaltRotator.
+func (s *SamplingReporter) RotateSalt() error {
+	rotator, ok := s.Reporter.(SaltRotator)
+	if !ok {
+		return ErrNotSupported
+	}
+	return rotator.RotateSalt()
+}
+
+// BinFor returns the bin from the underlying Reporter, or ErrNotSupported if
+// it is not a BinPreviewer.
+func (s *SamplingReporter) BinFor(domain string) (string, error) {
+	previewer, ok := s.Reporter.(BinPreviewer)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return previewer.BinFor(domain)
+}
+
+// Makes a random draw, and returns true with probability s.p.
+func (s *SamplingReporter) sample() (bool, error) {
+	i, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), samplingBits))
+	if err != nil {
+		return false, err
+	}
+	return i.Cmp(s.threshold) < 0, nil
+}
+
+// Channel returns a channel of the underlying Reporter that is sampled at the
+// same rate, or ErrNotSupported if it is not a ChannelReporter.
+func (s *SamplingReporter) Channel(values int, suffix string) (Reporter, error) {
+	parent, ok := s.Reporter.(ChannelReporter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	channel, err := parent.Channel(values, suffix)
+	if err != nil {
+		return nil, err
+	}
+	return NewSamplingReporter(channel, s.p)
+}
@@ -15,27 +15,173 @@
 package choir
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"strings"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+// ErrSchemaMismatch indicates that a name has the wrong fields for the
+// Receiver, which usually means that the client is configured with a
+// different number of values (or a different date encoding).  Because the
+// fields are positional, such names would otherwise be parsed with domain
+// labels attributed to values, or vice versa.
+var ErrSchemaMismatch = errors.New("Name doesn't match the Receiver's configuration")
+
 // Receiver represents the configuration of a metrics server, required
 // to receive `Report`s in query form.
 type Receiver struct {
-	// The name of the metrics server, e.g. "metrics.example.com"
+	// The name of the metrics server, e.g. "metrics.example.com".  It must
+	// not be empty.
 	Suffix string
 	// The number of values in each Report.
 	Values int
+	// The Alphabet used by clients to encode bins.  The default is Base32.
+	Alphabet Alphabet
+	// If set, reports must be authenticated with this key.
+	// See NewSigningReportSender.
+	AuthKey []byte
+	// If true, reports must not be segmented by country, and must use the
+	// NoCountry placeholder.  If false, NoCountry is rejected.
+	NoCountry bool
+	// The query type and class that clients use, for ParseQuery.  The
+	// defaults are TXT and INET.  See QueryOptions.
+	QueryType  dnsmessage.Type
+	QueryClass dnsmessage.Class
+	// If true, dates are encoded compactly.  See WithCompactDate.
+	CompactDate bool
+}
+
+// ParseError is the error returned by ParseReport.  Its message is that of
+// the underlying error, and it provides additional detail for debugging.
+type ParseError struct {
+	// The name that could not be parsed.
+	Name string
+	// The Receiver's configuration.
+	Suffix string
+	Values int
+	// The underlying error.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostic returns a description of the failure that includes the
+// Receiver's configuration and the name's labels, which is useful for
+// debugging a mismatch between the client and server configuration.
+func (e *ParseError) Diagnostic() string {
+	labels := strings.Split(normalizeForReport(e.Name), ".")
+	return fmt.Sprintf("%v (expected %d values and suffix %q, got labels %q)", e.Err, e.Values, e.Suffix, labels)
 }
 
-// ParseReport inverts Reporter.name(report)
+// ParseReport inverts Reporter.name(report).  Errors are of type *ParseError.
 func (r *Receiver) ParseReport(name string) (*Report, error) {
+	report, err := r.parseReport(name)
+	if err != nil {
+		return nil, &ParseError{
+			Name:   name,
+			Suffix: r.Suffix,
+			Values: r.Values,
+			Err:    err,
+		}
+	}
+	return report, nil
+}
+
+// ParseQuery parses a serialized DNS query (e.g. as produced by
+// FormatQueryWithOptions) and returns the Report encoded in its question.
+// The query must contain a single question, with the Receiver's QueryType
+// and QueryClass.
+func (r *Receiver) ParseQuery(query []byte) (*Report, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("Message is not a query")
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if len(questions) != 1 {
+		return nil, fmt.Errorf("Expected 1 question, got %d", len(questions))
+	}
+	q := questions[0]
+	qtype, qclass := questionType(r.QueryType, r.QueryClass)
+	if q.Type != qtype || q.Class != qclass {
+		return nil, fmt.Errorf("Wrong query type: %v %v != %v %v", q.Type, q.Class, qtype, qclass)
+	}
+	return r.ParseReport(q.Name.String())
+}
+
+// ConfirmationResponse returns a response to `query` that confirms delivery
+// of the report to a client whose sender has Confirmation set to `token`,
+// with a TXT record containing `token` and a TTL of zero.  The metrics
+// server should only send it after recording the report.
+func ConfirmationResponse(query []byte, token string) ([]byte, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+	if q.Response || len(q.Questions) != 1 {
+		return nil, errors.New("Message is not a query with 1 question")
+	}
+	question := q.Questions[0]
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               q.ID,
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: q.RecursionDesired,
+			RCode:            dnsmessage.RCodeSuccess,
+		},
+		Questions: q.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeTXT,
+				Class: question.Class,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{token}},
+		}},
+	}
+	return response.Pack()
+}
+
+func (r *Receiver) parseReport(name string) (*Report, error) {
+	if r.Values < 0 || r.Values > maxValues {
+		return nil, fmt.Errorf("Unreasonable number of values: %d", r.Values)
+	}
+	// Every name would match an empty suffix.
+	if err := checkSuffix(r.Suffix); err != nil {
+		return nil, err
+	}
+	// Bound the work done for each name, which may be malicious.  A name
+	// that fits in a DNS message is at most MaxNameLength characters, plus
+	// the trailing ".".
+	if len(name) > MaxNameLength+1 {
+		return nil, fmt.Errorf("%w: %d > %d", ErrNameTooLong, len(name), MaxNameLength)
+	}
 	for _, runeValue := range name {
 		if runeValue >= 128 {
 			return nil, errors.New("Non-ASCII characters are unsupported")
 		}
 	}
+	// The whole name is lowercased before it is split, so values and
+	// domains are recovered correctly even if a resolver (or the client)
+	// randomizes the case of the query name (e.g. DNS 0x20 encoding).
 	name = normalizeForReport(name)
 	suffix := normalizeForReport(r.Suffix)
 	if !strings.HasSuffix(name, suffix) {
@@ -44,8 +190,15 @@ func (r *Receiver) ParseReport(name string) (*Report, error) {
 	name = strings.TrimSuffix(name, suffix)
 	name = strings.TrimSuffix(name, ".")
 	labels := strings.Split(name, ".")
+	var tag string
+	if r.AuthKey != nil {
+		var err error
+		if labels, tag, err = verifyTag(r.AuthKey, labels); err != nil {
+			return nil, err
+		}
+	}
 	if len(labels) <= r.Values+3 {
-		return nil, errors.New("Name is too short")
+		return nil, fmt.Errorf("%w: name is too short for %d values", ErrSchemaMismatch, r.Values)
 	}
 	valueLabels, labels := labels[:r.Values], labels[r.Values:]
 	values := make([]Value, r.Values)
@@ -57,12 +210,45 @@ func (r *Receiver) ParseReport(name string) (*Report, error) {
 	}
 	bin, labels := labels[0], labels[1:]
 	country, labels := labels[0], labels[1:]
+	alphabet := r.Alphabet
+	if alphabet == "" {
+		alphabet = Base32
+	}
+	if bin == "" || !alphabet.contains(bin) {
+		return nil, fmt.Errorf("%w: bin label %q is not in the alphabet; is the value count (%d) correct?", ErrSchemaMismatch, bin, r.Values)
+	}
 	dateLabel, labels := labels[0], labels[1:]
 	domain := strings.Join(labels, ".")
 
-	date, err := time.Parse(dateForm, dateLabel)
-	if err != nil {
-		return nil, err
+	// The fields are positional, so if the client sent a different number of
+	// values than r.Values, every field is shifted.  The country and date have
+	// fixed formats, which allows this to be detected instead of silently
+	// attributing domain labels to values (or vice versa).
+	if len(country) != 2 {
+		return nil, fmt.Errorf("%w: country label %q has the wrong length; is the value count (%d) correct?", ErrSchemaMismatch, country, r.Values)
+	}
+	if _, err := NewCountry(country); err != nil {
+		return nil, fmt.Errorf("%w: country label %q is not a country code; is the value count (%d) correct?", ErrSchemaMismatch, country, r.Values)
+	}
+	if r.NoCountry != (country == NoCountry) {
+		return nil, fmt.Errorf("%w: country label %q doesn't match NoCountry = %v", ErrSchemaMismatch, country, r.NoCountry)
+	}
+	var date time.Time
+	if r.CompactDate {
+		var err error
+		if date, err = parseCompactDate(dateLabel); err != nil {
+			return nil, fmt.Errorf("%w: date label %q is not a compact date; is the value count (%d) correct?", ErrSchemaMismatch, dateLabel, r.Values)
+		}
+	} else {
+		var err error
+		if !isDigits(dateLabel) {
+			err = errors.New("not digits")
+		} else {
+			date, err = time.Parse(dateForm, dateLabel)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: date label %q is not a date; is the value count (%d) correct?", ErrSchemaMismatch, dateLabel, r.Values)
+		}
 	}
 
 	return &Report{
@@ -71,27 +257,180 @@ func (r *Receiver) ParseReport(name string) (*Report, error) {
 			Country: country,
 			Date:    date,
 		},
-		Values: values,
-		bin:    bin,
+		Values:      values,
+		bin:         bin,
+		tag:         tag,
+		compactDate: r.CompactDate,
 	}, nil
 }
 
+// Reports whether `s` consists only of the digits 0-9.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Occupancy returns the number of distinct bins observed for each Key in
+// `reports`, which should be parsed reports (e.g. from ParseReport).  This is
+// a lower bound on the number of distinct users who reported each Key.
+// Reports without a bin (see Report.Bin), such as the output of Filter, are
+// skipped, so a Key whose reports have no bins is absent from the result.
+//
+// Bins are only meaningful within a single Key.  A user's bin is different
+// for each domain and date, so bins counted across several Keys (e.g. all the
+// domains that reported a particular value) do not bound the number of users:
+// two reports in different bins might come from the same user, and two
+// reports in the same bin might come from different users.
+func Occupancy(reports []Report) map[Key]int {
+	bins := make(map[Key]stringSet)
+	for _, r := range reports {
+		if r.bin == "" {
+			continue
+		}
+		set, ok := bins[r.Key]
+		if !ok {
+			set = newStringSet()
+			bins[r.Key] = set
+		}
+		set.add(r.bin)
+	}
+	occupancy := make(map[Key]int, len(bins))
+	for key, set := range bins {
+		occupancy[key] = set.len()
+	}
+	return occupancy
+}
+
+// BinStats describes how the reports for a Key are distributed over bins.
+// See BinDistribution.
+type BinStats struct {
+	// The number of reports for the Key.
+	Reports int
+	// The number of distinct bins among those reports.
+	Bins int
+	// The Shannon entropy of the distribution of reports over bins, in bits.
+	Entropy float64
+	// The entropy, in bits, of the most even possible distribution of this
+	// many reports over the client's bins.
+	MaxEntropy float64
+}
+
+// The minimum number of reports for a Key before BinStats.Concentrated can
+// report it.  With fewer reports, a concentrated distribution is too likely to
+// occur by chance.
+const minConcentrationReports = 8
+
+// Concentrated reports whether the reports for this Key are suspiciously
+// concentrated in a few bins: there are enough reports to judge, and the
+// entropy is less than half of the maximum.
+func (s BinStats) Concentrated() bool {
+	return s.Reports >= minConcentrationReports && s.Entropy < s.MaxEntropy/2
+}
+
+// BinDistribution returns BinStats for each Key in `reports`, which should be
+// parsed reports (e.g. from ParseReport).  `bins` is the number of bins that
+// clients use.  Reports without a bin, such as the output of Filter, are
+// skipped, as in Occupancy.
+//
+// This is a diagnostic for a misconfigured fleet of clients that share a
+// salt (e.g. a salt file that was bundled with an application).  Clients with
+// the same salt are assigned the same bin for every Key, so their reports
+// are concentrated in a single bin: the Key may never reach the Filter
+// threshold, and Occupancy counts them as a single user.  Independent
+// clients are spread uniformly over the bins.
+//
+// A concentrated Key can also occur by chance, or when a single client sends
+// several reports for a Key (see WithDedupValues and WithoutDailyDedup).  A
+// shared salt affects every Key on every day, so operators should look for
+// a large fraction of concentrated Keys that persists over several days,
+// rather than for individual Keys.
+func BinDistribution(reports []Report, bins int) map[Key]BinStats {
+	counts := make(map[Key]map[string]int)
+	for _, r := range reports {
+		if r.bin == "" {
+			continue
+		}
+		c, ok := counts[r.Key]
+		if !ok {
+			c = make(map[string]int)
+			counts[r.Key] = c
+		}
+		c[r.bin]++
+	}
+	stats := make(map[Key]BinStats, len(counts))
+	for key, c := range counts {
+		s := BinStats{Bins: len(c)}
+		for _, n := range c {
+			s.Reports += n
+		}
+		for _, n := range c {
+			p := float64(n) / float64(s.Reports)
+			s.Entropy -= p * math.Log2(p)
+		}
+		s.MaxEntropy = maxBinEntropy(s.Reports, bins)
+		stats[key] = s
+	}
+	return stats
+}
+
+// Returns the entropy, in bits, of `n` reports spread as evenly as possible
+// over `bins` bins.
+func maxBinEntropy(n, bins int) float64 {
+	if n <= 0 || bins <= 0 {
+		return 0
+	}
+	// Every bin has `q` or `q+1` reports.
+	q, r := n/bins, n%bins
+	entropy := 0.0
+	if q > 0 {
+		p := float64(q) / float64(n)
+		entropy -= float64(bins-r) * p * math.Log2(p)
+	}
+	if r > 0 {
+		p := float64(q+1) / float64(n)
+		entropy -= float64(r) * p * math.Log2(p)
+	}
+	return entropy
+}
+
 // Each key has an associated dam, which holds Reports until it
-// reaches a threshold number of bins and "bursts", releasing
-// the Reports and any future reports as well.
+// reaches a threshold number of bins (or values, see ReleaseCondition) and
+// "bursts", releasing the Reports and any future reports as well.
 type dam struct {
-	// A set (map with empty values) of observed bins
-	bins map[string]observed
+	// The set of observed bins
+	bins stringSet
+	// The set of observed value tuples (see Report.Fingerprint).
+	values stringSet
 	// All observed values.  len(observations) >= len(bins).
 	observations [][]Value
 }
 
+func newDam() *dam {
+	return &dam{bins: newStringSet(), values: newStringSet()}
+}
+
+// DamState is the serializable contents of a dam: the reports that have
+// been received for a Key but not yet released by Filter.  It allows the
+// reports for a Key to be split across several Filters (e.g. on different
+// shards) and merged back together.
+type DamState struct {
+	Key Key
+	// The distinct bins observed for Key.
+	Bins []string
+	// The values of each report held behind the dam.
+	Observations [][]Value
+}
+
 // Add a Report to the dam.  If the number of bins exceeds the
 // `threshold`, the dam bursts, releasing all the stored reports.
 // If the dam has already burst, the report will be returned
 // immediately.
 // If `d` is `nil`, it is treated as burst.
-func (d *dam) add(report Report, threshold int) []Report {
+func (d *dam) add(report Report, threshold int, condition ReleaseCondition) []Report {
 	if d == nil {
 		return []Report{report}
 	}
@@ -101,14 +440,47 @@ func (d *dam) add(report Report, threshold int) []Report {
 		// (which are reports without a bin) back into Filter again.
 	}
 	// Add reports behind the dam
-	d.bins[report.bin] = observed{}
+	d.bins.add(report.bin)
+	d.values.add(report.Fingerprint())
 	d.observations = append(d.observations, report.Values)
-	if len(d.bins) >= threshold {
+	return d.release(report.Key, threshold, condition)
+}
+
+// Merge the contents of another dam for the same key into this one.
+// The bin sets are combined by union (see stringSet.union).
+// If `d` is `nil`, it is treated as burst.
+func (d *dam) merge(state DamState, threshold int, condition ReleaseCondition) []Report {
+	if d == nil {
+		out := make([]Report, len(state.Observations))
+		for i, v := range state.Observations {
+			out[i] = Report{
+				Key:    state.Key,
+				Values: v,
+			}
+		}
+		return out
+	}
+	bins := newStringSet()
+	for _, bin := range state.Bins {
+		bins.add(bin)
+	}
+	d.bins.union(bins)
+	for _, v := range state.Observations {
+		d.values.add(Report{Values: v}.Fingerprint())
+	}
+	d.observations = append(d.observations, state.Observations...)
+	return d.release(state.Key, threshold, condition)
+}
+
+// If the dam has reached the `threshold` under `condition`, the dam bursts,
+// returning all the stored reports.
+func (d *dam) release(key Key, threshold int, condition ReleaseCondition) []Report {
+	if condition.satisfied(d.bins.len(), d.values.len(), threshold) {
 		// The dam bursts.
 		out := make([]Report, len(d.observations))
 		for i, v := range d.observations {
 			out[i] = Report{
-				Key:    report.Key,
+				Key:    key,
 				Values: v,
 			}
 		}
@@ -118,35 +490,359 @@ func (d *dam) add(report Report, threshold int) []Report {
 	return nil
 }
 
+// Returns the contents of the dam.  `d` must not be nil.
+func (d *dam) state(key Key) DamState {
+	return DamState{
+		Key:          key,
+		Bins:         d.bins.sorted(),
+		Observations: d.observations,
+	}
+}
+
+// FilterState is the state of a Filter, which can be carried over to a
+// later Filter (see WithFilterState).  This allows a server that processes a
+// day's reports in several chunks (e.g. hourly log files) to accumulate bins
+// across the whole day.
+type FilterState struct {
+	// The dams that have not burst.
+	Pending []DamState
+	// The Keys whose dams have burst.  New reports for these Keys are
+	// released immediately.
+	Released []Key
+}
+
+// Prune discards the state for Keys dated before `date`.  Keys include the
+// date, so each day's dams are independent, and reports held for a past date
+// are discarded when its state is pruned.  Servers should prune the state
+// once reports for a date are no longer expected (e.g. a day after the date
+// ends, to allow for delayed queries), so that the state does not grow
+// without bound.
+func (s *FilterState) Prune(date time.Time) {
+	pending := s.Pending[:0]
+	for _, d := range s.Pending {
+		if !d.Key.Date.Before(date) {
+			pending = append(pending, d)
+		}
+	}
+	s.Pending = pending
+	released := s.Released[:0]
+	for _, key := range s.Released {
+		if !key.Date.Before(date) {
+			released = append(released, key)
+		}
+	}
+	s.Released = released
+}
+
+// Optional configuration for Filter.  The zero value is the default.
+type filterConfig struct {
+	initial   []DamState
+	pending   func([]DamState)
+	state     *FilterState
+	condition ReleaseCondition
+	clock     Clock
+	maxAge    time.Duration
+	anonymity func(Key, int)
+}
+
+// FilterOption configures optional behavior of Filter.
+type FilterOption func(*filterConfig)
+
+// WithDamStates provides partial state (e.g. from another shard) to merge
+// into the Filter before it reads any input.  Reports held in `states` are
+// released as soon as the merged bins reach the threshold.
+func WithDamStates(states []DamState) FilterOption {
+	return func(c *filterConfig) {
+		c.initial = append(c.initial, states...)
+	}
+}
+
+// WithPendingStates arranges for `f` to be called with the state of every
+// dam that has not burst, after the input channel is closed and before the
+// output channel is closed.  The states can be passed to another Filter
+// using WithDamStates.
+func WithPendingStates(f func([]DamState)) FilterOption {
+	return func(c *filterConfig) {
+		c.pending = f
+	}
+}
+
+// WithFilterState starts the Filter from `state`, and replaces `state` with
+// the Filter's final state after the input channel is closed (but not if the
+// Filter is canceled).  Passing the same FilterState to a series of Filters
+// makes the threshold apply to all of their input combined, as if it had
+// been passed to a single Filter.  `state` must not be accessed while a
+// Filter is using it.  See FilterState.Prune.
+func WithFilterState(state *FilterState) FilterOption {
+	return func(c *filterConfig) {
+		c.state = state
+	}
+}
+
+// ReleaseCondition determines what must reach the threshold before Filter
+// releases the reports for a Key.  See WithReleaseCondition.
+type ReleaseCondition int
+
+const (
+	// ReleaseOnBins releases the reports for a Key once they are in
+	// `threshold` distinct bins.  This provides k-anonymity for users: the
+	// reports are only released if they probably came from at least
+	// `threshold` users.  This is the default.
+	ReleaseOnBins ReleaseCondition = iota
+	// ReleaseOnValues releases the reports for a Key once they have
+	// `threshold` distinct tuples of values.  This protects the rarity of
+	// values: the output never reveals that only a few distinct values were
+	// reported for a Key.  It does not protect users: a single user whose
+	// reports have several distinct values (e.g. over several days, or with
+	// WithDedupValues) can release them on their own.
+	ReleaseOnValues
+	// ReleaseOnBinsAndValues releases the reports for a Key once they are in
+	// `threshold` distinct bins and have `threshold` distinct tuples of
+	// values, which provides both protections.
+	ReleaseOnBinsAndValues
+)
+
+// Reports whether a dam with this many distinct `bins` and `values` has
+// reached `threshold`.
+func (c ReleaseCondition) satisfied(bins, values, threshold int) bool {
+	switch c {
+	case ReleaseOnValues:
+		return values >= threshold
+	case ReleaseOnBinsAndValues:
+		return bins >= threshold && values >= threshold
+	}
+	return bins >= threshold
+}
+
+// WithReleaseCondition sets the ReleaseCondition of the Filter.  The default
+// is ReleaseOnBins.  FilterReport always uses ReleaseOnBins.
+func WithReleaseCondition(c ReleaseCondition) FilterOption {
+	return func(config *filterConfig) {
+		config.condition = c
+	}
+}
+
+// WithFilterClock sets the source of the current time for date handling in
+// the Filter (see WithMaxKeyAge).  The default is time.Now.  This allows
+// tests to advance time deterministically, including across midnight UTC.
+func WithFilterClock(clock Clock) FilterOption {
+	return func(c *filterConfig) {
+		c.clock = clock
+	}
+}
+
+// WithMaxKeyAge makes the Filter discard its state for Keys dated before the
+// date `age` ago, as if by FilterState.Prune, and drop any reports for those
+// Keys that arrive later.  Reports held for a discarded Key are never
+// released.  This bounds the memory of a long-running Filter, without
+// restarting it.  The age should allow for delayed queries, e.g. 48 hours.
+// The default is to keep all state until the input is closed.
+func WithMaxKeyAge(age time.Duration) FilterOption {
+	return func(c *filterConfig) {
+		c.maxAge = age
+	}
+}
+
+// WithAnonymity arranges for `f` to be called with each Key whose reports
+// are released, and the number of distinct bins that had been observed for
+// it when its dam burst.  This is the k-anonymity actually achieved for the
+// Key, which can exceed the threshold (e.g. when reports from several shards
+// are merged), so downstream code can record it with the released reports.
+// A higher bin count means that the Key's reports probably came from more
+// users, and are better protected.  Reports that arrive after the dam has
+// burst are released without a further call, so the count is a lower bound
+// for them.  With ReleaseOnValues, the count can be below the threshold.
+//
+// `f` is called on the Filter's goroutine, before the reports that the burst
+// releases are delivered to the output channel.
+func WithAnonymity(f func(key Key, bins int)) FilterOption {
+	return func(c *filterConfig) {
+		c.anonymity = f
+	}
+}
+
 // Filter accepts a channel of reports (e.g. all the reports arriving at
 // the metrics server) and delivers them to the output channel only if
 // enough arrive to provide k-anonymity at the desired threshold.
 // Callers should close the input channel when finished, to allow
 // garbage-collection of any pending reports.
-func Filter(in <-chan Report, threshold int) <-chan Report {
+//
+// Filter retains state for every Key that it has seen until the input is
+// closed, so its memory usage grows with the number of distinct keys.
+// According to BenchmarkFilter, each Key whose dam has not burst costs
+// roughly 300 bytes plus its held values, and each burst Key costs roughly
+// the size of its map entry.  Long-running servers should therefore close
+// and restart the Filter periodically (e.g. daily, since the date is part of
+// the Key), or use FilterContext to bound its lifetime.
+//
+// Reports (and states, see WithDamStates) whose Key is not dated at midnight
+// UTC (see NewKey) are discarded.
+func Filter(in <-chan Report, threshold int, opts ...FilterOption) <-chan Report {
+	return FilterContext(context.Background(), in, threshold, opts...)
+}
+
+// FilterContext is like Filter, but also stops when `ctx` is canceled.
+// When that happens, the output channel is closed and any reports that have
+// not yet reached the threshold are discarded.  This allows a server to
+// shut down without leaking the Filter's goroutine and memory, even if the
+// input channel is never closed.
+func FilterContext(ctx context.Context, in <-chan Report, threshold int, opts ...FilterOption) <-chan Report {
 	out := make(chan Report)
 	go func() {
-		pending := make(map[Key]*dam)
-		for report := range in {
-			d, ok := pending[report.Key]
-			if !ok {
-				d = &dam{bins: make(map[string]observed)}
-				pending[report.Key] = d
+		defer close(out)
+		filter(ctx, in, threshold, opts, func(r Report, burst bool) bool {
+			select {
+			case out <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// Release is a Report delivered by FilterReleases, with the reason that it
+// was released.
+type Release struct {
+	Report
+	// True if the report was held behind the dam for its Key, and released
+	// when the Key reached the threshold.  False if the dam had already
+	// burst when the report arrived (or when its state was merged), so it
+	// passed straight through.
+	Burst bool
+}
+
+// FilterReleases is like FilterContext, but indicates whether each report
+// was part of the batch released when its Key reached the threshold, or
+// passed through afterward.  The batch released at the burst is the first
+// k-anonymous sample for the Key, which some analyses (e.g. estimation) need
+// to treat differently from the ongoing stream.
+func FilterReleases(ctx context.Context, in <-chan Report, threshold int, opts ...FilterOption) <-chan Release {
+	out := make(chan Release)
+	go func() {
+		defer close(out)
+		filter(ctx, in, threshold, opts, func(r Report, burst bool) bool {
+			select {
+			case out <- Release{Report: r, Burst: burst}:
+				return true
+			case <-ctx.Done():
+				return false
 			}
-			released := d.add(report, threshold)
-			if released != nil {
-				// The dam has burst.
-				if d != nil {
-					// Replace the dam with nil (which acts as
-					// a burst dam) as a memory optimization.
-					pending[report.Key] = nil
+		})
+	}()
+	return out
+}
+
+// Runs a Filter, passing each released report to `send`, along with whether
+// it was released by a burst.  `send` returns false if ctx was canceled.
+// Returns when the input is closed or ctx is canceled.
+func filter(ctx context.Context, in <-chan Report, threshold int, opts []FilterOption, send func(r Report, burst bool) bool) {
+	var config filterConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	clock := config.clock
+	if clock == nil {
+		clock = time.Now
+	}
+	pending := make(map[Key]*dam)
+	// Keys dated before `cutoff` have expired (if maxAge is set).
+	var cutoff time.Time
+	// Returns true if `key` has expired, after discarding the state for
+	// any Keys that have expired since the last call.
+	expired := func(key Key) bool {
+		if config.maxAge <= 0 {
+			return false
+		}
+		if c := TruncateDate(clock().Add(-config.maxAge)); c.After(cutoff) {
+			cutoff = c
+			for k := range pending {
+				if k.Date.Before(cutoff) {
+					delete(pending, k)
 				}
-				for _, r := range released {
-					out <- r
+			}
+		}
+		return key.Date.Before(cutoff)
+	}
+	// Returns the dam for `key`, creating it if necessary.
+	get := func(key Key) *dam {
+		d, ok := pending[key]
+		if !ok {
+			d = newDam()
+			pending[key] = d
+		}
+		return d
+	}
+	// Delivers any reports released by `d`.  Returns false if ctx was
+	// canceled.
+	emit := func(key Key, d *dam, released []Report) bool {
+		if released != nil {
+			if d != nil && config.anonymity != nil {
+				config.anonymity(key, d.bins.len())
+			}
+			// The dam has burst.  Replace the dam with nil (which acts
+			// as a burst dam) as a memory optimization.
+			pending[key] = nil
+			for _, r := range released {
+				if !send(r, d != nil) {
+					return false
 				}
 			}
 		}
-		close(out)
-	}()
-	return out
+		return true
+	}
+	initial := config.initial
+	if config.state != nil {
+		for _, key := range config.state.Released {
+			pending[key] = nil
+		}
+		initial = append(append([]DamState(nil), config.state.Pending...), initial...)
+	}
+	for _, state := range initial {
+		if state.Key.validate() != nil || expired(state.Key) {
+			continue
+		}
+		d := get(state.Key)
+		if !emit(state.Key, d, d.merge(state, threshold, config.condition)) {
+			return
+		}
+	}
+	for {
+		select {
+		case report, ok := <-in:
+			if !ok {
+				var states []DamState
+				var released []Key
+				for key, d := range pending {
+					if d != nil {
+						states = append(states, d.state(key))
+					} else {
+						released = append(released, key)
+					}
+				}
+				if config.pending != nil {
+					config.pending(states)
+				}
+				if config.state != nil {
+					*config.state = FilterState{
+						Pending:  states,
+						Released: released,
+					}
+				}
+				return
+			}
+			// A Key that isn't dated at midnight would have its own dam,
+			// separate from the other reports for the same day.
+			if report.Key.validate() != nil || expired(report.Key) {
+				continue
+			}
+			d := get(report.Key)
+			if !emit(report.Key, d, d.add(report, threshold, config.condition)) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,170 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"errors"
+	"sync"
+)
+
+// DamStore holds the dams used by FilterReport, so that the state of the
+// k-anonymity filter can live outside the process (e.g. in a database).
+// This allows stateless collectors, such as serverless functions, to apply
+// the threshold to all the reports that they receive collectively.
+//
+// Implementations must be safe for concurrent use, including by several
+// processes that share the same backing store, so AddBin and Release must
+// each be atomic.
+type DamStore interface {
+	// AddBin adds a report's `bin` and `values` to the dam for `key`, unless
+	// the dam has burst.  It returns the number of distinct bins in the dam,
+	// and whether the dam had already burst.  Bins must be combined by union
+	// (see DamState).
+	AddBin(key Key, bin string, values []Value) (bins int, burst bool, err error)
+	// Release marks the dam for `key` as burst, and returns the values of
+	// the reports that it held.  If the dam has already burst, it returns
+	// nil, so only one caller releases each report.
+	Release(key Key) ([][]Value, error)
+	// Get returns the state of the dam for `key`, and whether it has burst.
+	Get(key Key) (state DamState, burst bool, err error)
+	// Put replaces the state of the dam for `state.Key`, which must not have
+	// burst, or returns an error if it has.  This allows state to be imported
+	// (e.g. from Filter).
+	Put(state DamState) error
+}
+
+// FilterReport is the stateless equivalent of Filter.  It adds `report` (as
+// returned by ParseReport) to its dam in `store`, and returns any reports
+// that are released by the dam.  It returns an error if the report's Key is
+// not dated at midnight UTC (see NewKey).
+func FilterReport(store DamStore, report Report, threshold int) ([]Report, error) {
+	if report.bin == "" {
+		return nil, errors.New("Report is missing bin")
+	}
+	if err := report.Key.validate(); err != nil {
+		return nil, err
+	}
+	bins, burst, err := store.AddBin(report.Key, report.bin, report.Values)
+	if err != nil {
+		return nil, err
+	}
+	if burst {
+		return []Report{{Key: report.Key, Values: report.Values}}, nil
+	}
+	if bins < threshold {
+		return nil, nil
+	}
+	observations, err := store.Release(report.Key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Report, len(observations))
+	for i, v := range observations {
+		out[i] = Report{
+			Key:    report.Key,
+			Values: v,
+		}
+	}
+	return out, nil
+}
+
+// MemoryDamStore implements DamStore in memory, with the same behavior as
+// Filter.  It is useful for testing, and for collectors that run in a single
+// long-lived process.
+type MemoryDamStore struct {
+	mu   sync.Mutex // Protects `dams`.
+	dams map[Key]*dam
+}
+
+// NewMemoryDamStore returns an empty MemoryDamStore.
+func NewMemoryDamStore() *MemoryDamStore {
+	return &MemoryDamStore{dams: make(map[Key]*dam)}
+}
+
+func (s *MemoryDamStore) AddBin(key Key, bin string, values []Value) (int, bool, error) {
+	if err := key.validate(); err != nil {
+		return 0, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.dams[key]
+	if !ok {
+		d = newDam()
+		s.dams[key] = d
+	} else if d == nil {
+		// A nil dam has burst.
+		return 0, true, nil
+	}
+	d.bins.add(bin)
+	d.observations = append(d.observations, values)
+	return d.bins.len(), false, nil
+}
+
+func (s *MemoryDamStore) Release(key Key) ([][]Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.dams[key]
+	s.dams[key] = nil
+	if d == nil {
+		return nil, nil
+	}
+	return d.observations, nil
+}
+
+func (s *MemoryDamStore) Get(key Key) (DamState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.dams[key]
+	if !ok {
+		return DamState{Key: key}, false, nil
+	} else if d == nil {
+		return DamState{Key: key}, true, nil
+	}
+	state := d.state(key)
+	// The caller must not be able to modify the stored observations.
+	state.Observations = cloneObservations(state.Observations)
+	return state, false, nil
+}
+
+func (s *MemoryDamStore) Put(state DamState) error {
+	if err := state.Key.validate(); err != nil {
+		return err
+	}
+	d := newDam()
+	for _, bin := range state.Bins {
+		d.bins.add(bin)
+	}
+	d.observations = cloneObservations(state.Observations)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.dams[state.Key]; ok && old == nil {
+		// Replacing a burst dam would release its reports again.
+		return errors.New("Dam has already burst")
+	}
+	s.dams[state.Key] = d
+	return nil
+}
+
+// Returns a copy of `observations` that shares no slices with it.
+func cloneObservations(observations [][]Value) [][]Value {
+	if observations == nil {
+		return nil
+	}
+	out := make([][]Value, len(observations))
+	for i, values := range observations {
+		out[i] = append([]Value(nil), values...)
+	}
+	return out
+}
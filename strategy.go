@@ -0,0 +1,131 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"crypto/rand"
+	"io"
+	"math/big"
+)
+
+// BurstStrategy selects which of the reports in a burst are sent.  A new
+// BurstStrategy is created for each burst (see WithBurstStrategy), so
+// implementations only need to consider a single burst, and are not called
+// concurrently.
+//
+// Every report that is sent from a burst can be correlated with the others,
+// because they are sent together, so strategies that select more than one
+// report weaken the protection that burst suppression provides.
+type BurstStrategy interface {
+	// Observe is called with each report in the burst, in order.
+	Observe(Report) error
+	// Selected returns the reports that would be sent if the burst ended
+	// now, without modifying the strategy.  It is called at the end of the
+	// burst, to select the reports to send, and may also be called earlier
+	// for debugging.
+	Selected() []Report
+}
+
+// reservoir selects up to `size` reports uniformly at random from a stream of
+// reports of unknown length (reservoir sampling), using `random`.  Every
+// subset of `size` reports is equally likely to be selected, regardless of
+// their order.
+type reservoir struct {
+	size     int
+	random   io.Reader // Source of randomness, normally crypto/rand.
+	count    int64     // Number of reports observed.
+	selected []Report
+}
+
+func newReservoir(size int) reservoir {
+	return reservoir{size: size, random: rand.Reader}
+}
+
+func (s *reservoir) Observe(r Report) error {
+	s.count++
+	if len(s.selected) < s.size {
+		s.selected = append(s.selected, r)
+		return nil
+	}
+	// Maintain a uniformly random selection by replacing a selected report
+	// with decreasing probability.
+	i, err := rand.Int(s.random, big.NewInt(s.count))
+	if err != nil {
+		return err
+	} else if j := i.Int64(); j < int64(s.size) {
+		// The probability of reaching this point is size/count.
+		s.selected[j] = r
+	}
+	return nil
+}
+
+// Selected returns a copy of the selected reports, which are all the reports
+// if fewer than `size` have been observed.
+func (s *reservoir) Selected() []Report {
+	if len(s.selected) == 0 {
+		return nil
+	}
+	return append([]Report(nil), s.selected...)
+}
+
+// reservoirStrategy implements BurstStrategy by selecting one report
+// uniformly at random.
+type reservoirStrategy struct {
+	reservoir
+}
+
+// NewReservoirStrategy returns a BurstStrategy that selects one report from
+// the burst uniformly at random.  This is the default.  The choice reveals
+// nothing about the order of the reports, or about which of them triggered
+// the burst.
+func NewReservoirStrategy() BurstStrategy {
+	return &reservoirStrategy{newReservoir(1)}
+}
+
+// NewReservoirStrategyFrom is like NewReservoirStrategy, but reads random
+// bytes from `random` instead of crypto/rand.  This is intended for tests:
+// a fixed input makes the selection predictable (e.g. a stream of zeros
+// always selects the last report).  If `random` returns an error, the
+// report that was being observed is dropped.
+func NewReservoirStrategyFrom(random io.Reader) BurstStrategy {
+	r := newReservoir(1)
+	r.random = random
+	return &reservoirStrategy{r}
+}
+
+// firstStrategy implements BurstStrategy by selecting the first report.
+type firstStrategy struct {
+	selected []Report
+}
+
+// NewFirstStrategy returns a BurstStrategy that selects the first report in
+// each burst.  This is deterministic, which makes it easier to test and
+// reason about, but the first report is often the most revealing one: for
+// example, it is typically the domain of the webpage that the user opened,
+// rather than one of the resources that the page loaded.
+func NewFirstStrategy() BurstStrategy {
+	return &firstStrategy{}
+}
+
+func (s *firstStrategy) Observe(r Report) error {
+	if s.selected == nil {
+		s.selected = []Report{r}
+	}
+	return nil
+}
+
+func (s *firstStrategy) Selected() []Report {
+	return append([]Report(nil), s.selected...)
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validate checks report names against a Receiver's configuration,
+// and describes the result in a readable form.  This is useful for debugging
+// why a collector isn't seeing the expected reports.  It powers the
+// "choir validate" command (see cmd/choir), and can also be used in tests.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Jigsaw-Code/choir"
+)
+
+// Name parses `name` (a query name, with or without the trailing ".") using
+// `receiver`, and writes a description of the decoded report, or of the
+// reason that it doesn't parse, to `w`.  It returns the report, or the error
+// from Receiver.ParseReport.
+//
+// The description includes the bin, so it should only be used for debugging.
+func Name(w io.Writer, receiver *choir.Receiver, name string) (*choir.Report, error) {
+	report, err := receiver.ParseReport(name)
+	if err != nil {
+		var parseErr *choir.ParseError
+		if errors.As(err, &parseErr) {
+			fmt.Fprintf(w, "FAIL %s\n  %s\n", name, parseErr.Diagnostic())
+		} else {
+			fmt.Fprintf(w, "FAIL %s\n  %v\n", name, err)
+		}
+		return nil, err
+	}
+	fmt.Fprintf(w, "OK %s\n", name)
+	fmt.Fprintf(w, "  domain:  %s\n", report.Domain)
+	fmt.Fprintf(w, "  country: %s\n", report.Country)
+	fmt.Fprintf(w, "  date:    %s\n", report.Date.Format("2006-01-02"))
+	fmt.Fprintf(w, "  bin:     %s\n", report.Bin())
+	for i, v := range report.Values {
+		fmt.Fprintf(w, "  value %d: %s\n", i, v)
+	}
+	return report, nil
+}
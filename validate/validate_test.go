@@ -0,0 +1,57 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Jigsaw-Code/choir"
+)
+
+func TestName(t *testing.T) {
+	receiver := &choir.Receiver{Suffix: "metrics.example.com", Values: 2}
+	var out bytes.Buffer
+	report, err := Name(&out, receiver, "http.404.q.us.20191218.www.example.com.metrics.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Domain != "www.example.com" || report.Bin() != "q" {
+		t.Errorf("Wrong report: %v", report)
+	}
+	expected := `OK http.404.q.us.20191218.www.example.com.metrics.example.com.
+  domain:  www.example.com
+  country: us
+  date:    2019-12-18
+  bin:     q
+  value 0: http
+  value 1: 404
+`
+	if out.String() != expected {
+		t.Errorf("Wrong output: %q", out.String())
+	}
+}
+
+func TestNameFailure(t *testing.T) {
+	// The name only has one value.
+	receiver := &choir.Receiver{Suffix: "metrics.example.com", Values: 2}
+	var out bytes.Buffer
+	if _, err := Name(&out, receiver, "404.q.us.20191218.www.example.com.metrics.example.com"); err == nil {
+		t.Fatal("Expected an error due to the wrong number of values")
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte("FAIL ")) || !bytes.Contains(out.Bytes(), []byte("expected 2 values")) {
+		t.Errorf("Expected a diagnostic: %q", out.String())
+	}
+}
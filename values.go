@@ -0,0 +1,366 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choir
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Units for formatting durations, from largest to smallest.
+var durationUnits = [...]struct {
+	unit   time.Duration
+	suffix string
+}{
+	{time.Hour, "h"},
+	{time.Minute, "m"},
+	{time.Second, "s"},
+	{time.Millisecond, "ms"},
+	{time.Microsecond, "us"},
+	{time.Nanosecond, "ns"},
+}
+
+// NewDurationValue converts `d` to a Value, after rounding it to the nearest
+// multiple of `bucket`.  The Value is an integer followed by the largest unit
+// that represents it exactly, e.g. "150ms", "90s", or "2h".
+//
+// Precise times and durations are potentially identifying: an exact latency
+// or timestamp could be matched against other logs to single out a user, and
+// every distinct value fragments the reports for a domain.  Callers should
+// choose the coarsest bucket that is still useful, e.g. 50ms for latencies.
+func NewDurationValue(d, bucket time.Duration) (Value, error) {
+	if bucket <= 0 {
+		return Value{}, fmt.Errorf("Bucket must be positive: %v", bucket)
+	}
+	if d < 0 {
+		return Value{}, fmt.Errorf("Duration must not be negative: %v", d)
+	}
+	d = d.Round(bucket)
+	if d == 0 {
+		return NewValue("0s")
+	}
+	for _, u := range durationUnits {
+		if d%u.unit == 0 {
+			return NewValue(strconv.FormatInt(int64(d/u.unit), 10) + u.suffix)
+		}
+	}
+	panic("Unreachable: every duration is a multiple of 1ns")
+}
+
+// The maximum length of the decimal representation of powerOfTwoBucket.
+const maxBucketLength = 19
+
+// Returns the largest power of two that is less than or equal to `n`, or zero
+// if `n` is less than one.  Exponential buckets reveal the order of magnitude
+// of a count, without revealing its precise value.
+func powerOfTwoBucket(n int64) int64 {
+	if n < 1 {
+		return 0
+	}
+	bucket := int64(1)
+	for bucket <= n/2 {
+		bucket *= 2
+	}
+	return bucket
+}
+
+// KVSeparator separates the key from the value in a Value produced by
+// NewKVValue.
+const KVSeparator = "-"
+
+// NewKVValue encodes a key-value pair as a single Value, e.g. "status-404"
+// for NewKVValue("status", "404").  The key must be non-empty and must not
+// contain KVSeparator, so that the pair can be recovered by splitting at the
+// first separator.  The combined Value must be a valid Value, including the
+// limit of 63 bytes.
+func NewKVValue(key, value string) (Value, error) {
+	if key == "" {
+		return Value{}, fmt.Errorf("Key must not be empty")
+	}
+	if strings.Contains(key, KVSeparator) {
+		return Value{}, fmt.Errorf("Key cannot contain %q: %s", KVSeparator, key)
+	}
+	return NewValue(key + KVSeparator + value)
+}
+
+// ParseKVValue inverts NewKVValue.
+func ParseKVValue(v Value) (key, value string, err error) {
+	parts := strings.SplitN(v.String(), KVSeparator, 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Not a key-value pair: %s", v)
+	}
+	return parts[0], parts[1], nil
+}
+
+// NewBoolValue encodes `b` as the Value "1" (true) or "0" (false).
+func NewBoolValue(b bool) Value {
+	if b {
+		return Value{"1"}
+	}
+	return Value{"0"}
+}
+
+// ParseBoolValue inverts NewBoolValue.
+func ParseBoolValue(v Value) (bool, error) {
+	switch v.String() {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Not a boolean: %s", v)
+}
+
+// NewEnumValue encodes `index`, one of `max` possible options, as a Value
+// containing its decimal representation without leading zeros (e.g. "0",
+// "7", or "12").  The caller is responsible for assigning a stable index to
+// each option; appending new options preserves the meaning of old values.
+func NewEnumValue(index, max int) (Value, error) {
+	if index < 0 || index >= max {
+		return Value{}, fmt.Errorf("Enum index out of range: %d not in [0, %d)", index, max)
+	}
+	return Value{strconv.Itoa(index)}, nil
+}
+
+// ParseEnumValue inverts NewEnumValue, and checks that the index is less than
+// `max`.
+func ParseEnumValue(v Value, max int) (int, error) {
+	s := v.String()
+	if s == "" || !isDigits(s) || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("Not an enum index: %s", v)
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if index >= max {
+		return 0, fmt.Errorf("Enum index out of range: %d not in [0, %d)", index, max)
+	}
+	return index, nil
+}
+
+// NewCountValue encodes the count `n` as the largest power of two that is less
+// than or equal to `n` (e.g. "1", "2", "4", "8"), or "0" if `n` is less than
+// one.  Exponential buckets reveal the order of magnitude of a count, without
+// revealing its precise value.  See Counter.
+func NewCountValue(n int64) Value {
+	// The bucket label is always a valid Value.
+	return Value{strconv.FormatInt(powerOfTwoBucket(n), 10)}
+}
+
+// MaxTimeOfDayBuckets is the most buckets accepted by NewTimeOfDayBucket,
+// i.e. one per hour.
+const MaxTimeOfDayBuckets = 24
+
+// NewTimeOfDayBucket divides the day into `buckets` equal slots (e.g. 4 for
+// quarters of the day), and encodes the slot that contains the time of day
+// of `t` as an enum value (see NewEnumValue and ParseEnumValue), from "0"
+// for the slot starting at midnight to buckets-1.  This reveals roughly when
+// an event happened, without its precise timing.
+//
+// Finer buckets reveal more about the user's routine, and make reports from
+// the same user easier to link, so applications should use the coarsest
+// buckets that answer their question.  At most MaxTimeOfDayBuckets are
+// allowed.
+//
+// The time of day is taken in the location of `t`.  Reports are dated in
+// UTC, so a value computed from t.UTC() lines up with the report's date,
+// while one computed in the user's local zone describes their day but also
+// reveals a little about where they are.  Either way, all clients that
+// report the same metric must use the same convention.
+func NewTimeOfDayBucket(t time.Time, buckets int) (Value, error) {
+	if buckets < 1 || buckets > MaxTimeOfDayBuckets {
+		return Value{}, fmt.Errorf("Time of day buckets out of range: %d not in [1, %d]", buckets, MaxTimeOfDayBuckets)
+	}
+	hour, min, sec := t.Clock()
+	seconds := (hour*60+min)*60 + sec
+	return NewEnumValue(seconds*buckets/(24*60*60), buckets)
+}
+
+// MaxSeverity is the highest level accepted by NewSeverityValue.
+const MaxSeverity = 9
+
+// The prefix of a severity Value.
+const severityPrefix = "s"
+
+// NewSeverityValue encodes a severity `level`, from 0 (least severe) to
+// MaxSeverity, as the Value "s0" through "s9".  Severities are a standard,
+// ordered dimension, so the server can compare them (see SeverityRange)
+// without interpreting free-form values.
+//
+// With ReleaseOnValues (or ReleaseOnBinsAndValues), each distinct severity is
+// a distinct value, so a Key whose only value is a severity can reach at most
+// MaxSeverity+1 distinct values, and thresholds above that are never
+// satisfied.  Once released, the reports reveal every level that was
+// reported, including a rare extreme level that was carried over the
+// threshold by the more common ones.  Applications that need to protect rare
+// levels should use fewer, coarser levels.
+func NewSeverityValue(level int) (Value, error) {
+	if level < 0 || level > MaxSeverity {
+		return Value{}, fmt.Errorf("Severity out of range: %d not in [0, %d]", level, MaxSeverity)
+	}
+	return Value{severityPrefix + strconv.Itoa(level)}, nil
+}
+
+// ParseSeverityValue inverts NewSeverityValue.
+func ParseSeverityValue(v Value) (int, error) {
+	s := v.String()
+	if len(s) != len(severityPrefix)+1 || !strings.HasPrefix(s, severityPrefix) || !isDigits(s[len(severityPrefix):]) {
+		return 0, fmt.Errorf("Not a severity: %s", v)
+	}
+	return int(s[len(severityPrefix)] - '0'), nil
+}
+
+// SeverityRange returns the lowest and highest severity in the value at
+// `index` of each report (e.g. the reports released for a Key), ignoring
+// reports where that value is missing or not a severity.  `ok` is false if
+// there are no severities.
+func SeverityRange(reports []Report, index int) (min, max int, ok bool) {
+	for _, r := range reports {
+		if index < 0 || index >= len(r.Values) {
+			continue
+		}
+		level, err := ParseSeverityValue(r.Values[index])
+		if err != nil {
+			continue
+		}
+		if !ok || level < min {
+			min = level
+		}
+		if !ok || level > max {
+			max = level
+		}
+		ok = true
+	}
+	return min, max, ok
+}
+
+// Markers at the start of each label produced by SplitValue.
+const (
+	splitMore    = "1" // Another chunk follows.
+	splitLast    = "0" // This is the last chunk.
+	splitPadding = "-" // A label after the last chunk.
+)
+
+// The number of bytes of `s` in each label produced by SplitValue.
+const splitChunkSize = 63 - len(splitMore)
+
+// SplitValue splits `s`, which may be longer than a single Value, across
+// exactly `labels` Values, so that it can be reported as `labels`
+// consecutive values of a Report, and recovered by JoinValues.  `s` must
+// otherwise be a valid Value (lower-case ASCII without "."), and at most
+// 62 bytes fit in each label.
+//
+// Each label starts with a marker: "1" if the next label continues `s`, or
+// "0" if it is the last chunk of `s`.  The remaining labels are "-", so that
+// every report has the same number of values regardless of the length of
+// `s`, as the Receiver requires.  Long values consume the name's length
+// budget: a report whose name would be too long is rejected by the Reporter
+// with ErrNameTooLong (see WithMaxSuffixLength).
+func SplitValue(s string, labels int) ([]Value, error) {
+	if labels < 1 || labels > maxValues {
+		return nil, fmt.Errorf("Unreasonable number of labels: %d", labels)
+	}
+	if len(s) > labels*splitChunkSize {
+		return nil, fmt.Errorf("Value is too long for %d labels: %d > %d bytes", labels, len(s), labels*splitChunkSize)
+	}
+	values := make([]Value, 0, labels)
+	for {
+		chunk, marker := s, splitLast
+		if len(s) > splitChunkSize {
+			chunk, marker = s[:splitChunkSize], splitMore
+		}
+		s = s[len(chunk):]
+		// NewValue checks the characters of each chunk.
+		v, err := NewValue(marker + chunk)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if marker == splitLast {
+			break
+		}
+	}
+	for len(values) < labels {
+		values = append(values, Value{splitPadding})
+	}
+	return values, nil
+}
+
+// JoinValues inverts SplitValue, e.g. on the values of a Report parsed by a
+// Receiver.  It returns an error if `values` were not produced by SplitValue.
+func JoinValues(values []Value) (string, error) {
+	var b strings.Builder
+	for i, v := range values {
+		s := v.String()
+		switch {
+		case strings.HasPrefix(s, splitMore):
+			b.WriteString(s[len(splitMore):])
+		case strings.HasPrefix(s, splitLast):
+			b.WriteString(s[len(splitLast):])
+			for _, p := range values[i+1:] {
+				if p.String() != splitPadding {
+					return "", fmt.Errorf("Expected padding after the last chunk, got %q", p)
+				}
+			}
+			return b.String(), nil
+		default:
+			return "", fmt.Errorf("Label %d is not a chunk of a split value: %q", i, s)
+		}
+	}
+	return "", errors.New("Split value is missing its last chunk")
+}
+
+// ValuePolicy checks that a Value is acceptable at a particular position in
+// a report, and returns an error if it is not.  The parse functions in this
+// package can be adapted as policies, e.g.
+//
+//	func(v Value) error { _, err := ParseEnumValue(v, 4); return err }
+//
+// See WithValuePolicies.
+type ValuePolicy func(Value) error
+
+// AllowedValues returns a ValuePolicy that only accepts the listed values.
+func AllowedValues(values ...string) ValuePolicy {
+	allowed := newStringSet()
+	for _, v := range values {
+		allowed.add(v)
+	}
+	return func(v Value) error {
+		if !allowed.contains(v.String()) {
+			return fmt.Errorf("Value is not allowed: %s", v)
+		}
+		return nil
+	}
+}
+
+// ValueError is the error returned when a value violates its ValuePolicy.
+type ValueError struct {
+	// The position of the value in the report.
+	Index int
+	// The error returned by the policy.
+	Err error
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("Value %d: %v", e.Index, e.Err)
+}
+
+func (e *ValueError) Unwrap() error {
+	return e.Err
+}